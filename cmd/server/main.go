@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/user/homelab-speedtest/internal/api"
 	"github.com/user/homelab-speedtest/internal/config"
@@ -40,6 +41,90 @@ func main() {
 		}
 	}
 
+	// WORKER_PORT_RANGE ("8090-8099", or "ephemeral") takes over from WORKER_PORT
+	workerPorts := orchestrator.PortRange{Min: workerPort, Max: workerPort}
+	if v := os.Getenv("WORKER_PORT_RANGE"); v != "" {
+		if r, err := orchestrator.ParsePortRange(v); err == nil {
+			workerPorts = r
+		} else {
+			log.Printf("Invalid WORKER_PORT_RANGE %q, using %s", v, workerPorts)
+		}
+	}
+
+	pingCount := 10
+	if v := os.Getenv("PING_COUNT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			pingCount = n
+		}
+	}
+
+	pingInterval := 200 * time.Millisecond
+	if v := os.Getenv("PING_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			pingInterval = d
+		}
+	}
+
+	pingPayloadSize := 64
+	if v := os.Getenv("PING_PAYLOAD_SIZE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			pingPayloadSize = n
+		}
+	}
+
+	speedDirection := orchestrator.DirectionForward
+	if v := os.Getenv("SPEEDTEST_DIRECTION"); v != "" {
+		switch v {
+		case orchestrator.DirectionForward, orchestrator.DirectionReverse, orchestrator.DirectionBidir:
+			speedDirection = v
+		default:
+			log.Printf("Invalid SPEEDTEST_DIRECTION %q, using %s", v, speedDirection)
+		}
+	}
+
+	speedParallel := 1
+	if v := os.Getenv("SPEEDTEST_PARALLEL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			speedParallel = n
+		}
+	}
+
+	serverStartTimeout := orchestrator.DefaultServerStartTimeout
+	if v := os.Getenv("WORKER_STARTUP_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			serverStartTimeout = d
+		}
+	}
+
+	sshIdleTTL := orchestrator.DefaultSSHIdleTTL
+	if v := os.Getenv("SSH_IDLE_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			sshIdleTTL = d
+		}
+	}
+
+	agentTimeout := orchestrator.DefaultAgentTimeout
+	if v := os.Getenv("AGENT_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			agentTimeout = d
+		}
+	}
+
+	// Tests get TEST_TIMEOUT on top of their own duration; whole tasks are
+	// only bounded when TASK_TIMEOUT is set
+	testTimeout := orchestrator.DefaultTestTimeout
+	if v := os.Getenv("TEST_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			testTimeout = d
+		}
+	}
+	var taskTimeout time.Duration
+	if v := os.Getenv("TASK_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			taskTimeout = d
+		}
+	}
+
 	cfg := config.Config{
 		Server:   config.ServerConfig{Port: serverPort},
 		Database: config.DatabaseConfig{Path: dbPath},
@@ -54,6 +139,24 @@ func main() {
 		log.Fatalf("Failed to init db: %v", err)
 	}
 
+	// Device secrets are encrypted with MASTER_KEY, or a key generated next to the database
+	var masterKey []byte
+	if v := os.Getenv("MASTER_KEY"); v != "" {
+		masterKey, err = db.ParseMasterKey(v)
+	} else {
+		keyPath := os.Getenv("MASTER_KEY_FILE")
+		if keyPath == "" {
+			keyPath = filepath.Join(filepath.Dir(cfg.Database.Path), "master.key")
+		}
+		masterKey, err = db.LoadMasterKey(keyPath)
+	}
+	if err != nil {
+		log.Fatalf("Failed to load master key: %v", err)
+	}
+	if err := database.SetMasterKey(masterKey); err != nil {
+		log.Fatalf("Failed to set master key: %v", err)
+	}
+
 	// Seed default schedules if none exist
 	seedDefaultSchedules(database)
 
@@ -61,19 +164,62 @@ func main() {
 	// Assume worker binary is in current dir or specific path
 	workerPath := "./worker"
 	orch := orchestrator.NewOrchestrator(workerPath, workerPort)
-	log.Printf("Worker port configured: %d", workerPort)
+	orch.PortRange = workerPorts
+	orch.SpeedDirection = speedDirection
+	orch.SpeedParallel = speedParallel
+	orch.PingCount = pingCount
+	orch.PingInterval = pingInterval
+	orch.PingPayloadSize = pingPayloadSize
+	orch.ServerStartTimeout = serverStartTimeout
+
+	// Host keys are pinned on first use; SSH_KNOWN_HOSTS adds known_hosts files (colon separated) that take precedence
+	var knownHosts []string
+	if v := os.Getenv("SSH_KNOWN_HOSTS"); v != "" {
+		knownHosts = filepath.SplitList(v)
+	}
+	hostKeys, err := orchestrator.NewHostKeyStore(database, knownHosts...)
+	if err != nil {
+		log.Fatalf("Failed to init host key store: %v", err)
+	}
+	orch.HostKeys = hostKeys
+	orch.LookupDevice = database.GetDevice
+	orch.Pool.IdleTTL = sshIdleTTL
+	orch.OnWorkerDeployed = func(dev db.Device, info db.WorkerInfo) {
+		if err := database.SetWorkerInfo(dev.ID, info); err != nil {
+			log.Printf("Failed to record worker version of %s: %v", dev.Name, err)
+		}
+	}
+	orch.OnWorkerRemoved = func(dev db.Device) {
+		if err := database.ClearWorkerInfo(dev.ID); err != nil {
+			log.Printf("Failed to clear worker version of %s: %v", dev.Name, err)
+		}
+	}
+	orch.Agents.Timeout = agentTimeout
+	orch.Agents.OnHello = orch.OnWorkerDeployed
+	orch.Agents.OnHeartbeat = func(dev db.Device) {
+		if err := database.SetAgentSeen(dev.ID); err != nil {
+			log.Printf("Failed to record heartbeat of %s: %v", dev.Name, err)
+		}
+	}
+	log.Printf("Worker server ports: %s", workerPorts)
+	log.Printf("SSH connections kept open for %v when idle", sshIdleTTL)
+	log.Printf("Speed test defaults: direction=%s, streams=%d", speedDirection, speedParallel)
+	log.Printf("Ping probe train: count=%d, interval=%v, size=%dB", pingCount, pingInterval, pingPayloadSize)
+	log.Printf("Timeouts: %v per test on top of its duration, %v per task (0 = none)", testTimeout, taskTimeout)
 
 	// 4. Init Notification Manager
 	notifier := notify.NewManager(database)
 
 	// 5. Init Scheduler
 	scheduler := orchestrator.NewScheduler(database, orch)
-	scheduler.Start()
+	scheduler.TestTimeout = testTimeout
+	scheduler.TaskTimeout = taskTimeout
 
 	// 6. Init API
 	apiHandler := api.NewHandler(database, orch, scheduler, notifier)
 
-	// Wire up callbacks
+	// Wire up callbacks before starting the scheduler: tasks restored from the
+	// database run right away
 	scheduler.OnResult = func(result db.Result) {
 		apiHandler.BroadcastResult(result)
 		// Check alert rules and send notifications
@@ -83,6 +229,8 @@ func main() {
 	scheduler.OnStatus = apiHandler.BroadcastStatus
 	scheduler.OnScheduleInfo = apiHandler.BroadcastScheduleInfo
 	scheduler.OnQueueStatus = apiHandler.BroadcastQueueStatus
+	orch.Agents.OnStatus = apiHandler.BroadcastAgentStatus
+	scheduler.Start()
 
 	// 5. Start Server
 	// Serve UI static files (built from Svelte) at /
@@ -103,8 +251,8 @@ func main() {
 	}
 }
 
-// seedDefaultSchedules creates default ping and speed schedules if none exist.
-// Can be overridden with PING_SCHEDULE and SPEEDTEST_SCHEDULE environment variables.
+// seedDefaultSchedules creates default ping, speed and bufferbloat schedules if none exist.
+// Can be overridden with PING_SCHEDULE, SPEEDTEST_SCHEDULE and BUFFERBLOAT_SCHEDULE environment variables.
 func seedDefaultSchedules(database *db.DB) {
 	schedules, err := database.GetSchedules()
 	if err != nil {
@@ -115,6 +263,7 @@ func seedDefaultSchedules(database *db.DB) {
 	// Check which schedule types already exist
 	hasPing := false
 	hasSpeed := false
+	hasBufferbloat := false
 	for _, s := range schedules {
 		if s.Type == "ping" {
 			hasPing = true
@@ -122,6 +271,9 @@ func seedDefaultSchedules(database *db.DB) {
 		if s.Type == "speed" {
 			hasSpeed = true
 		}
+		if s.Type == "bufferbloat" {
+			hasBufferbloat = true
+		}
 	}
 
 	// Create ping schedule if not exists
@@ -149,4 +301,19 @@ func seedDefaultSchedules(database *db.DB) {
 			log.Printf("Created default speed schedule: %s", speedSchedule)
 		}
 	}
+
+	// Create bufferbloat schedule if not exists; it saturates links, so it starts
+	// disabled unless BUFFERBLOAT_SCHEDULE is set
+	if !hasBufferbloat {
+		bufferbloatSchedule := os.Getenv("BUFFERBLOAT_SCHEDULE")
+		enabled := bufferbloatSchedule != ""
+		if bufferbloatSchedule == "" {
+			bufferbloatSchedule = "1h"
+		}
+		if err := database.UpdateSchedule("bufferbloat", bufferbloatSchedule, enabled); err != nil {
+			log.Printf("Warning: failed to create default bufferbloat schedule: %v", err)
+		} else {
+			log.Printf("Created default bufferbloat schedule: %s (enabled=%v)", bufferbloatSchedule, enabled)
+		}
+	}
 }
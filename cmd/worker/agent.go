@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/user/homelab-speedtest/internal/orchestrator"
+)
+
+// modeAgent runs the worker as a daemon that dials out to the server
+const modeAgent = "agent"
+
+// agentTokenEnv holds the enrollment token when -token isn't given, keeping it out of ps
+const agentTokenEnv = "HL_SPEEDTEST_AGENT_TOKEN"
+
+// maxAgentBackoff caps the delay between reconnects
+const maxAgentBackoff = time.Minute
+
+// errAgentRejected means the server refused the token; retrying won't help
+var errAgentRejected = errors.New("the server rejected the agent token")
+
+// agent runs the requests the server pushes over its control channel by
+// executing its own binary with -stdin, like the server would over SSH
+type agent struct {
+	conn    *websocket.Conn
+	exe     string
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	jobs map[string]*agentJob
+}
+
+// agentJob is a worker started in the background
+type agentJob struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	exited chan struct{}
+}
+
+// runAgent keeps a control channel to the server open, reconnecting with
+// backoff until the server rejects the token
+func runAgent(server, token string) {
+	if token == "" {
+		token = os.Getenv(agentTokenEnv)
+	}
+	if server == "" || token == "" {
+		fmt.Fprintf(os.Stderr, "Agent mode needs -server and -token (or $%s)\n", agentTokenEnv)
+		os.Exit(1)
+	}
+	wsURL, err := agentURL(server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid server URL: %v\n", err)
+		os.Exit(1)
+	}
+
+	backoff := time.Second
+	for {
+		connected, err := serveAgent(wsURL, token)
+		if errors.Is(err, errAgentRejected) {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if connected {
+			backoff = time.Second
+		}
+		fmt.Fprintf(os.Stderr, "Agent disconnected: %v, reconnecting in %v\n", err, backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxAgentBackoff)
+	}
+}
+
+// agentURL turns the server's base URL into the URL of its agent endpoint
+func agentURL(server string) (string, error) {
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("%q has no host", server)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + orchestrator.AgentPath
+	return u.String(), nil
+}
+
+// serveAgent connects once and handles the server's messages until the
+// connection drops. connected reports whether the server accepted the agent.
+func serveAgent(wsURL, token string) (connected bool, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return false, err
+	}
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return false, fmt.Errorf("%w: %s", errAgentRejected, bytes.TrimSpace(body))
+		}
+		return false, err
+	}
+	a := &agent{conn: conn, exe: exe, jobs: map[string]*agentJob{}}
+	defer a.close()
+
+	hostname, _ := os.Hostname()
+	hello := orchestrator.AgentMessage{
+		Type:            orchestrator.AgentHello,
+		ProtocolVersion: orchestrator.ProtocolVersion,
+		WorkerVersion:   version,
+		WorkerPath:      exe,
+		WorkerSHA256:    fileSHA256(exe),
+		Arch:            orchestrator.HostArch(),
+		Hostname:        hostname,
+	}
+	if err := a.send(hello); err != nil {
+		return false, err
+	}
+	fmt.Fprintf(os.Stderr, "Agent connected to %s\n", wsURL)
+
+	done := make(chan struct{})
+	defer close(done)
+	go a.heartbeat(done)
+
+	for {
+		var msg orchestrator.AgentMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return true, err
+		}
+		switch msg.Type {
+		case orchestrator.AgentRun:
+			a.run(msg)
+		case orchestrator.AgentStart:
+			a.start(msg)
+		case orchestrator.AgentStop:
+			a.stop(msg.ID, time.Duration(msg.TimeoutMs)*time.Millisecond)
+		default:
+			fmt.Fprintf(os.Stderr, "Agent ignoring unexpected %q message\n", msg.Type)
+		}
+	}
+}
+
+func (a *agent) send(msg orchestrator.AgentMessage) error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	return a.conn.WriteJSON(msg)
+}
+
+func (a *agent) heartbeat(done chan struct{}) {
+	ticker := time.NewTicker(orchestrator.DefaultAgentHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := a.send(orchestrator.AgentMessage{Type: orchestrator.AgentHeartbeat}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// run runs the worker to completion and sends back its output. Like a
+// started worker it is registered before returning, so a stop can abort it.
+func (a *agent) run(msg orchestrator.AgentMessage) {
+	var stdout, stderr bytes.Buffer
+	reply := orchestrator.AgentMessage{Type: orchestrator.AgentResult, ID: msg.ID}
+	job, err := a.launch(msg.ID, &stdout, &stderr)
+	if err != nil {
+		reply.Error = err.Error()
+		_ = a.send(reply)
+		return
+	}
+	go func() {
+		if err := a.wait(msg.ID, job, msg.Input); err != nil {
+			reply.Error = err.Error()
+		}
+		reply.Stdout = strings.TrimSpace(stdout.String())
+		reply.Stderr = strings.TrimSpace(stderr.String())
+		_ = a.send(reply)
+	}()
+}
+
+// start starts the worker in the background and streams its output until it
+// exits. The job is registered before returning, so a stop can't overtake it.
+func (a *agent) start(msg orchestrator.AgentMessage) {
+	job, err := a.launch(msg.ID, &agentOutput{a: a, id: msg.ID}, &agentOutput{a: a, id: msg.ID, stderr: true})
+	if err != nil {
+		_ = a.send(orchestrator.AgentMessage{Type: orchestrator.AgentExit, ID: msg.ID, Error: err.Error()})
+		return
+	}
+	go func() {
+		exit := orchestrator.AgentMessage{Type: orchestrator.AgentExit, ID: msg.ID}
+		if err := a.wait(msg.ID, job, msg.Input); err != nil {
+			exit.Error = err.Error()
+		}
+		_ = a.send(exit)
+	}()
+}
+
+// launch starts the worker and registers it as job id
+func (a *agent) launch(id string, stdout, stderr io.Writer) (*agentJob, error) {
+	cmd := exec.Command(a.exe, "-stdin")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := &agentJob{cmd: cmd, stdin: stdin, exited: make(chan struct{})}
+	a.mu.Lock()
+	a.jobs[id] = job
+	a.mu.Unlock()
+	return job, nil
+}
+
+// wait feeds a job its input and waits for it to exit. Stdin stays open
+// meanwhile, like an SSH session's, so closing it is what stops the worker.
+func (a *agent) wait(id string, job *agentJob, input string) error {
+	_, _ = io.WriteString(job.stdin, input)
+	err := job.cmd.Wait()
+	close(job.exited)
+	a.mu.Lock()
+	delete(a.jobs, id)
+	a.mu.Unlock()
+	return err
+}
+
+// stop closes a worker's stdin, which makes it exit, and kills it if it
+// hasn't after timeout
+func (a *agent) stop(id string, timeout time.Duration) {
+	a.mu.Lock()
+	job := a.jobs[id]
+	a.mu.Unlock()
+	if job == nil {
+		return
+	}
+	_ = job.stdin.Close()
+	go func() {
+		select {
+		case <-job.exited:
+		case <-time.After(timeout):
+			_ = job.cmd.Process.Kill()
+		}
+	}()
+}
+
+// close drops the connection and stops the workers it started
+func (a *agent) close() {
+	_ = a.conn.Close()
+	a.mu.Lock()
+	ids := make([]string, 0, len(a.jobs))
+	for id := range a.jobs {
+		ids = append(ids, id)
+	}
+	a.mu.Unlock()
+	for _, id := range ids {
+		a.stop(id, 5*time.Second)
+	}
+}
+
+// agentOutput forwards what a started worker writes to the server
+type agentOutput struct {
+	a      *agent
+	id     string
+	stderr bool
+}
+
+func (w *agentOutput) Write(p []byte) (int, error) {
+	msg := orchestrator.AgentMessage{Type: orchestrator.AgentOutput, ID: w.id}
+	if w.stderr {
+		msg.Stderr = string(p)
+	} else {
+		msg.Stdout = string(p)
+	}
+	if err := w.a.send(msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// fileSHA256 returns the hex SHA-256 of a file, or "" if it can't be read
+func fileSHA256(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
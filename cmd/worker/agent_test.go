@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestAgentURL(t *testing.T) {
+	cases := []struct {
+		server, want string
+	}{
+		{"http://speedtest:8080", "ws://speedtest:8080/api/agent/ws"},
+		{"https://lab.example.com/speedtest/", "wss://lab.example.com/speedtest/api/agent/ws"},
+		{"speedtest:8080", "ws://speedtest:8080/api/agent/ws"},
+		{"wss://lab.example.com", "wss://lab.example.com/api/agent/ws"},
+	}
+	for _, c := range cases {
+		if got, err := agentURL(c.server); err != nil || got != c.want {
+			t.Errorf("agentURL(%q) = %q, %v, want %q", c.server, got, err, c.want)
+		}
+	}
+	for _, server := range []string{"ftp://speedtest", "http://"} {
+		if _, err := agentURL(server); err == nil {
+			t.Errorf("agentURL(%q) should fail", server)
+		}
+	}
+}
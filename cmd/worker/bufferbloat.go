@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/orchestrator"
+)
+
+// loadRampUp is the minimum time the TCP load runs before loaded probes start,
+// so the queues along the path have filled up
+const loadRampUp = 1 * time.Second
+
+// runBufferbloat measures latency on an idle path, then again while TCP streams
+// saturate it. The difference is the queueing delay added under load.
+func runBufferbloat(req orchestrator.WorkerRequest, resp *orchestrator.WorkerResponse) {
+	count, interval, size := probeOptions(req)
+	duration := defaultTestDuration
+	if req.DurationSeconds > 0 {
+		duration = time.Duration(req.DurationSeconds) * time.Second
+	}
+	rampUp := max(time.Duration(max(req.OmitSeconds, 0))*time.Second, loadRampUp)
+	loadedCount := max(int(duration/interval), 1)
+
+	fmt.Fprintf(os.Stderr, "Worker bufferbloat test against %s (idle probes=%d, loaded probes=%d, interval=%v)\n",
+		req.Target, count, loadedCount, interval)
+
+	conn, err := net.DialTimeout("udp", req.Target, 2*time.Second)
+	if err != nil {
+		resp.Success = false
+		resp.Error = err.Error()
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	idleRtts, lastErr := sendProbeTrain(conn, count, interval, size)
+	idle := summarizeProbes(idleRtts)
+	if idle.received == 0 {
+		msg := fmt.Sprintf("idle latency: all %d probes lost", count)
+		if lastErr != nil {
+			msg = fmt.Sprintf("%s: %v", msg, lastErr)
+		}
+		resp.Success = false
+		resp.Error = msg
+		return
+	}
+
+	// The ramp-up doubles as the streams' omit period, so bandwidth and
+	// loaded latency are measured over the same window
+	load := req
+	load.DurationSeconds = int(duration / time.Second)
+	load.OmitSeconds = int(rampUp / time.Second)
+	loadDone := make(chan error, 1)
+	go func() {
+		loadDone <- measureTCP(load, resp)
+	}()
+
+	// A fresh socket keeps late echoes of the idle train out of the loaded one
+	time.Sleep(rampUp)
+	var loadedRtts []float64
+	if loadedConn, err := net.DialTimeout("udp", req.Target, 2*time.Second); err == nil {
+		loadedRtts, _ = sendProbeTrain(loadedConn, loadedCount, interval, size)
+		_ = loadedConn.Close()
+	}
+	loadErr := <-loadDone
+	loaded := summarizeProbes(loadedRtts)
+
+	resp.IdleLatencyMs = idle.avg
+	resp.LatencyMs = idle.avg
+	resp.PacketsSent = loadedCount
+	resp.PacketsReceived = loaded.received
+	resp.PacketLoss = float64(loadedCount-loaded.received) / float64(loadedCount) * 100
+
+	if loadErr != nil {
+		resp.Success = false
+		resp.Error = fmt.Sprintf("load generation failed: %v", loadErr)
+		return
+	}
+	if loaded.received == 0 {
+		resp.Success = false
+		resp.Error = fmt.Sprintf("loaded latency: all %d probes lost", loadedCount)
+		return
+	}
+
+	resp.LoadedLatencyMs = loaded.avg
+	resp.LatencyMinMs = loaded.min
+	resp.LatencyMaxMs = loaded.max
+	resp.LatencyStdDevMs = loaded.stddev
+	resp.JitterMs = loaded.jitter
+	resp.BufferbloatMs = max(loaded.avg-idle.avg, 0)
+	resp.BufferbloatGrade = orchestrator.BufferbloatGrade(resp.BufferbloatMs)
+	resp.Success = true
+
+	fmt.Fprintf(os.Stderr, "Worker bufferbloat: idle %.3f ms, loaded %.3f ms (+%.3f ms, grade %s), %.2f Mbps\n",
+		idle.avg, loaded.avg, resp.BufferbloatMs, resp.BufferbloatGrade, resp.BandwidthMbps)
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net"
 	"os"
 	"time"
@@ -11,41 +13,158 @@ import (
 	"github.com/user/homelab-speedtest/internal/orchestrator"
 )
 
+// version identifies the worker build; set with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
-	mode := flag.String("mode", "", "Operation mode: server, client, ping")
-	target := flag.String("target", "", "Target address (ip:port for client, ip for ping)")
-	port := flag.Int("port", 8080, "Port to listen on (server mode)")
-	// duration := flag.Int("duration", 10, "Test duration in seconds")
+	mode := flag.String("mode", "", "Operation mode: server, client, udp, ping, bufferbloat, trace, pmtu, agent")
+	target := flag.String("target", "", "Target address (ip:port of a worker in server mode)")
+	port := flag.Int("port", 8080, "Port to listen on, 0 for an ephemeral port (server mode)")
+	portMax := flag.Int("port-max", 0, "Highest port to try when -port is taken (server mode)")
+	duration := flag.Int("duration", orchestrator.DefaultDurationSeconds, "Test duration in seconds (client, udp, bufferbloat)")
+	buffer := flag.Int("buffer", orchestrator.DefaultBufferSize, "Write buffer size in bytes (client mode)")
+	omit := flag.Int("omit", 0, "Omit the first N seconds from the result (client, bufferbloat)")
+	sampleInterval := flag.Int("sample-interval", orchestrator.DefaultSampleInterval, "Throughput sample period in milliseconds (client mode)")
+	count := flag.Int("count", defaultProbeCount, "Number of probes to send (ping; idle probes in bufferbloat)")
+	interval := flag.Int("interval", int(defaultProbeInterval/time.Millisecond), "Delay between probes in milliseconds (ping, bufferbloat)")
+	size := flag.Int("size", 0, "Datagram payload size in bytes (ping: 64, udp: 1400 if unset)")
+	bitrate := flag.Float64("bitrate", defaultUDPBitrateMbps, "Target send rate in Mbps (udp mode)")
+	reverse := flag.Bool("reverse", false, "Server sends, client receives (client mode)")
+	bidir := flag.Bool("bidir", false, "Send and receive simultaneously (client mode)")
+	parallel := flag.Int("parallel", 1, "Number of parallel TCP streams (client, bufferbloat)")
+	protocol := flag.String("protocol", orchestrator.TraceUDP, "Probe protocol: udp or tcp (trace mode)")
+	maxHops := flag.Int("max-hops", defaultMaxHops, "Maximum TTL (trace mode)")
+	queries := flag.Int("queries", defaultTraceQueries, "Probes per hop (trace mode)")
+	stdin := flag.Bool("stdin", false, "Read the request as JSON from stdin; flags provide the defaults")
+	showVersion := flag.Bool("version", false, "Print the worker and protocol version and exit")
+	server := flag.String("server", "", "Server URL to connect to, e.g. http://speedtest:8080 (agent mode)")
+	token := flag.String("token", "", "Enrollment token of this device, default $"+agentTokenEnv+" (agent mode)")
 
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Printf("hl-speedtest-worker %s (protocol %d)\n", version, orchestrator.ProtocolVersion)
+		return
+	}
+	if *mode == modeAgent {
+		runAgent(*server, *token)
+		return
+	}
+	started := time.Now()
+
+	direction := orchestrator.DirectionForward
+	if *reverse {
+		direction = orchestrator.DirectionReverse
+	}
+	if *bidir {
+		direction = orchestrator.DirectionBidir
+	}
+
+	req := orchestrator.WorkerRequest{
+		Mode:        *mode,
+		Target:      *target,
+		Port:        *port,
+		PortMax:     *portMax,
+		Count:       *count,
+		IntervalMs:  *interval,
+		PayloadSize: *size,
+		BitrateMbps: *bitrate,
+		Direction:   direction,
+		Parallel:    *parallel,
+
+		DurationSeconds: *duration,
+		BufferSize:      *buffer,
+		OmitSeconds:     *omit,
+
+		SampleIntervalMs: *sampleInterval,
+
+		Protocol: *protocol,
+		MaxHops:  *maxHops,
+		Queries:  *queries,
+	}
 	resp := orchestrator.WorkerResponse{Success: true}
 
-	switch *mode {
+	if *stdin {
+		if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+			resp.Success = false
+			resp.Error = fmt.Sprintf("invalid request: %v", err)
+			printResponse(started, resp)
+			return
+		}
+		if req.ProtocolVersion != 0 && req.ProtocolVersion != orchestrator.ProtocolVersion {
+			resp.Success = false
+			resp.Error = fmt.Sprintf("unsupported protocol version %d (worker speaks %d)", req.ProtocolVersion, orchestrator.ProtocolVersion)
+			printResponse(started, resp)
+			return
+		}
+	}
+
+	if req.HoldStdin && req.Mode != orchestrator.ModeServer {
+		// The orchestrator closes stdin when it gave up on the test, e.g. after a timeout
+		go func() {
+			_, _ = io.Copy(io.Discard, os.Stdin)
+			fmt.Fprintln(os.Stderr, "Worker stdin closed, aborting")
+			os.Exit(1)
+		}()
+	}
+
+	switch req.Mode {
 	case orchestrator.ModeServer:
-		runServer(*port)
+		if *stdin {
+			// The orchestrator holds stdin open for as long as it needs the server
+			go func() {
+				_, _ = io.Copy(io.Discard, os.Stdin)
+				fmt.Fprintln(os.Stderr, "Worker server stdin closed, exiting")
+				os.Exit(0)
+			}()
+		}
+		runServer(req.Port, req.PortMax)
 	case orchestrator.ModeClient:
-		runClient(*target, &resp)
+		runClient(req, &resp)
+	case orchestrator.ModeUDP:
+		runUDPClient(req, &resp)
 	case orchestrator.ModePing:
-		runPing(*target, &resp)
+		runPing(req, &resp)
+	case orchestrator.ModeBufferbloat:
+		runBufferbloat(req, &resp)
+	case orchestrator.ModeTrace:
+		runTrace(req, &resp)
+	case orchestrator.ModePMTU:
+		runPMTU(req, &resp)
 	default:
-		fmt.Println("Usage: worker --mode [server|client|ping] ...")
-		os.Exit(1)
+		if !*stdin {
+			fmt.Println("Usage: worker --mode [server|client|udp|ping|bufferbloat|trace|pmtu|agent] ...")
+			os.Exit(1)
+		}
+		resp.Success = false
+		resp.Error = fmt.Sprintf("unknown mode %q", req.Mode)
 	}
+	printResponse(started, resp)
 
 	// Tiny delay to ensure buffers are flushed over SSH
 	time.Sleep(100 * time.Millisecond)
 }
 
-func runServer(port int) {
-	// Simple TCP echo/sink server
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+func runServer(port, portMax int) {
+	// Simple TCP sink server, with a UDP responder for latency probes and UDP
+	// throughput tests on the same port
+	ln, pc, err := listenPair(port, portMax)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Worker error listening: %v\n", err)
 		os.Exit(1)
 	}
 	defer func() { _ = ln.Close() }()
-	fmt.Fprintf(os.Stderr, "Worker server listening on :%d\n", port)
+	defer func() { _ = pc.Close() }()
+	port = ln.Addr().(*net.TCPAddr).Port
+	go runUDPResponder(pc)
+
+	fmt.Fprintf(os.Stderr, "Worker server listening on :%d (tcp+udp)\n", port)
+	printJson(orchestrator.ServerReady{
+		Ready:           true,
+		Port:            port,
+		ProtocolVersion: orchestrator.ProtocolVersion,
+		WorkerVersion:   version,
+	})
 
 	for {
 		conn, err := ln.Accept()
@@ -57,79 +176,64 @@ func runServer(port int) {
 	}
 }
 
-func handleConnection(conn net.Conn) {
-	defer func() { _ = conn.Close() }()
-	fmt.Fprintf(os.Stderr, "Worker accepted connection from %s\n", conn.RemoteAddr())
-	// Discard data
-	buf := make([]byte, 32*1024)
-	for {
-		_, err := conn.Read(buf)
-		if err != nil {
-			return
+// listenPair binds TCP and UDP on the same port. Port 0 picks an ephemeral
+// port; otherwise ports from port to portMax are tried, starting at a random
+// one so concurrent servers don't race for the same port.
+func listenPair(port, portMax int) (net.Listener, net.PacketConn, error) {
+	if port == 0 {
+		var lastErr error
+		for range 10 {
+			ln, pc, err := listenPort(0)
+			if err == nil {
+				return ln, pc, nil
+			}
+			lastErr = err
 		}
+		return nil, nil, lastErr
 	}
-}
-
-func runClient(target string, resp *orchestrator.WorkerResponse) {
-	fmt.Fprintf(os.Stderr, "Worker client connecting to %s\n", target)
-	// TCP throughput test
-	start := time.Now()
-	conn, err := net.DialTimeout("tcp", target, 5*time.Second)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Worker client dial error: %v\n", err)
-		resp.Success = false
-		resp.Error = fmt.Sprintf("dial error: %v", err)
-		printJson(resp)
-		return
-	}
-	defer func() { _ = conn.Close() }()
-	fmt.Fprintf(os.Stderr, "Worker client connected, starting data transfer...\n")
-
-	// Send data for 10 seconds
-	duration := 10 * time.Second
-	deadline := start.Add(duration)
-	_ = conn.SetDeadline(deadline)
-
-	buf := make([]byte, 32*1024) // 32KB chunks
-	var totalBytes int64
-
-	for time.Now().Before(deadline) {
-		n, err := conn.Write(buf)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Worker client write error: %v\n", err)
-			break
+	portMax = max(portMax, port)
+	n := portMax - port + 1
+	offset := rand.IntN(n)
+	for i := range n {
+		ln, pc, err := listenPort(port + (offset+i)%n)
+		if err == nil {
+			return ln, pc, nil
 		}
-		totalBytes += int64(n)
 	}
-
-	elapsed := time.Since(start).Seconds()
-	mbps := (float64(totalBytes) * 8 / 1000000) / elapsed
-
-	fmt.Fprintf(os.Stderr, "Worker client finished. Bytes sent: %d, Speed: %.2f Mbps\n", totalBytes, mbps)
-
-	resp.BandwidthMbps = mbps
-	resp.Success = true // Ensure success is true if we sent data
-	printJson(resp)
+	if n == 1 {
+		return nil, nil, fmt.Errorf("port %d is in use", port)
+	}
+	return nil, nil, fmt.Errorf("no free port in %d-%d", port, portMax)
 }
 
-func runPing(target string, resp *orchestrator.WorkerResponse) {
-	fmt.Fprintf(os.Stderr, "Worker pinging %s\n", target)
-	start := time.Now()
-	conn, err := net.DialTimeout("tcp", target, 2*time.Second)
+// listenPort binds TCP on port and UDP on the port TCP got
+func listenPort(port int) (net.Listener, net.PacketConn, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Worker ping error: %v\n", err)
-		resp.Success = false
-		resp.Error = err.Error()
-		printJson(resp)
-		return
+		return nil, nil, err
 	}
-	defer func() { _ = conn.Close() }()
+	port = ln.Addr().(*net.TCPAddr).Port
+	pc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		_ = ln.Close()
+		return nil, nil, fmt.Errorf("udp: %w", err)
+	}
+	return ln, pc, nil
+}
 
-	latency := time.Since(start).Seconds() * 1000 // ms
-	fmt.Fprintf(os.Stderr, "Worker ping success: %.2f ms\n", latency)
-	resp.LatencyMs = latency
-	resp.Success = true
-	printJson(resp)
+// printResponse writes resp to stdout wrapped in the versioned envelope
+func printResponse(started time.Time, resp orchestrator.WorkerResponse) {
+	hostname, _ := os.Hostname()
+	finished := time.Now()
+	printJson(orchestrator.WorkerEnvelope{
+		ProtocolVersion: orchestrator.ProtocolVersion,
+		WorkerVersion:   version,
+		Hostname:        hostname,
+		StartedAt:       started.UTC(),
+		FinishedAt:      finished.UTC(),
+		DurationMs:      float64(finished.Sub(started)) / float64(time.Millisecond),
+		Response:        resp,
+	})
 }
 
 func printJson(v interface{}) {
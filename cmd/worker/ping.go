@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/orchestrator"
+)
+
+// Probe packets are UDP datagrams echoed back verbatim by the worker server:
+//
+//	[0:4]  magic "HLPE"
+//	[4:8]  sequence number (big endian)
+//	[8:16] send time in unix nanoseconds (informational)
+//	[16:]  zero padding up to the requested payload size
+var probeMagic = []byte("HLPE")
+
+const (
+	probeHeaderSize = 16
+	maxProbeSize    = 65000
+
+	defaultProbeCount    = 10
+	defaultProbeInterval = 200 * time.Millisecond
+	defaultProbeSize     = 64
+
+	// probeTimeout is how long we wait for stragglers after the last probe was sent
+	probeTimeout = 1 * time.Second
+)
+
+// isProbe reports whether a datagram is a latency probe that should be echoed
+func isProbe(b []byte) bool {
+	return len(b) >= probeHeaderSize && string(b[:4]) == string(probeMagic)
+}
+
+// probeOptions applies the ping defaults to the probe settings of req
+func probeOptions(req orchestrator.WorkerRequest) (count int, interval time.Duration, size int) {
+	count = req.Count
+	if count <= 0 {
+		count = defaultProbeCount
+	}
+	interval = time.Duration(req.IntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	size = req.PayloadSize
+	if size <= 0 {
+		size = defaultProbeSize
+	}
+	size = min(max(size, probeHeaderSize), maxProbeSize)
+	return count, interval, size
+}
+
+func runPing(req orchestrator.WorkerRequest, resp *orchestrator.WorkerResponse) {
+	count, interval, size := probeOptions(req)
+
+	fmt.Fprintf(os.Stderr, "Worker pinging %s (count=%d, interval=%v, size=%d)\n", req.Target, count, interval, size)
+
+	conn, err := net.DialTimeout("udp", req.Target, 2*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Worker ping error: %v\n", err)
+		resp.Success = false
+		resp.Error = err.Error()
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	rtts, lastErr := sendProbeTrain(conn, count, interval, size)
+	stats := summarizeProbes(rtts)
+
+	resp.PacketsSent = count
+	resp.PacketsReceived = stats.received
+	resp.PacketLoss = float64(count-stats.received) / float64(count) * 100
+
+	if stats.received == 0 {
+		msg := fmt.Sprintf("all %d probes lost", count)
+		if lastErr != nil {
+			msg = fmt.Sprintf("%s: %v", msg, lastErr)
+		}
+		fmt.Fprintf(os.Stderr, "Worker ping failed: %s\n", msg)
+		resp.Success = false
+		resp.Error = msg
+		return
+	}
+
+	resp.LatencyMs = stats.avg
+	resp.LatencyMinMs = stats.min
+	resp.LatencyMaxMs = stats.max
+	resp.LatencyStdDevMs = stats.stddev
+	resp.JitterMs = stats.jitter
+	resp.Success = true
+
+	fmt.Fprintf(os.Stderr, "Worker ping success: %d/%d received, min/avg/max/stddev = %.3f/%.3f/%.3f/%.3f ms, jitter %.3f ms\n",
+		stats.received, count, stats.min, stats.avg, stats.max, stats.stddev, stats.jitter)
+}
+
+// sendProbeTrain sends count probes over conn and collects their round-trip times.
+// The returned slice is indexed by sequence number; lost probes are NaN.
+func sendProbeTrain(conn net.Conn, count int, interval time.Duration, size int) ([]float64, error) {
+	var (
+		mu        sync.Mutex
+		sentAt    = make([]time.Time, count)
+		rtts      = make([]float64, count)
+		received  int
+		lastErr   error
+		allEchoed = make(chan struct{})
+	)
+	for i := range rtts {
+		rtts[i] = math.NaN()
+	}
+
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		buf := make([]byte, maxProbeSize)
+		for {
+			n, err := conn.Read(buf)
+			now := time.Now()
+			if err != nil {
+				var netErr net.Error
+				if (errors.As(err, &netErr) && netErr.Timeout()) || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// Connected UDP sockets surface ICMP errors (e.g. port unreachable) here
+				mu.Lock()
+				lastErr = err
+				mu.Unlock()
+				continue
+			}
+			if !isProbe(buf[:n]) {
+				continue
+			}
+			seq := int(binary.BigEndian.Uint32(buf[4:8]))
+			mu.Lock()
+			if seq < count && !sentAt[seq].IsZero() && math.IsNaN(rtts[seq]) {
+				rtts[seq] = float64(now.Sub(sentAt[seq])) / float64(time.Millisecond)
+				received++
+				if received == count {
+					close(allEchoed)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	packet := make([]byte, size)
+	copy(packet, probeMagic)
+	for seq := 0; seq < count; seq++ {
+		if seq > 0 {
+			time.Sleep(interval)
+		}
+		binary.BigEndian.PutUint32(packet[4:8], uint32(seq))
+		now := time.Now()
+		binary.BigEndian.PutUint64(packet[8:16], uint64(now.UnixNano()))
+		mu.Lock()
+		sentAt[seq] = now
+		mu.Unlock()
+		if _, err := conn.Write(packet); err != nil {
+			mu.Lock()
+			lastErr = err
+			mu.Unlock()
+		}
+	}
+
+	select {
+	case <-allEchoed:
+	case <-time.After(probeTimeout):
+	}
+	_ = conn.SetReadDeadline(time.Now())
+	<-readerDone
+
+	mu.Lock()
+	defer mu.Unlock()
+	return rtts, lastErr
+}
+
+type probeStats struct {
+	received int
+	min      float64
+	max      float64
+	avg      float64
+	stddev   float64
+	jitter   float64
+}
+
+// summarizeProbes computes latency statistics over the received probes (NaN = lost).
+// Jitter follows RFC 3550 section 6.4.1: a running estimate of the mean deviation of
+// the difference between consecutive transit times, smoothed with a gain of 1/16.
+func summarizeProbes(rtts []float64) probeStats {
+	var s probeStats
+	var sum float64
+	prev := math.NaN()
+	for _, rtt := range rtts {
+		if math.IsNaN(rtt) {
+			continue
+		}
+		if s.received == 0 || rtt < s.min {
+			s.min = rtt
+		}
+		if s.received == 0 || rtt > s.max {
+			s.max = rtt
+		}
+		s.received++
+		sum += rtt
+
+		if !math.IsNaN(prev) {
+			d := math.Abs(rtt - prev)
+			s.jitter += (d - s.jitter) / 16
+		}
+		prev = rtt
+	}
+	if s.received == 0 {
+		return s
+	}
+
+	s.avg = sum / float64(s.received)
+	var variance float64
+	for _, rtt := range rtts {
+		if !math.IsNaN(rtt) {
+			variance += (rtt - s.avg) * (rtt - s.avg)
+		}
+	}
+	s.stddev = math.Sqrt(variance / float64(s.received))
+	return s
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSummarizeProbes(t *testing.T) {
+	nan := math.NaN()
+	stats := summarizeProbes([]float64{1.0, nan, 3.0, 2.0})
+
+	if stats.received != 3 {
+		t.Fatalf("Expected 3 received probes, got %d", stats.received)
+	}
+	if stats.min != 1.0 || stats.max != 3.0 {
+		t.Errorf("Expected min/max 1.0/3.0, got %f/%f", stats.min, stats.max)
+	}
+	if stats.avg != 2.0 {
+		t.Errorf("Expected avg 2.0, got %f", stats.avg)
+	}
+	if math.Abs(stats.stddev-math.Sqrt(2.0/3.0)) > 1e-9 {
+		t.Errorf("Expected stddev %f, got %f", math.Sqrt(2.0/3.0), stats.stddev)
+	}
+
+	// RFC 3550: J = J + (|D| - J) / 16 over consecutive received probes (|3-1|, then |2-3|)
+	want := 2.0 / 16
+	want += (1.0 - want) / 16
+	if math.Abs(stats.jitter-want) > 1e-9 {
+		t.Errorf("Expected jitter %f, got %f", want, stats.jitter)
+	}
+}
+
+func TestSummarizeProbesAllLost(t *testing.T) {
+	stats := summarizeProbes([]float64{math.NaN(), math.NaN()})
+	if stats.received != 0 {
+		t.Errorf("Expected 0 received probes, got %d", stats.received)
+	}
+	if stats.avg != 0 || stats.jitter != 0 {
+		t.Errorf("Expected zero stats when all probes are lost, got %+v", stats)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// After a TCP test the client opens one more connection with the report
+// direction and the test's session ID. The server answers with a JSON
+// tcpReport describing what it measured on each stream of that session, so the
+// client can report receiver-side bandwidth for forward tests and the server's
+// send rate for reverse tests.
+
+const (
+	// maxSessionID is the largest session ID that fits the 24 bit header field
+	maxSessionID = 1<<24 - 1
+	// reportWait bounds how long the server waits for a session's streams to finish
+	reportWait = receiveGrace
+	// tcpSessionTTL drops reports nobody asked for
+	tcpSessionTTL = 10 * time.Minute
+)
+
+// tcpStreamReport is the server's view of one stream
+type tcpStreamReport struct {
+	Stream         int     `json:"stream"`
+	BytesReceived  int64   `json:"bytes_received,omitempty"`
+	ReceiveSeconds float64 `json:"receive_seconds,omitempty"`
+	BytesSent      int64   `json:"bytes_sent,omitempty"`
+	SendSeconds    float64 `json:"send_seconds,omitempty"`
+}
+
+type tcpReport struct {
+	Streams []tcpStreamReport `json:"streams"`
+}
+
+// newSessionID picks a random non-zero session ID
+func newSessionID() uint32 {
+	return 1 + rand.Uint32N(maxSessionID)
+}
+
+// reportRegistry collects finished stream reports per session on the server
+type reportRegistry struct {
+	mu       sync.Mutex
+	sessions map[uint32]*reportSession
+}
+
+type reportSession struct {
+	streams []tcpStreamReport
+	updated time.Time
+}
+
+var reports = &reportRegistry{sessions: make(map[uint32]*reportSession)}
+
+// add records a finished stream
+func (r *reportRegistry) add(session uint32, rep tcpStreamReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for id, s := range r.sessions {
+		if now.Sub(s.updated) > tcpSessionTTL {
+			delete(r.sessions, id)
+		}
+	}
+	s, ok := r.sessions[session]
+	if !ok {
+		s = &reportSession{}
+		r.sessions[session] = s
+	}
+	s.streams = append(s.streams, rep)
+	s.updated = now
+}
+
+// take waits until n streams of session have finished or timeout passes, then
+// removes and returns whatever was recorded
+func (r *reportRegistry) take(session uint32, n int, timeout time.Duration) []tcpStreamReport {
+	deadline := time.Now().Add(timeout)
+	for {
+		r.mu.Lock()
+		s := r.sessions[session]
+		if (s != nil && len(s.streams) >= n) || !time.Now().Before(deadline) {
+			delete(r.sessions, session)
+			r.mu.Unlock()
+			if s == nil {
+				return nil
+			}
+			return s.streams
+		}
+		r.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// serveReport answers a report request on the server
+func serveReport(conn net.Conn, hdr tcpHeader) {
+	rep := tcpReport{Streams: reports.take(hdr.session, hdr.stream, reportWait)}
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_ = json.NewEncoder(conn).Encode(rep)
+}
+
+// fetchReport asks the server for its measurements of a finished session
+func fetchReport(target string, session uint32, streams int) (tcpReport, error) {
+	var rep tcpReport
+	conn, err := net.DialTimeout("tcp", target, 5*time.Second)
+	if err != nil {
+		return rep, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetDeadline(time.Now().Add(reportWait + 5*time.Second))
+	hdr := tcpHeader{direction: directionReport, session: session, stream: streams}
+	if _, err := conn.Write(hdr.encode()); err != nil {
+		return rep, err
+	}
+	if err := json.NewDecoder(conn).Decode(&rep); err != nil {
+		return rep, fmt.Errorf("reading report: %w", err)
+	}
+	return rep, nil
+}
+
+// receive reads conn until EOF and returns the bytes read after the omit period
+// and the time they took. The clock starts at the first byte rather than at
+// the header so the time the client spends dialing other streams isn't counted.
+func receive(conn net.Conn, omit time.Duration, bufSize int) (int64, float64) {
+	buf := make([]byte, bufSize)
+	n, err := conn.Read(buf)
+	start := time.Now()
+	w := window{measureFrom: start.Add(omit), bufSize: bufSize}
+
+	var total int64
+	if omit <= 0 {
+		total = int64(n)
+	}
+	if err == nil {
+		total += discard(conn, w)
+	}
+	return total, time.Since(w.measureFrom).Seconds()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/orchestrator"
+)
+
+func TestTCPHeaderRoundTrip(t *testing.T) {
+	in := tcpHeader{
+		direction: orchestrator.DirectionBidir,
+		duration:  12 * time.Second,
+		omit:      1500 * time.Millisecond,
+		session:   maxSessionID,
+		stream:    7,
+	}
+	out, ok := decodeTCPHeader(in.encode())
+	if !ok {
+		t.Fatal("Expected header to decode")
+	}
+	if out != in {
+		t.Errorf("Expected %+v, got %+v", in, out)
+	}
+
+	if _, ok := decodeTCPHeader([]byte("garbage")); ok {
+		t.Error("Expected short input to be rejected")
+	}
+}
+
+func TestApplyReport(t *testing.T) {
+	streams := []orchestrator.StreamResult{
+		{BandwidthMbps: 100, SenderBandwidthMbps: 100},
+		{BandwidthMbps: 50, SenderBandwidthMbps: 50},
+	}
+	applyReport(streams, tcpReport{Streams: []tcpStreamReport{
+		{Stream: 0, BytesReceived: 10_000_000, ReceiveSeconds: 1, BytesSent: 5_000_000, SendSeconds: 1},
+		{Stream: 5, BytesReceived: 1, ReceiveSeconds: 1}, // unknown stream, ignored
+	}})
+
+	if streams[0].ReceiverBandwidthMbps != 80 || streams[0].BandwidthMbps != 80 {
+		t.Errorf("Expected receiver bandwidth 80 on stream 0, got %+v", streams[0])
+	}
+	if streams[0].SenderBandwidthMbps != 100 {
+		t.Errorf("Expected sender bandwidth to be kept, got %v", streams[0].SenderBandwidthMbps)
+	}
+	if streams[0].ReverseSenderBandwidthMbps != 40 {
+		t.Errorf("Expected reverse sender bandwidth 40, got %v", streams[0].ReverseSenderBandwidthMbps)
+	}
+	if streams[1].BandwidthMbps != 50 || streams[1].ReceiverBandwidthMbps != 0 {
+		t.Errorf("Expected stream 1 untouched, got %+v", streams[1])
+	}
+}
+
+func TestReportRegistryTake(t *testing.T) {
+	r := &reportRegistry{sessions: make(map[uint32]*reportSession)}
+	r.add(42, tcpStreamReport{Stream: 0})
+	r.add(42, tcpStreamReport{Stream: 1})
+
+	if got := r.take(42, 2, time.Second); len(got) != 2 {
+		t.Fatalf("Expected 2 stream reports, got %d", len(got))
+	}
+	if got := r.take(42, 1, 20*time.Millisecond); got != nil {
+		t.Errorf("Expected session to be consumed, got %v", got)
+	}
+}
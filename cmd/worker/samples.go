@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/orchestrator"
+)
+
+// minSampleInterval keeps the sampler from dominating short tests
+const minSampleInterval = 100 * time.Millisecond
+
+// transferCounters are the measured byte totals shared by all streams of a test.
+// A nil *transferCounters ignores updates, which is what the server side uses.
+type transferCounters struct {
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+func (c *transferCounters) addSent(n int) {
+	if c != nil {
+		c.sent.Add(int64(n))
+	}
+}
+
+func (c *transferCounters) addReceived(n int) {
+	if c != nil {
+		c.received.Add(int64(n))
+	}
+}
+
+// sampler turns cumulative byte counts into per-interval throughput samples
+type sampler struct {
+	from     time.Time
+	interval time.Duration
+	last     time.Time
+	sent     int64
+	received int64
+	samples  []orchestrator.IntervalSample
+}
+
+func newSampler(from time.Time, interval time.Duration) *sampler {
+	return &sampler{from: from, interval: max(interval, minSampleInterval), last: from}
+}
+
+// record closes the current interval at now with the given cumulative totals
+func (s *sampler) record(now time.Time, sent, received int64) {
+	secs := now.Sub(s.last).Seconds()
+	if secs <= 0 {
+		return
+	}
+	s.samples = append(s.samples, orchestrator.IntervalSample{
+		Start:                s.last.Sub(s.from).Seconds(),
+		End:                  now.Sub(s.from).Seconds(),
+		BytesSent:            sent - s.sent,
+		BytesReceived:        received - s.received,
+		BandwidthMbps:        mbps(sent-s.sent, secs),
+		ReverseBandwidthMbps: mbps(received-s.received, secs),
+	})
+	s.last, s.sent, s.received = now, sent, received
+}
+
+// finish records the trailing partial interval. Slivers shorter than a quarter
+// interval are folded into the previous sample so they don't show up as spikes.
+func (s *sampler) finish(now time.Time, sent, received int64) []orchestrator.IntervalSample {
+	n := len(s.samples)
+	if n == 0 || now.Sub(s.last) >= s.interval/4 {
+		s.record(now, sent, received)
+		return s.samples
+	}
+	prev := &s.samples[n-1]
+	prev.BytesSent += sent - s.sent
+	prev.BytesReceived += received - s.received
+	prev.End = now.Sub(s.from).Seconds()
+	secs := prev.End - prev.Start
+	prev.BandwidthMbps = mbps(prev.BytesSent, secs)
+	prev.ReverseBandwidthMbps = mbps(prev.BytesReceived, secs)
+	return s.samples
+}
+
+// sampleTransfer polls c every interval from the start of the measured window
+// until done is closed and returns the resulting time series
+func sampleTransfer(c *transferCounters, from time.Time, interval time.Duration, done <-chan struct{}) []orchestrator.IntervalSample {
+	wait := time.NewTimer(time.Until(from))
+	defer wait.Stop()
+	select {
+	case <-wait.C:
+	case <-done:
+		return nil
+	}
+
+	s := newSampler(from, interval)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.record(now, c.sent.Load(), c.received.Load())
+		case <-done:
+			return s.finish(time.Now(), c.sent.Load(), c.received.Load())
+		}
+	}
+}
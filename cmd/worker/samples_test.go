@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSampler(t *testing.T) {
+	from := time.Now()
+	s := newSampler(from, time.Second)
+
+	s.record(from.Add(time.Second), 125_000, 0)                      // 1 Mbps
+	s.record(from.Add(2*time.Second), 375_000, 0)                    // 2 Mbps
+	samples := s.finish(from.Add(2100*time.Millisecond), 400_000, 0) // short tail is folded in
+
+	if len(samples) != 2 {
+		t.Fatalf("Expected 2 samples, got %d: %+v", len(samples), samples)
+	}
+	if samples[0].BandwidthMbps != 1 {
+		t.Errorf("Expected first sample 1 Mbps, got %.3f", samples[0].BandwidthMbps)
+	}
+	last := samples[1]
+	if last.BytesSent != 275_000 || last.End < 2.09 || last.End > 2.11 {
+		t.Errorf("Expected tail folded into last sample, got %+v", last)
+	}
+
+	// A long enough tail becomes its own sample
+	s = newSampler(from, time.Second)
+	s.record(from.Add(time.Second), 125_000, 0)
+	samples = s.finish(from.Add(1500*time.Millisecond), 250_000, 50_000)
+	if len(samples) != 2 || samples[1].BytesReceived != 50_000 {
+		t.Errorf("Expected separate tail sample, got %+v", samples)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/orchestrator"
+)
+
+// Every TCP test connection starts with a fixed header sent by the client:
+//
+//	[0:4]   magic "HLPT"
+//	[4]     direction (see directionCodes)
+//	[5:8]   omit period in milliseconds (big endian, 24 bit)
+//	[8:12]  test duration in milliseconds, including the omit period (big endian)
+//	[12:15] session ID for the report (big endian, 24 bit), 0 = no report
+//	[15]    stream index; for report requests the number of streams
+//
+// Connections that don't start with the magic are treated as a plain sink so
+// older clients keep working against a newer server.
+var tcpMagic = []byte("HLPT")
+
+const (
+	tcpHeaderSize = 16
+	maxBufferSize = 16 * 1024 * 1024
+
+	// maxServerSendDuration caps how long the server will transmit for a reverse test
+	maxServerSendDuration = 5 * time.Minute
+	// maxParallelStreams bounds -parallel to something sane
+	maxParallelStreams = 128
+	// receiveGrace is how long the receiver waits past the test duration for the sender to finish
+	receiveGrace = 5 * time.Second
+	// tcpStatsInterval is the longest period between TCP_INFO polls
+	tcpStatsInterval = 250 * time.Millisecond
+)
+
+// directionReport asks the server for its measurements of a finished session (see report.go)
+const directionReport = "report"
+
+var directionCodes = map[string]byte{
+	orchestrator.DirectionForward: 0,
+	orchestrator.DirectionReverse: 1,
+	orchestrator.DirectionBidir:   2,
+	directionReport:               3,
+}
+
+type tcpHeader struct {
+	direction string
+	duration  time.Duration
+	omit      time.Duration
+	session   uint32
+	stream    int
+}
+
+func (h tcpHeader) encode() []byte {
+	b := make([]byte, tcpHeaderSize)
+	copy(b, tcpMagic)
+	b[4] = directionCodes[h.direction]
+	omit := uint32(min(h.omit.Milliseconds(), 1<<24-1))
+	b[5], b[6], b[7] = byte(omit>>16), byte(omit>>8), byte(omit)
+	binary.BigEndian.PutUint32(b[8:12], uint32(h.duration.Milliseconds()))
+	binary.BigEndian.PutUint32(b[12:16], h.session<<8|uint32(h.stream&0xff))
+	return b
+}
+
+// decodeTCPHeader parses a connection header; ok is false for legacy clients
+func decodeTCPHeader(b []byte) (h tcpHeader, ok bool) {
+	if len(b) < tcpHeaderSize || string(b[:4]) != string(tcpMagic) {
+		return h, false
+	}
+	h.direction = orchestrator.DirectionForward
+	for name, code := range directionCodes {
+		if code == b[4] {
+			h.direction = name
+		}
+	}
+	h.omit = time.Duration(uint32(b[5])<<16|uint32(b[6])<<8|uint32(b[7])) * time.Millisecond
+	h.duration = time.Duration(binary.BigEndian.Uint32(b[8:12])) * time.Millisecond
+	tail := binary.BigEndian.Uint32(b[12:16])
+	h.session, h.stream = tail>>8, int(tail&0xff)
+	return h, true
+}
+
+func handleConnection(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	fmt.Fprintf(os.Stderr, "Worker accepted connection from %s\n", conn.RemoteAddr())
+
+	buf := make([]byte, tcpHeaderSize)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	hdr, ok := decodeTCPHeader(buf)
+	if !ok {
+		// Legacy client: the bytes we just read were payload
+		_ = discard(conn, window{bufSize: orchestrator.DefaultBufferSize})
+		return
+	}
+	if hdr.direction == directionReport {
+		serveReport(conn, hdr)
+		return
+	}
+
+	duration := min(hdr.duration, maxServerSendDuration)
+	if duration <= 0 {
+		duration = defaultTestDuration
+	}
+	start := time.Now()
+	w := window{measureFrom: start.Add(hdr.omit), deadline: start.Add(duration), bufSize: orchestrator.DefaultBufferSize}
+	rep := tcpStreamReport{Stream: hdr.stream}
+
+	switch hdr.direction {
+	case orchestrator.DirectionReverse:
+		rep.BytesSent = sendUntil(conn, w)
+		rep.SendSeconds = time.Since(w.measureFrom).Seconds()
+		fmt.Fprintf(os.Stderr, "Worker server sent %d bytes to %s\n", rep.BytesSent, conn.RemoteAddr())
+	case orchestrator.DirectionBidir:
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			rep.BytesReceived, rep.ReceiveSeconds = receive(conn, hdr.omit, w.bufSize)
+		}()
+		rep.BytesSent = sendUntil(conn, w)
+		rep.SendSeconds = time.Since(w.measureFrom).Seconds()
+		closeWrite(conn)
+		fmt.Fprintf(os.Stderr, "Worker server sent %d bytes to %s\n", rep.BytesSent, conn.RemoteAddr())
+		<-done
+	default:
+		rep.BytesReceived, rep.ReceiveSeconds = receive(conn, hdr.omit, w.bufSize)
+	}
+
+	if hdr.session != 0 {
+		reports.add(hdr.session, rep)
+	}
+}
+
+func runClient(req orchestrator.WorkerRequest, resp *orchestrator.WorkerResponse) {
+	if err := measureTCP(req, resp); err != nil {
+		resp.Success = false
+		resp.Error = err.Error()
+		return
+	}
+	resp.Success = true // Ensure success is true if we moved data
+}
+
+// measureTCP runs a TCP throughput test against a worker server and fills in the
+// bandwidth, stream and sample fields of resp
+func measureTCP(req orchestrator.WorkerRequest, resp *orchestrator.WorkerResponse) error {
+	direction := req.Direction
+	if direction == "" {
+		direction = orchestrator.DirectionForward
+	}
+	if _, ok := directionCodes[direction]; !ok {
+		return fmt.Errorf("unknown direction %q", direction)
+	}
+	parallel := min(max(req.Parallel, 1), maxParallelStreams)
+	duration := defaultTestDuration
+	if req.DurationSeconds > 0 {
+		duration = time.Duration(req.DurationSeconds) * time.Second
+	}
+	omit := time.Duration(max(req.OmitSeconds, 0)) * time.Second
+	bufSize := req.BufferSize
+	if bufSize <= 0 {
+		bufSize = orchestrator.DefaultBufferSize
+	}
+	bufSize = min(bufSize, maxBufferSize)
+
+	fmt.Fprintf(os.Stderr, "Worker client connecting to %s (direction=%s, streams=%d, duration=%v, omit=%v, buffer=%d)\n",
+		req.Target, direction, parallel, duration, omit, bufSize)
+	// TCP throughput test: open every stream before any data flows so they share one time window
+	conns := make([]net.Conn, 0, parallel)
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	session := newSessionID()
+	for i := 0; i < parallel; i++ {
+		conn, err := net.DialTimeout("tcp", req.Target, 5*time.Second)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Worker client dial error: %v\n", err)
+			return fmt.Errorf("dial error: %w", err)
+		}
+		conns = append(conns, conn)
+		hdr := tcpHeader{direction: direction, duration: omit + duration, omit: omit, session: session, stream: i}
+		if _, err := conn.Write(hdr.encode()); err != nil {
+			return fmt.Errorf("failed to send test header: %w", err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Worker client connected, starting data transfer...\n")
+
+	// The omit window lets TCP slow start settle; bytes moved during it are not counted
+	start := time.Now()
+	w := window{
+		measureFrom: start.Add(omit),
+		deadline:    start.Add(omit + duration),
+		bufSize:     bufSize,
+		counters:    &transferCounters{},
+	}
+
+	sampleInterval := time.Duration(req.SampleIntervalMs) * time.Millisecond
+	if sampleInterval <= 0 {
+		sampleInterval = orchestrator.DefaultSampleInterval * time.Millisecond
+	}
+	w.statsEvery = min(sampleInterval, tcpStatsInterval)
+	streamsDone := make(chan struct{})
+	samplesDone := make(chan []orchestrator.IntervalSample, 1)
+	go func() {
+		samplesDone <- sampleTransfer(w.counters, w.measureFrom, sampleInterval, streamsDone)
+	}()
+
+	streams := make([]orchestrator.StreamResult, parallel)
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			streams[i] = runStream(conn, direction, w)
+			streams[i].Stream = i
+		}()
+	}
+	wg.Wait()
+	close(streamsDone)
+	resp.Samples = <-samplesDone
+
+	// The server's measurements; without them only the sender side is known
+	if rep, err := fetchReport(req.Target, session, parallel); err != nil {
+		fmt.Fprintf(os.Stderr, "Worker client could not get the server report: %v\n", err)
+	} else {
+		applyReport(streams, rep)
+	}
+
+	var sent, received int64
+	for _, st := range streams {
+		sent += st.BytesSent
+		received += st.BytesReceived
+		resp.BandwidthMbps += st.BandwidthMbps
+		resp.ReverseBandwidthMbps += st.ReverseBandwidthMbps
+		resp.SenderBandwidthMbps += st.SenderBandwidthMbps
+		resp.ReceiverBandwidthMbps += st.ReceiverBandwidthMbps
+		resp.ReverseSenderBandwidthMbps += st.ReverseSenderBandwidthMbps
+	}
+	resp.Parallel = parallel
+	resp.TCP = aggregateTCPStats(streams)
+	if resp.TCP != nil {
+		fmt.Fprintf(os.Stderr, "Worker client TCP stats: %d retransmits, rtt %.3f ms (var %.3f ms), cwnd %d\n",
+			resp.TCP.Retransmits, resp.TCP.RttMs, resp.TCP.RttVarMs, resp.TCP.Cwnd)
+	}
+	if parallel > 1 {
+		resp.Streams = streams
+		for _, st := range streams {
+			fmt.Fprintf(os.Stderr, "Worker client stream %d: sent %.2f Mbps, received %.2f Mbps\n",
+				st.Stream, st.BandwidthMbps, st.ReverseBandwidthMbps)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Worker client finished. Bytes sent: %d (%.2f Mbps), received: %d (%.2f Mbps)\n",
+		sent, resp.BandwidthMbps, received, resp.ReverseBandwidthMbps)
+
+	if sent == 0 && received == 0 {
+		return errors.New("no data transferred")
+	}
+	return nil
+}
+
+// applyReport merges the server's per-stream measurements into the client's.
+// Where the server measured what it received, that becomes the stream's bandwidth.
+func applyReport(streams []orchestrator.StreamResult, rep tcpReport) {
+	for _, sr := range rep.Streams {
+		if sr.Stream < 0 || sr.Stream >= len(streams) {
+			continue
+		}
+		st := &streams[sr.Stream]
+		if sr.ReceiveSeconds > 0 {
+			st.ReceiverBandwidthMbps = mbps(sr.BytesReceived, sr.ReceiveSeconds)
+			st.BandwidthMbps = st.ReceiverBandwidthMbps
+		}
+		if sr.SendSeconds > 0 {
+			st.ReverseSenderBandwidthMbps = mbps(sr.BytesSent, sr.SendSeconds)
+		}
+	}
+}
+
+// window is the time frame of a transfer; bytes moved before measureFrom are not counted
+type window struct {
+	measureFrom time.Time
+	deadline    time.Time
+	bufSize     int
+	counters    *transferCounters // optional, fed with the counted bytes for sampling
+	statsEvery  time.Duration     // TCP_INFO polling period, 0 disables it
+}
+
+// runStream moves data over one connection in the requested direction(s)
+func runStream(conn net.Conn, direction string, w window) orchestrator.StreamResult {
+	var res orchestrator.StreamResult
+	var sendElapsed, recvElapsed float64
+	monitor := startTCPInfoMonitor(conn, w.statsEvery)
+
+	switch direction {
+	case orchestrator.DirectionForward:
+		res.BytesSent = sendUntil(conn, w)
+		sendElapsed = time.Since(w.measureFrom).Seconds()
+		closeWrite(conn) // lets the server see the end of the stream and stop its clock
+	case orchestrator.DirectionReverse:
+		_ = conn.SetReadDeadline(w.deadline.Add(receiveGrace))
+		res.BytesReceived = discard(conn, w)
+		recvElapsed = time.Since(w.measureFrom).Seconds()
+	case orchestrator.DirectionBidir:
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			res.BytesSent = sendUntil(conn, w)
+			sendElapsed = time.Since(w.measureFrom).Seconds()
+			closeWrite(conn)
+		}()
+		_ = conn.SetReadDeadline(w.deadline.Add(receiveGrace))
+		res.BytesReceived = discard(conn, w)
+		recvElapsed = time.Since(w.measureFrom).Seconds()
+		<-done
+	}
+
+	res.BandwidthMbps = mbps(res.BytesSent, sendElapsed)
+	res.SenderBandwidthMbps = res.BandwidthMbps
+	res.ReverseBandwidthMbps = mbps(res.BytesReceived, recvElapsed)
+	res.TCP = monitor.finish()
+	return res
+}
+
+// sendUntil writes to conn until the deadline passes or the peer goes away.
+// It returns the number of bytes written after w.measureFrom.
+func sendUntil(conn net.Conn, w window) int64 {
+	_ = conn.SetWriteDeadline(w.deadline)
+	buf := make([]byte, w.bufSize)
+	var total int64
+	for time.Now().Before(w.deadline) {
+		n, err := conn.Write(buf)
+		if !time.Now().Before(w.measureFrom) {
+			total += int64(n)
+			w.counters.addSent(n)
+		}
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				fmt.Fprintf(os.Stderr, "Worker write error: %v\n", err)
+			}
+			break
+		}
+	}
+	return total
+}
+
+// discard reads from conn until EOF or error and returns the number of bytes read after w.measureFrom
+func discard(conn net.Conn, w window) int64 {
+	buf := make([]byte, w.bufSize)
+	var total int64
+	for {
+		n, err := conn.Read(buf)
+		if !time.Now().Before(w.measureFrom) {
+			total += int64(n)
+			w.counters.addReceived(n)
+		}
+		if err != nil {
+			return total
+		}
+	}
+}
+
+// closeWrite signals end of stream to the peer while keeping the read side open
+func closeWrite(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		_ = tc.CloseWrite()
+	}
+}
+
+func mbps(bytes int64, seconds float64) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / 1000000 / seconds
+}
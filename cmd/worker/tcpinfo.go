@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/orchestrator"
+)
+
+// tcpInfo is the subset of the kernel's TCP_INFO we report
+type tcpInfo struct {
+	retransmits int    // total retransmitted segments
+	rttUs       uint32 // smoothed RTT
+	rttVarUs    uint32
+	cwnd        int // congestion window in segments
+}
+
+// tcpInfoMonitor polls TCP_INFO of one connection while a transfer runs. The
+// smoothed RTT is averaged over the polls; retransmits and cwnd are final values.
+type tcpInfoMonitor struct {
+	conn net.Conn
+	stop chan struct{}
+	done chan struct{}
+
+	mu         sync.Mutex
+	polls      int
+	rttSumUs   float64
+	rttVarSum  float64
+	last       tcpInfo
+	haveSample bool
+}
+
+// startTCPInfoMonitor begins polling conn every interval. It returns nil when
+// interval is 0 or the platform has no TCP_INFO.
+func startTCPInfoMonitor(conn net.Conn, interval time.Duration) *tcpInfoMonitor {
+	if interval <= 0 {
+		return nil
+	}
+	if _, ok := readTCPInfo(conn); !ok {
+		return nil
+	}
+	m := &tcpInfoMonitor{conn: conn, stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.poll()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+	return m
+}
+
+func (m *tcpInfoMonitor) poll() {
+	info, ok := readTCPInfo(m.conn)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.polls++
+	m.rttSumUs += float64(info.rttUs)
+	m.rttVarSum += float64(info.rttVarUs)
+	m.last = info
+	m.haveSample = true
+}
+
+// finish takes a final reading and returns the stream's statistics.
+// It must be called before the connection is closed.
+func (m *tcpInfoMonitor) finish() *orchestrator.TCPStats {
+	if m == nil {
+		return nil
+	}
+	close(m.stop)
+	<-m.done
+	m.poll()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.haveSample {
+		return nil
+	}
+	return &orchestrator.TCPStats{
+		Retransmits: m.last.retransmits,
+		RttMs:       m.rttSumUs / float64(m.polls) / 1000,
+		RttVarMs:    m.rttVarSum / float64(m.polls) / 1000,
+		Cwnd:        m.last.cwnd,
+	}
+}
+
+// aggregateTCPStats combines per-stream statistics: retransmits and cwnd are
+// summed, RTT figures averaged. It returns nil if no stream had statistics.
+func aggregateTCPStats(streams []orchestrator.StreamResult) *orchestrator.TCPStats {
+	var total orchestrator.TCPStats
+	n := 0
+	for _, st := range streams {
+		if st.TCP == nil {
+			continue
+		}
+		n++
+		total.Retransmits += st.TCP.Retransmits
+		total.Cwnd += st.TCP.Cwnd
+		total.RttMs += st.TCP.RttMs
+		total.RttVarMs += st.TCP.RttVarMs
+	}
+	if n == 0 {
+		return nil
+	}
+	total.RttMs /= float64(n)
+	total.RttVarMs /= float64(n)
+	return &total
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// readTCPInfo returns the kernel's TCP_INFO for conn
+func readTCPInfo(conn net.Conn) (tcpInfo, bool) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return tcpInfo{}, false
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return tcpInfo{}, false
+	}
+	var info *unix.TCPInfo
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil || sockErr != nil {
+		return tcpInfo{}, false
+	}
+	return tcpInfo{
+		retransmits: int(info.Total_retrans),
+		rttUs:       info.Rtt,
+		rttVarUs:    info.Rttvar,
+		cwnd:        int(info.Snd_cwnd),
+	}, true
+}
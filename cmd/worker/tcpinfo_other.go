@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// readTCPInfo is only implemented on Linux
+func readTCPInfo(net.Conn) (tcpInfo, bool) {
+	return tcpInfo{}, false
+}
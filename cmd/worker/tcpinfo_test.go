@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/user/homelab-speedtest/internal/orchestrator"
+)
+
+func TestAggregateTCPStats(t *testing.T) {
+	if aggregateTCPStats([]orchestrator.StreamResult{{}, {}}) != nil {
+		t.Error("Expected nil without per-stream stats")
+	}
+
+	total := aggregateTCPStats([]orchestrator.StreamResult{
+		{TCP: &orchestrator.TCPStats{Retransmits: 2, RttMs: 1, RttVarMs: 0.5, Cwnd: 10}},
+		{},
+		{TCP: &orchestrator.TCPStats{Retransmits: 3, RttMs: 3, RttVarMs: 1.5, Cwnd: 20}},
+	})
+	want := orchestrator.TCPStats{Retransmits: 5, RttMs: 2, RttVarMs: 1, Cwnd: 30}
+	if total == nil || *total != want {
+		t.Errorf("Expected %+v, got %+v", want, total)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/orchestrator"
+)
+
+// The orchestrator sizes its test timeouts from these, so they live with the protocol
+const (
+	defaultMaxHops      = orchestrator.DefaultTraceMaxHops
+	maxTraceHops        = orchestrator.MaxTraceHops
+	defaultTraceQueries = orchestrator.DefaultTraceQueries
+	traceProbeTimeout   = orchestrator.TraceProbeTimeout
+	pmtuProbeTimeout    = orchestrator.PMTUProbeTimeout
+	pmtuAttempts        = orchestrator.PMTUAttempts
+)
+
+// errTraceUnsupported is returned where the kernel interfaces for trace and pmtu are missing
+var errTraceUnsupported = errors.New("trace and pmtu are only supported on Linux")
+
+// hopReply is the outcome of one traceroute probe; from is invalid when nothing answered.
+// unreachable is set when a router rejected the probe for a reason other than its TTL.
+type hopReply struct {
+	from        netip.Addr
+	rtt         time.Duration
+	reached     bool
+	unreachable bool
+}
+
+// mtuProber sends one probe of an IP packet size with DF set. fits reports whether
+// it made it to the target and back; nextHopMTU is the MTU a router or the local
+// stack reported when it didn't, 0 if unknown.
+type mtuProber interface {
+	probe(size int) (fits bool, nextHopMTU int, err error)
+}
+
+// resolveTarget resolves the worker address a trace or pmtu test runs against
+func resolveTarget(target string) (netip.AddrPort, error) {
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), nil
+}
+
+func runTrace(req orchestrator.WorkerRequest, resp *orchestrator.WorkerResponse) {
+	protocol := req.Protocol
+	if protocol == "" {
+		protocol = orchestrator.TraceUDP
+	}
+	maxHops := req.MaxHops
+	if maxHops <= 0 {
+		maxHops = defaultMaxHops
+	}
+	maxHops = min(maxHops, maxTraceHops)
+	queries := req.Queries
+	if queries <= 0 {
+		queries = defaultTraceQueries
+	}
+
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "Worker trace error: %v\n", err)
+		resp.Success = false
+		resp.Error = err.Error()
+	}
+	if protocol != orchestrator.TraceUDP && protocol != orchestrator.TraceTCP {
+		fail(fmt.Errorf("unknown trace protocol %q", protocol))
+		return
+	}
+	dst, err := resolveTarget(req.Target)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Worker tracing %s over %s (max hops=%d, queries=%d)\n", dst, protocol, maxHops, queries)
+
+	reached := false
+	var rejectedBy netip.Addr
+	for ttl := 1; ttl <= maxHops && !reached && !rejectedBy.IsValid(); ttl++ {
+		replies := make([]hopReply, 0, queries)
+		for range queries {
+			r, err := probeHop(protocol, dst, ttl, traceProbeTimeout)
+			if err != nil {
+				fail(err)
+				return
+			}
+			replies = append(replies, r)
+			reached = reached || r.reached
+			if r.unreachable {
+				rejectedBy = r.from
+			}
+		}
+		hop := summarizeHop(ttl, replies)
+		resp.Hops = append(resp.Hops, hop)
+		fmt.Fprintf(os.Stderr, "Worker trace hop %2d: %-39s %d/%d %.3f ms\n",
+			hop.TTL, hop.Address, hop.Received, hop.Sent, hop.RttAvgMs)
+	}
+
+	if !reached && rejectedBy.IsValid() {
+		fail(fmt.Errorf("target unreachable: %s rejected the probes", rejectedBy))
+		return
+	}
+	if !reached {
+		fail(fmt.Errorf("target not reached within %d hops", maxHops))
+		return
+	}
+	resp.LatencyMs = resp.Hops[len(resp.Hops)-1].RttAvgMs
+	resp.Success = true
+}
+
+// summarizeHop condenses the replies to one TTL. If several routers answered
+// (ECMP) the first responder is reported and RTTs cover all of them.
+func summarizeHop(ttl int, replies []hopReply) orchestrator.TraceHop {
+	hop := orchestrator.TraceHop{TTL: ttl, Sent: len(replies)}
+	var sum float64
+	for _, r := range replies {
+		if !r.from.IsValid() {
+			continue
+		}
+		rtt := float64(r.rtt) / float64(time.Millisecond)
+		if hop.Received == 0 {
+			hop.Address = r.from.String()
+			hop.RttMinMs = rtt
+			hop.RttMaxMs = rtt
+		}
+		hop.RttMinMs = math.Min(hop.RttMinMs, rtt)
+		hop.RttMaxMs = math.Max(hop.RttMaxMs, rtt)
+		hop.Received++
+		sum += rtt
+	}
+	if hop.Received > 0 {
+		hop.RttAvgMs = sum / float64(hop.Received)
+	}
+	return hop
+}
+
+func runPMTU(req orchestrator.WorkerRequest, resp *orchestrator.WorkerResponse) {
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "Worker pmtu error: %v\n", err)
+		resp.Success = false
+		resp.Error = err.Error()
+	}
+	dst, err := resolveTarget(req.Target)
+	if err != nil {
+		fail(err)
+		return
+	}
+	sock, err := newPMTUSocket(dst)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer sock.close()
+
+	lo, hi := minPathMTU(dst.Addr()), sock.routeMTU()
+	fmt.Fprintf(os.Stderr, "Worker discovering path MTU to %s (between %d and %d)\n", dst, lo, hi)
+
+	mtu, err := searchPathMTU(sock, lo, hi)
+	if err != nil {
+		fail(err)
+		return
+	}
+	resp.PathMTU = mtu
+	resp.Success = true
+	fmt.Fprintf(os.Stderr, "Worker path MTU to %s: %d\n", dst, mtu)
+}
+
+// minPathMTU is the smallest MTU the IP version guarantees
+func minPathMTU(addr netip.Addr) int {
+	if addr.Is4() {
+		return 576
+	}
+	return 1280
+}
+
+// searchPathMTU binary searches the largest size in [lo, hi] that gets through.
+// lo is assumed to fit; at least one probe at lo must succeed or the target is
+// considered unreachable.
+func searchPathMTU(p mtuProber, lo, hi int) (int, error) {
+	fits, _, err := p.probe(lo)
+	if err != nil {
+		return 0, err
+	}
+	if !fits {
+		return 0, fmt.Errorf("no answer to %d byte probes", lo)
+	}
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		fits, nextHop, err := p.probe(mid)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case fits:
+			lo = mid
+		case nextHop >= lo && nextHop < mid:
+			// A router told us the limit; verify it rather than trusting it blindly
+			hi = nextHop
+		default:
+			hi = mid - 1
+		}
+	}
+	return lo, nil
+}
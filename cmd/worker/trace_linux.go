@@ -0,0 +1,327 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/user/homelab-speedtest/internal/orchestrator"
+)
+
+// Both modes work without raw sockets: ICMP errors triggered by our probes are
+// read from the socket's error queue (IP_RECVERR), which also names the router
+// that sent them.
+
+// sizeofSockExtendedErr is struct sock_extended_err, followed by the offender's sockaddr
+const sizeofSockExtendedErr = 16
+
+// sockErr is one entry of a socket's error queue
+type sockErr struct {
+	errno  unix.Errno
+	origin uint8
+	icmp   uint8  // ICMP(v6) type for ICMP origins
+	info   uint32 // next-hop MTU for EMSGSIZE
+	from   netip.Addr
+}
+
+// timeExceeded reports whether a router dropped the probe because its TTL ran out
+func (se *sockErr) timeExceeded() bool {
+	return (se.origin == unix.SO_EE_ORIGIN_ICMP && se.icmp == 11) ||
+		(se.origin == unix.SO_EE_ORIGIN_ICMP6 && se.icmp == 3)
+}
+
+// openProbeSocket creates a non-blocking socket that queues ICMP errors
+func openProbeSocket(addr netip.Addr, typ int) (int, error) {
+	family, level, opt := unix.AF_INET, unix.SOL_IP, unix.IP_RECVERR
+	if addr.Is6() {
+		family, level, opt = unix.AF_INET6, unix.SOL_IPV6, unix.IPV6_RECVERR
+	}
+	fd, err := unix.Socket(family, typ|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("socket: %w", err)
+	}
+	if err := unix.SetsockoptInt(fd, level, opt, 1); err != nil {
+		_ = unix.Close(fd)
+		return -1, fmt.Errorf("enabling error queue: %w", err)
+	}
+	return fd, nil
+}
+
+func sockaddr(dst netip.AddrPort) unix.Sockaddr {
+	if dst.Addr().Is4() {
+		return &unix.SockaddrInet4{Port: int(dst.Port()), Addr: dst.Addr().As4()}
+	}
+	return &unix.SockaddrInet6{Port: int(dst.Port()), Addr: dst.Addr().As16()}
+}
+
+func setHopLimit(fd int, addr netip.Addr, ttl int) error {
+	if addr.Is4() {
+		return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TTL, ttl)
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+}
+
+// pollFor waits up to timeout for events on fd. It returns 0 on timeout.
+func pollFor(fd int, events int16, timeout time.Duration) (int16, error) {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: events}}
+	for {
+		n, err := unix.Poll(fds, int(timeout.Milliseconds())+1)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil || n == 0 {
+			return 0, err
+		}
+		return fds[0].Revents, nil
+	}
+}
+
+// readErrQueue pops one entry off the error queue; nil if it is empty
+func readErrQueue(fd int) (*sockErr, error) {
+	buf := make([]byte, 512)
+	oob := make([]byte, 512)
+	_, oobn, _, _, err := unix.Recvmsg(fd, buf, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+	if errors.Is(err, unix.EAGAIN) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading error queue: %w", err)
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, fmt.Errorf("parsing error queue: %w", err)
+	}
+	for _, m := range msgs {
+		isErr := (m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_RECVERR) ||
+			(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_RECVERR)
+		if !isErr || len(m.Data) < sizeofSockExtendedErr {
+			continue
+		}
+		se := &sockErr{
+			errno:  unix.Errno(binary.NativeEndian.Uint32(m.Data[0:4])),
+			origin: m.Data[4],
+			icmp:   m.Data[5],
+			info:   binary.NativeEndian.Uint32(m.Data[8:12]),
+		}
+		offender := m.Data[sizeofSockExtendedErr:]
+		if len(offender) >= 2 {
+			switch binary.NativeEndian.Uint16(offender[0:2]) {
+			case unix.AF_INET:
+				if len(offender) >= 8 {
+					se.from = netip.AddrFrom4([4]byte(offender[4:8]))
+				}
+			case unix.AF_INET6:
+				if len(offender) >= 24 {
+					se.from = netip.AddrFrom16([16]byte(offender[8:24])).Unmap()
+				}
+			}
+		}
+		return se, nil
+	}
+	return nil, nil
+}
+
+// probeHop sends one probe with the given TTL and waits for the target's answer
+// or an ICMP error from a router on the way. A zero hopReply means no answer.
+func probeHop(protocol string, dst netip.AddrPort, ttl int, timeout time.Duration) (hopReply, error) {
+	typ := unix.SOCK_DGRAM
+	if protocol == orchestrator.TraceTCP {
+		typ = unix.SOCK_STREAM
+	}
+	fd, err := openProbeSocket(dst.Addr(), typ)
+	if err != nil {
+		return hopReply{}, err
+	}
+	defer func() { _ = unix.Close(fd) }()
+	if err := setHopLimit(fd, dst.Addr(), ttl); err != nil {
+		return hopReply{}, fmt.Errorf("setting TTL: %w", err)
+	}
+
+	start := time.Now()
+	events := int16(unix.POLLIN)
+	err = unix.Connect(fd, sockaddr(dst))
+	if typ == unix.SOCK_STREAM {
+		if err != nil && !errors.Is(err, unix.EINPROGRESS) {
+			return hopReply{}, fmt.Errorf("connect: %w", err)
+		}
+		events = unix.POLLOUT
+	} else {
+		if err != nil {
+			return hopReply{}, fmt.Errorf("connect: %w", err)
+		}
+		packet := make([]byte, probeHeaderSize)
+		copy(packet, probeMagic)
+		binary.BigEndian.PutUint32(packet[4:8], uint32(ttl))
+		binary.BigEndian.PutUint64(packet[8:16], uint64(start.UnixNano()))
+		if _, err := unix.Write(fd, packet); err != nil {
+			return hopReply{}, fmt.Errorf("sending probe: %w", err)
+		}
+	}
+
+	target := hopReply{from: dst.Addr(), reached: true}
+	buf := make([]byte, maxProbeSize)
+	for {
+		remaining := time.Until(start.Add(timeout))
+		if remaining <= 0 {
+			return hopReply{}, nil
+		}
+		revents, err := pollFor(fd, events, remaining)
+		if err != nil {
+			return hopReply{}, fmt.Errorf("poll: %w", err)
+		}
+		if revents == 0 {
+			continue
+		}
+		rtt := time.Since(start)
+		target.rtt = rtt
+
+		if revents&unix.POLLERR != 0 {
+			se, err := readErrQueue(fd)
+			if err != nil {
+				return hopReply{}, err
+			}
+			if se != nil && se.from.IsValid() {
+				// Time exceeded from a router, or e.g. port unreachable from the target itself
+				reached := se.from == dst.Addr()
+				return hopReply{from: se.from, rtt: rtt, reached: reached, unreachable: !reached && !se.timeExceeded()}, nil
+			}
+		}
+
+		if typ == unix.SOCK_STREAM {
+			soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+			if err != nil {
+				return hopReply{}, fmt.Errorf("connect: %w", err)
+			}
+			switch unix.Errno(soErr) {
+			case 0, unix.ECONNREFUSED:
+				// SYN-ACK or RST: either way the target answered
+				return target, nil
+			default:
+				return hopReply{}, nil
+			}
+		}
+
+		if revents&unix.POLLIN != 0 {
+			n, err := unix.Read(fd, buf)
+			if err == nil && isProbe(buf[:n]) {
+				return target, nil
+			}
+			if errors.Is(err, unix.ECONNREFUSED) {
+				// The host answered but no worker is listening
+				return target, nil
+			}
+		}
+	}
+}
+
+// pmtuSocket is a connected UDP socket that sends with DF set regardless of
+// the kernel's cached path MTU
+type pmtuSocket struct {
+	fd       int
+	v6       bool
+	overhead int // IP + UDP header bytes
+	seq      uint32
+}
+
+func newPMTUSocket(dst netip.AddrPort) (*pmtuSocket, error) {
+	fd, err := openProbeSocket(dst.Addr(), unix.SOCK_DGRAM)
+	if err != nil {
+		return nil, err
+	}
+	s := &pmtuSocket{fd: fd, v6: dst.Addr().Is6(), overhead: 20 + 8}
+	if s.v6 {
+		s.overhead = 40 + 8
+		err = unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+	} else {
+		err = unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+	}
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("setting DF: %w", err)
+	}
+	if err := unix.Connect(fd, sockaddr(dst)); err != nil {
+		s.close()
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	return s, nil
+}
+
+func (s *pmtuSocket) close() {
+	_ = unix.Close(s.fd)
+}
+
+// routeMTU is the MTU the kernel knows for the route to the target
+func (s *pmtuSocket) routeMTU() int {
+	var mtu int
+	var err error
+	if s.v6 {
+		mtu, err = unix.GetsockoptInt(s.fd, unix.SOL_IPV6, unix.IPV6_MTU)
+	} else {
+		mtu, err = unix.GetsockoptInt(s.fd, unix.SOL_IP, unix.IP_MTU)
+	}
+	if err != nil || mtu <= 0 {
+		return 1500
+	}
+	return mtu
+}
+
+func (s *pmtuSocket) probe(size int) (bool, int, error) {
+	packet := make([]byte, min(max(size-s.overhead, probeHeaderSize), maxProbeSize))
+	copy(packet, probeMagic)
+
+	for range pmtuAttempts {
+		s.seq++
+		binary.BigEndian.PutUint32(packet[4:8], s.seq)
+		if _, err := unix.Write(s.fd, packet); err != nil {
+			if errors.Is(err, unix.EMSGSIZE) {
+				return false, s.routeMTU(), nil
+			}
+			return false, 0, fmt.Errorf("sending probe: %w", err)
+		}
+		fits, mtu, done, err := s.await(s.seq)
+		if err != nil || done {
+			return fits, mtu, err
+		}
+	}
+	return false, 0, nil
+}
+
+// await waits for the echo of probe seq. done is false if nothing came back in time.
+func (s *pmtuSocket) await(seq uint32) (fits bool, mtu int, done bool, err error) {
+	deadline := time.Now().Add(pmtuProbeTimeout)
+	buf := make([]byte, maxProbeSize)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false, 0, false, nil
+		}
+		revents, err := pollFor(s.fd, unix.POLLIN, remaining)
+		if err != nil {
+			return false, 0, true, fmt.Errorf("poll: %w", err)
+		}
+		if revents&unix.POLLERR != 0 {
+			se, err := readErrQueue(s.fd)
+			if err != nil {
+				return false, 0, true, err
+			}
+			if se != nil {
+				if se.errno == unix.EMSGSIZE {
+					return false, int(se.info), true, nil
+				}
+				return false, 0, true, fmt.Errorf("probe rejected by %s: %w", se.from, se.errno)
+			}
+		}
+		if revents&unix.POLLIN != 0 {
+			n, err := unix.Read(s.fd, buf)
+			if err == nil && isProbe(buf[:n]) && binary.BigEndian.Uint32(buf[4:8]) == seq {
+				return true, 0, true, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import (
+	"net/netip"
+	"time"
+)
+
+// probeHop and newPMTUSocket rely on the Linux socket error queue
+
+func probeHop(string, netip.AddrPort, int, time.Duration) (hopReply, error) {
+	return hopReply{}, errTraceUnsupported
+}
+
+type pmtuSocket struct{}
+
+func newPMTUSocket(netip.AddrPort) (*pmtuSocket, error) {
+	return nil, errTraceUnsupported
+}
+
+func (s *pmtuSocket) close() {}
+
+func (s *pmtuSocket) routeMTU() int { return 0 }
+
+func (s *pmtuSocket) probe(int) (bool, int, error) {
+	return false, 0, errTraceUnsupported
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// fakePath fits packets up to mtu; routers report it when tell is set
+type fakePath struct {
+	mtu    int
+	tell   bool
+	probes int
+}
+
+func (p *fakePath) probe(size int) (bool, int, error) {
+	p.probes++
+	if size <= p.mtu {
+		return true, 0, nil
+	}
+	if p.tell {
+		return false, p.mtu, nil
+	}
+	return false, 0, nil
+}
+
+func TestSearchPathMTU(t *testing.T) {
+	silent := &fakePath{mtu: 1472}
+	if mtu, err := searchPathMTU(silent, 576, 9000); err != nil || mtu != 1472 {
+		t.Errorf("Expected 1472, got %d (err %v)", mtu, err)
+	}
+
+	// A frag-needed hint should shortcut the search
+	told := &fakePath{mtu: 1400, tell: true}
+	if mtu, err := searchPathMTU(told, 576, 9000); err != nil || mtu != 1400 {
+		t.Errorf("Expected 1400, got %d (err %v)", mtu, err)
+	}
+	if told.probes >= silent.probes {
+		t.Errorf("Expected fewer probes with MTU hints, got %d vs %d", told.probes, silent.probes)
+	}
+
+	if _, err := searchPathMTU(&fakePath{mtu: 500}, 576, 1500); err == nil {
+		t.Error("Expected an error when the smallest probe gets no answer")
+	}
+}
+
+func TestSummarizeHop(t *testing.T) {
+	router := netip.MustParseAddr("192.0.2.1")
+	hop := summarizeHop(3, []hopReply{
+		{from: router, rtt: 2 * time.Millisecond},
+		{}, // lost
+		{from: router, rtt: 4 * time.Millisecond},
+	})
+	if hop.TTL != 3 || hop.Sent != 3 || hop.Received != 2 {
+		t.Errorf("Unexpected counts: %+v", hop)
+	}
+	if hop.Address != "192.0.2.1" {
+		t.Errorf("Expected address 192.0.2.1, got %q", hop.Address)
+	}
+	if hop.RttMinMs != 2 || hop.RttAvgMs != 3 || hop.RttMaxMs != 4 {
+		t.Errorf("Unexpected RTTs: %+v", hop)
+	}
+
+	if silent := summarizeHop(4, []hopReply{{}, {}}); silent.Address != "" || silent.Received != 0 {
+		t.Errorf("Expected an unanswered hop, got %+v", silent)
+	}
+}
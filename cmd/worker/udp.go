@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"os"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/orchestrator"
+)
+
+// UDP throughput packets (all integers big endian):
+//
+//	data:    "HLPU" | session uint32 | seq uint64 | send time unix nanos int64 | padding
+//	fin:     "HLPF" | session uint32 | packets sent uint64
+//	summary: "HLPS" | session uint32 | JSON udpSummary
+var (
+	udpDataMagic    = []byte("HLPU")
+	udpFinMagic     = []byte("HLPF")
+	udpSummaryMagic = []byte("HLPS")
+)
+
+const (
+	udpDataHeaderSize = 24
+	udpFinSize        = 16
+
+	defaultUDPPayloadSize = 1400 // stays below a 1500 byte MTU with IP/UDP headers
+	defaultUDPBitrateMbps = 10
+	defaultTestDuration   = orchestrator.DefaultDurationSeconds * time.Second
+
+	udpFinRetries  = 10
+	udpFinInterval = 200 * time.Millisecond
+	udpSessionTTL  = 1 * time.Minute
+
+	// udpMaxSeq bounds the per-session bitset (32MB) against bogus sequence numbers
+	udpMaxSeq = 1 << 28
+)
+
+// udpSummary is what the server reports back to the client at the end of a UDP test
+type udpSummary struct {
+	PacketsReceived   int     `json:"packets_received"`
+	PacketsLost       int     `json:"packets_lost"`
+	PacketsDuplicated int     `json:"packets_duplicated"`
+	PacketsReordered  int     `json:"packets_reordered"`
+	BytesReceived     int64   `json:"bytes_received"`
+	JitterMs          float64 `json:"jitter_ms"`
+	DurationSeconds   float64 `json:"duration_seconds"`
+}
+
+// udpSession tracks the receive side of one UDP test
+type udpSession struct {
+	seen       []uint64 // bitset of received sequence numbers
+	maxSeq     int64
+	first      time.Time
+	last       time.Time
+	transit    float64
+	hasTransit bool
+	summary    udpSummary
+}
+
+func newUDPSession() *udpSession {
+	return &udpSession{maxSeq: -1}
+}
+
+// record accounts for a data packet with the given sequence number and sender timestamp
+func (s *udpSession) record(seq uint64, sentAt time.Time, size int, now time.Time) {
+	word, bit := seq/64, seq%64
+	for uint64(len(s.seen)) <= word {
+		s.seen = append(s.seen, 0)
+	}
+	if s.seen[word]&(1<<bit) != 0 {
+		s.summary.PacketsDuplicated++
+		return
+	}
+	s.seen[word] |= 1 << bit
+
+	if s.first.IsZero() {
+		s.first = now
+	}
+	s.last = now
+	s.summary.PacketsReceived++
+	s.summary.BytesReceived += int64(size)
+
+	if int64(seq) < s.maxSeq {
+		s.summary.PacketsReordered++
+	} else {
+		s.maxSeq = int64(seq)
+	}
+
+	// RFC 3550 interarrival jitter; the clock offset between hosts cancels out in the difference
+	transit := float64(now.Sub(sentAt)) / float64(time.Millisecond)
+	if s.hasTransit {
+		d := math.Abs(transit - s.transit)
+		s.summary.JitterMs += (d - s.summary.JitterMs) / 16
+	}
+	s.transit = transit
+	s.hasTransit = true
+}
+
+// finish closes the session given the number of packets the client claims to have sent
+func (s *udpSession) finish(sent int) udpSummary {
+	s.summary.PacketsLost = max(sent-s.summary.PacketsReceived, 0)
+	if !s.first.IsZero() {
+		s.summary.DurationSeconds = s.last.Sub(s.first).Seconds()
+	}
+	return s.summary
+}
+
+// runUDPResponder serves all UDP traffic on pc until it is closed: latency probes are
+// echoed, throughput data is accounted per session and fin packets get a summary reply.
+func runUDPResponder(pc net.PacketConn) {
+	sessions := make(map[uint32]*udpSession)
+
+	buf := make([]byte, maxProbeSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		now := time.Now()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "Worker UDP read error: %v\n", err)
+			continue
+		}
+		pkt := buf[:n]
+
+		switch {
+		case isProbe(pkt):
+			if _, err := pc.WriteTo(pkt, addr); err != nil {
+				fmt.Fprintf(os.Stderr, "Worker UDP echo error: %v\n", err)
+			}
+
+		case len(pkt) >= udpDataHeaderSize && string(pkt[:4]) == string(udpDataMagic):
+			id := binary.BigEndian.Uint32(pkt[4:8])
+			seq := binary.BigEndian.Uint64(pkt[8:16])
+			sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(pkt[16:24])))
+			if seq > udpMaxSeq {
+				continue
+			}
+			sess, ok := sessions[id]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Worker UDP session %08x started from %s\n", id, addr)
+				sess = newUDPSession()
+				sessions[id] = sess
+			}
+			sess.record(seq, sentAt, n, now)
+
+		case len(pkt) >= udpFinSize && string(pkt[:4]) == string(udpFinMagic):
+			id := binary.BigEndian.Uint32(pkt[4:8])
+			sent := int(binary.BigEndian.Uint64(pkt[8:16]))
+			sess, ok := sessions[id]
+			if !ok {
+				sess = newUDPSession()
+				sessions[id] = sess
+			}
+			summary := sess.finish(sent)
+			for otherID, other := range sessions {
+				if otherID != id && now.Sub(other.last) > udpSessionTTL {
+					delete(sessions, otherID)
+				}
+			}
+
+			data, _ := json.Marshal(summary)
+			reply := make([]byte, 8, 8+len(data))
+			copy(reply, udpSummaryMagic)
+			binary.BigEndian.PutUint32(reply[4:8], id)
+			reply = append(reply, data...)
+			if _, err := pc.WriteTo(reply, addr); err != nil {
+				fmt.Fprintf(os.Stderr, "Worker UDP summary error: %v\n", err)
+			}
+		}
+	}
+}
+
+func runUDPClient(req orchestrator.WorkerRequest, resp *orchestrator.WorkerResponse) {
+	bitrate := req.BitrateMbps
+	if bitrate <= 0 {
+		bitrate = defaultUDPBitrateMbps
+	}
+	size := req.PayloadSize
+	if size <= 0 {
+		size = defaultUDPPayloadSize
+	}
+	size = min(max(size, udpDataHeaderSize), maxProbeSize)
+	duration := defaultTestDuration
+	if req.DurationSeconds > 0 {
+		duration = time.Duration(req.DurationSeconds) * time.Second
+	}
+
+	fmt.Fprintf(os.Stderr, "Worker UDP client sending to %s at %.2f Mbps (size=%d, duration=%v)\n", req.Target, bitrate, size, duration)
+
+	conn, err := net.DialTimeout("udp", req.Target, 5*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Worker UDP client dial error: %v\n", err)
+		resp.Success = false
+		resp.Error = fmt.Sprintf("dial error: %v", err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	session := rand.Uint32()
+	packetsPerSecond := bitrate * 1e6 / float64(size*8)
+
+	packet := make([]byte, size)
+	copy(packet, udpDataMagic)
+	binary.BigEndian.PutUint32(packet[4:8], session)
+
+	var sent uint64
+	var lastErr error
+	start := time.Now()
+	deadline := start.Add(duration)
+	for {
+		now := time.Now()
+		if !now.Before(deadline) {
+			break
+		}
+		// Pace against the ideal schedule so short sleeps don't accumulate drift
+		due := uint64(now.Sub(start).Seconds() * packetsPerSecond)
+		if sent >= due {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		for ; sent < due; sent++ {
+			binary.BigEndian.PutUint64(packet[8:16], sent)
+			binary.BigEndian.PutUint64(packet[16:24], uint64(time.Now().UnixNano()))
+			if _, err := conn.Write(packet); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	elapsed := time.Since(start).Seconds()
+
+	summary, err := requestUDPSummary(conn, session, sent)
+	if err != nil {
+		if lastErr != nil {
+			err = fmt.Errorf("%w (last send error: %v)", err, lastErr)
+		}
+		fmt.Fprintf(os.Stderr, "Worker UDP client error: %v\n", err)
+		resp.Success = false
+		resp.Error = err.Error()
+		resp.PacketsSent = int(sent)
+		return
+	}
+
+	resp.PacketsSent = int(sent)
+	resp.PacketsReceived = summary.PacketsReceived
+	resp.PacketsLost = summary.PacketsLost
+	resp.PacketsDuplicated = summary.PacketsDuplicated
+	resp.PacketsReordered = summary.PacketsReordered
+	resp.JitterMs = summary.JitterMs
+	if sent > 0 {
+		resp.PacketLoss = float64(summary.PacketsLost) / float64(sent) * 100
+	}
+	// Throughput is what actually arrived, measured over the sender's transmit window
+	if elapsed > 0 {
+		resp.BandwidthMbps = float64(summary.BytesReceived) * 8 / 1e6 / elapsed
+	}
+	resp.Success = true
+
+	fmt.Fprintf(os.Stderr, "Worker UDP client finished. Sent %d, received %d, lost %d (%.2f%%), dup %d, reordered %d, jitter %.3f ms, %.2f Mbps\n",
+		sent, summary.PacketsReceived, summary.PacketsLost, resp.PacketLoss, summary.PacketsDuplicated,
+		summary.PacketsReordered, summary.JitterMs, resp.BandwidthMbps)
+}
+
+// requestUDPSummary sends fin packets until the server answers with its receive summary
+func requestUDPSummary(conn net.Conn, session uint32, sent uint64) (udpSummary, error) {
+	fin := make([]byte, udpFinSize)
+	copy(fin, udpFinMagic)
+	binary.BigEndian.PutUint32(fin[4:8], session)
+	binary.BigEndian.PutUint64(fin[8:16], sent)
+
+	buf := make([]byte, maxProbeSize)
+	for i := 0; i < udpFinRetries; i++ {
+		if _, err := conn.Write(fin); err != nil {
+			return udpSummary{}, fmt.Errorf("failed to send fin: %w", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(udpFinInterval))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if n < 8 || string(buf[:4]) != string(udpSummaryMagic) || binary.BigEndian.Uint32(buf[4:8]) != session {
+				continue
+			}
+			var summary udpSummary
+			if err := json.Unmarshal(buf[8:n], &summary); err != nil {
+				return udpSummary{}, fmt.Errorf("invalid summary from server: %w", err)
+			}
+			return summary, nil
+		}
+	}
+	return udpSummary{}, fmt.Errorf("no summary received from server after %d attempts", udpFinRetries)
+}
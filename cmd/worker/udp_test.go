@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUDPSessionAccounting(t *testing.T) {
+	sess := newUDPSession()
+	base := time.Now()
+
+	// 0, 1, 3, 2 (reordered), 3 (duplicate); 4 never arrives
+	for i, seq := range []uint64{0, 1, 3, 2, 3} {
+		sess.record(seq, base.Add(time.Duration(seq)*time.Millisecond), 100, base.Add(time.Duration(i)*time.Millisecond))
+	}
+	summary := sess.finish(5)
+
+	if summary.PacketsReceived != 4 {
+		t.Errorf("Expected 4 received, got %d", summary.PacketsReceived)
+	}
+	if summary.PacketsLost != 1 {
+		t.Errorf("Expected 1 lost, got %d", summary.PacketsLost)
+	}
+	if summary.PacketsDuplicated != 1 {
+		t.Errorf("Expected 1 duplicate, got %d", summary.PacketsDuplicated)
+	}
+	if summary.PacketsReordered != 1 {
+		t.Errorf("Expected 1 reordered, got %d", summary.PacketsReordered)
+	}
+	if summary.BytesReceived != 400 {
+		t.Errorf("Expected 400 bytes, got %d", summary.BytesReceived)
+	}
+	if summary.JitterMs <= 0 {
+		t.Errorf("Expected non-zero jitter for uneven arrivals, got %f", summary.JitterMs)
+	}
+}
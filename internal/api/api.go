@@ -1,11 +1,15 @@
 package api
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -80,6 +84,13 @@ func (h *Handler) BroadcastQueueStatus(status orchestrator.QueueStatus) {
 	})
 }
 
+func (h *Handler) BroadcastAgentStatus(status orchestrator.AgentStatus) {
+	h.broadcast(map[string]any{
+		"type": "agent",
+		"data": status,
+	})
+}
+
 func (h *Handler) broadcast(event any) {
 	// Broadcast to SSE clients
 	h.clientsMu.Lock()
@@ -125,15 +136,62 @@ func (h *Handler) routes() {
 				Type    string `json:"type"`
 				Cron    string `json:"cron"`
 				Enabled bool   `json:"enabled"`
+
+				// Speed test options; omitted fields are left unchanged
+				DurationSeconds *int `json:"duration_seconds"`
+				BufferSize      *int `json:"buffer_size"`
+				OmitSeconds     *int `json:"omit_seconds"`
 			}
 			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 				http.Error(w, err.Error(), 400)
 				return
 			}
+			hasOptions := req.DurationSeconds != nil || req.BufferSize != nil || req.OmitSeconds != nil
+			if hasOptions && req.Type != "speed" && req.Type != "bufferbloat" {
+				http.Error(w, "test options are only supported on the speed and bufferbloat schedules", 400)
+				return
+			}
+			var opts db.TestOptions
+			if hasOptions {
+				schedules, err := h.db.GetSchedules()
+				if err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+				for _, sch := range schedules {
+					if sch.Type == req.Type {
+						opts = sch.TestOptions
+					}
+				}
+				if req.DurationSeconds != nil {
+					opts.DurationSeconds = *req.DurationSeconds
+				}
+				if req.BufferSize != nil {
+					opts.BufferSize = *req.BufferSize
+				}
+				if req.OmitSeconds != nil {
+					opts.OmitSeconds = *req.OmitSeconds
+				}
+				check := orchestrator.SpeedTestOptions{
+					DurationSeconds: opts.DurationSeconds,
+					BufferSize:      opts.BufferSize,
+					OmitSeconds:     &opts.OmitSeconds,
+				}
+				if err := check.Validate(); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+			}
 			if err := h.db.UpdateSchedule(req.Type, req.Cron, req.Enabled); err != nil {
 				http.Error(w, err.Error(), 500)
 				return
 			}
+			if hasOptions {
+				if err := h.db.UpdateScheduleOptions(req.Type, opts); err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+			}
 			// Reload scheduler
 			h.scheduler.Reload()
 			w.WriteHeader(http.StatusOK)
@@ -172,10 +230,124 @@ func (h *Handler) routes() {
 			return
 		}
 
+		dev, err := h.db.GetDevice(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		devices, err := h.db.GetDevices()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, other := range devices {
+			if other.JumpDeviceID == id {
+				http.Error(w, fmt.Sprintf("Device is the jump host of %s", other.Name), http.StatusConflict)
+				return
+			}
+		}
+		// Uninstall first, while the device's host key is still pinned
+		if dev != nil && dev.WorkerCleanup == db.CleanupOnDelete {
+			if err := h.orch.RemoveWorker(*dev); err != nil {
+				log.Printf("Deleting device %d: failed to remove its worker: %v", id, err)
+			}
+		}
+
 		if err := h.db.DeleteDevice(id); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		h.orch.Pool.Evict(id)
+		h.orch.Agents.Disconnect(id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Issue a new enrollment token for the device's agent; the previous one stops working
+	h.HandleFunc("POST /devices/{id}/agent-token", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		dev, err := h.db.GetDevice(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dev == nil {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		}
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		token := hex.EncodeToString(buf)
+		if err := h.db.SetAgentToken(id, token); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.orch.Agents.Disconnect(id)
+		log.Printf("Issued a new agent token for device %s", dev.Name)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": token})
+	})
+
+	h.HandleFunc("DELETE /devices/{id}/worker", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		dev, err := h.db.GetDevice(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dev == nil {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		}
+		if err := h.orch.RemoveWorker(*dev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	h.HandleFunc("GET /devices/{id}/hostkey", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		key, err := h.db.GetHostKey(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if key == nil {
+			http.Error(w, "No host key pinned", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(key)
+	})
+
+	// Forget the pinned host key, e.g. after a device was reinstalled
+	h.HandleFunc("DELETE /devices/{id}/hostkey", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		if err := h.db.DeleteHostKey(id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Reconnect so the next test verifies and pins the current key
+		h.orch.Pool.Evict(id)
+		log.Printf("Host key of device %d reset, the next connection pins a new one", id)
 		w.WriteHeader(http.StatusNoContent)
 	})
 
@@ -188,20 +360,26 @@ func (h *Handler) routes() {
 			return
 		}
 
-		var dev db.Device
-		if err := json.NewDecoder(r.Body).Decode(&dev); err != nil {
+		stored, err := h.db.GetDevice(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		dev, err := h.decodeDevice(r, stored)
+		if err != nil {
 			log.Printf("PUT /devices/%d: Body decode error: %v", id, err)
 			http.Error(w, err.Error(), 400)
 			return
 		}
 		dev.ID = id
 
-		log.Printf("Updating device %d: %+v", id, dev)
+		log.Printf("Updating device %d: %+v", id, maskDevice(dev))
 		if err := h.db.UpdateDevice(dev); err != nil {
 			log.Printf("PUT /devices/%d: Update error: %v", id, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		h.evictOnWorkerChange(stored, dev)
 		w.WriteHeader(http.StatusOK)
 	})
 
@@ -214,8 +392,13 @@ func (h *Handler) routes() {
 			return
 		}
 
-		var dev db.Device
-		if err := json.NewDecoder(r.Body).Decode(&dev); err != nil {
+		stored, err := h.db.GetDevice(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		dev, err := h.decodeDevice(r, stored)
+		if err != nil {
 			http.Error(w, err.Error(), 400)
 			return
 		}
@@ -225,6 +408,7 @@ func (h *Handler) routes() {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		h.evictOnWorkerChange(stored, dev)
 		w.WriteHeader(http.StatusOK)
 	})
 
@@ -236,10 +420,14 @@ func (h *Handler) routes() {
 				http.Error(w, err.Error(), 500)
 				return
 			}
+			for i := range devs {
+				devs[i] = maskDevice(devs[i])
+				devs[i].AgentOnline = devs[i].Transport == db.TransportAgent && h.orch.Agents.Online(devs[i].ID)
+			}
 			_ = json.NewEncoder(w).Encode(devs)
 		case "POST":
-			var dev db.Device
-			if err := json.NewDecoder(r.Body).Decode(&dev); err != nil {
+			dev, err := h.decodeDevice(r, nil)
+			if err != nil {
 				http.Error(w, err.Error(), 400)
 				return
 			}
@@ -251,6 +439,64 @@ func (h *Handler) routes() {
 		}
 	})
 
+	// Per device pair preferences (e.g. parallel stream count, test timeout)
+	h.HandleFunc("/pair-settings", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			settings, err := h.db.GetPairSettings()
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(settings)
+		case "PUT":
+			var ps db.PairSetting
+			if err := json.NewDecoder(r.Body).Decode(&ps); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if ps.SourceID == 0 || ps.TargetID == 0 || ps.SourceID == ps.TargetID {
+				http.Error(w, "source_id and target_id must be two different devices", http.StatusBadRequest)
+				return
+			}
+			if ps.ParallelStreams != nil && (*ps.ParallelStreams < 1 || *ps.ParallelStreams > 128) {
+				http.Error(w, "parallel_streams must be between 1 and 128", http.StatusBadRequest)
+				return
+			}
+			if ps.TimeoutSeconds != nil && (*ps.TimeoutSeconds < 1 || *ps.TimeoutSeconds > 3600) {
+				http.Error(w, "timeout_seconds must be between 1 and 3600", http.StatusBadRequest)
+				return
+			}
+			if err := h.db.SetPairSetting(ps); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	h.HandleFunc("DELETE /pair-settings/{source}/{target}", func(w http.ResponseWriter, r *http.Request) {
+		sourceID, err := strconv.Atoi(r.PathValue("source"))
+		if err != nil {
+			http.Error(w, "Invalid source ID", http.StatusBadRequest)
+			return
+		}
+		targetID, err := strconv.Atoi(r.PathValue("target"))
+		if err != nil {
+			http.Error(w, "Invalid target ID", http.StatusBadRequest)
+			return
+		}
+
+		if err := h.db.DeletePairSetting(sourceID, targetID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
 	h.HandleFunc("/results/latest", func(w http.ResponseWriter, r *http.Request) {
 		results, err := h.db.GetLatestResults()
 		if err != nil {
@@ -260,6 +506,55 @@ func (h *Handler) routes() {
 		_ = json.NewEncoder(w).Encode(results)
 	})
 
+	// Throughput time series of a speed test result
+	h.HandleFunc("GET /results/{id}/samples", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		exists, err := h.db.ResultExists(id)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if !exists {
+			http.Error(w, "Result not found", http.StatusNotFound)
+			return
+		}
+		samples, err := h.db.GetSamples(id)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(samples)
+	})
+
+	h.HandleFunc("GET /results/{id}/hops", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		exists, err := h.db.ResultExists(id)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if !exists {
+			http.Error(w, "Result not found", http.StatusNotFound)
+			return
+		}
+		hops, err := h.db.GetTraceHops(id)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(hops)
+	})
+
 	// SSE Endpoint
 	h.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
 		// Set headers for SSE
@@ -309,13 +604,65 @@ func (h *Handler) routes() {
 	})
 
 	h.HandleFunc("POST /test/ping/all", func(w http.ResponseWriter, r *http.Request) {
-		go h.scheduler.RunAllPings()
+		go h.scheduler.RunAllPings(taskSource(r))
 		w.WriteHeader(http.StatusAccepted)
 		_, _ = w.Write([]byte(`{"status": "initiated"}`))
 	})
 
 	h.HandleFunc("POST /test/speed/all", func(w http.ResponseWriter, r *http.Request) {
-		go h.scheduler.RunAllSpeeds()
+		// An optional body overrides the speed schedule's options for this run
+		opts, err := decodeTestOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		go h.scheduler.RunAllSpeeds(taskSource(r), opts)
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"status": "initiated"}`))
+	})
+
+	h.HandleFunc("POST /test/bufferbloat/all", func(w http.ResponseWriter, r *http.Request) {
+		opts, err := decodeTestOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		go h.scheduler.RunAllBufferbloat(taskSource(r), opts)
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"status": "initiated"}`))
+	})
+
+	// Traceroute and path MTU discovery for one pair
+	h.HandleFunc("POST /test/trace", func(w http.ResponseWriter, r *http.Request) {
+		var t orchestrator.TraceTask
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if t.SourceID == 0 || t.TargetID == 0 || t.SourceID == t.TargetID {
+			http.Error(w, "source_id and target_id must be two different devices", http.StatusBadRequest)
+			return
+		}
+		if err := t.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		devices, err := h.db.GetDevices()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		found := 0
+		for _, d := range devices {
+			if d.ID == t.SourceID || d.ID == t.TargetID {
+				found++
+			}
+		}
+		if found < 2 {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		}
+		go h.scheduler.RunTrace(taskSource(r), t)
 		w.WriteHeader(http.StatusAccepted)
 		_, _ = w.Write([]byte(`{"status": "initiated"}`))
 	})
@@ -327,6 +674,89 @@ func (h *Handler) routes() {
 		_ = json.NewEncoder(w).Encode(status)
 	})
 
+	h.HandleFunc("DELETE /queue/{taskID}", func(w http.ResponseWriter, r *http.Request) {
+		if !h.scheduler.CancelTask(r.PathValue("taskID")) {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Moves a queued task ahead of the others of its new priority, by
+	// default to the front of the queue
+	h.HandleFunc("POST /queue/{taskID}/priority", func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Priority orchestrator.TaskPriority `json:"priority"`
+		}{Priority: orchestrator.PriorityHigh}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Priority < orchestrator.PriorityNormal || req.Priority > orchestrator.PriorityHigh {
+			http.Error(w, "priority must be 0 (normal) or 1 (high)", http.StatusBadRequest)
+			return
+		}
+		if !h.scheduler.SetTaskPriority(r.PathValue("taskID"), req.Priority) {
+			http.Error(w, "Task not queued", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(h.scheduler.GetQueueStatus())
+	})
+
+	// Task history, newest first
+	h.HandleFunc("GET /tasks", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		limit, offset := 50, 0
+		if v := q.Get("limit"); v != "" {
+			l, err := strconv.Atoi(v)
+			if err != nil || l < 1 || l > 500 {
+				http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+				return
+			}
+			limit = l
+		}
+		if v := q.Get("offset"); v != "" {
+			o, err := strconv.Atoi(v)
+			if err != nil || o < 0 {
+				http.Error(w, "offset must be a non-negative number", http.StatusBadRequest)
+				return
+			}
+			offset = o
+		}
+		status := q.Get("status")
+		switch status {
+		case "", db.TaskQueued, db.TaskRunning, db.TaskDone, db.TaskFailed, db.TaskCancelled:
+		default:
+			http.Error(w, "Invalid status", http.StatusBadRequest)
+			return
+		}
+		tasks, total, err := h.db.GetTasks(limit, offset, status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Tasks []db.Task `json:"tasks"`
+			Total int       `json:"total"`
+		}{tasks, total})
+	})
+
+	h.HandleFunc("POST /queue/pause", func(w http.ResponseWriter, r *http.Request) {
+		h.scheduler.PauseQueue()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(h.scheduler.GetQueueStatus())
+	})
+
+	h.HandleFunc("POST /queue/resume", func(w http.ResponseWriter, r *http.Request) {
+		h.scheduler.ResumeQueue()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(h.scheduler.GetQueueStatus())
+	})
+
 	// Notification settings endpoints
 	h.HandleFunc("/notification-settings", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -467,6 +897,34 @@ func (h *Handler) routes() {
 		w.WriteHeader(http.StatusOK)
 	})
 
+	// Control channel of workers in agent mode, authenticated with the device's token
+	h.HandleFunc("GET /agent/ws", func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			http.Error(w, "Missing agent token", http.StatusUnauthorized)
+			return
+		}
+		dev, err := h.db.GetDeviceByAgentToken(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dev == nil {
+			http.Error(w, "Invalid agent token", http.StatusUnauthorized)
+			return
+		}
+		if dev.Transport != db.TransportAgent {
+			http.Error(w, fmt.Sprintf("Device %s doesn't use the agent transport", dev.Name), http.StatusForbidden)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("Agent WebSocket upgrade error: %v", err)
+			return
+		}
+		_ = h.orch.Agents.Serve(*dev, conn)
+	})
+
 	// WebSocket endpoint for real-time updates
 	h.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		conn, err := upgrader.Upgrade(w, r, nil)
@@ -511,3 +969,114 @@ func (h *Handler) routes() {
 		}
 	})
 }
+
+// taskSource tells tests started from the web UI, which marks its requests
+// with an X-Task-Source header, from those started through the API
+func taskSource(r *http.Request) orchestrator.TaskSource {
+	if r.Header.Get("X-Task-Source") == string(orchestrator.SourceManual) {
+		return orchestrator.SourceManual
+	}
+	return orchestrator.SourceAPI
+}
+
+// decodeTestOptions reads optional speed test options from a request body.
+// It returns nil when the body is empty or sets no options.
+func decodeTestOptions(r *http.Request) (*orchestrator.SpeedTestOptions, error) {
+	if r.ContentLength == 0 {
+		return nil, nil
+	}
+	var opts orchestrator.SpeedTestOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts == (orchestrator.SpeedTestOptions{}) {
+		return nil, nil
+	}
+	return &opts, nil
+}
+
+// decodeDevice reads a device from a request body and validates its settings.
+// Masked secrets are taken from stored, the device being updated (nil when adding).
+func (h *Handler) decodeDevice(r *http.Request, stored *db.Device) (db.Device, error) {
+	var dev db.Device
+	if err := json.NewDecoder(r.Body).Decode(&dev); err != nil {
+		return dev, err
+	}
+	if stored != nil {
+		dev.ID = stored.ID
+		keepMaskedSecrets(&dev, *stored)
+	}
+	if err := orchestrator.ValidateTransport(dev.Transport); err != nil {
+		return dev, err
+	}
+	if err := orchestrator.ValidateCredential(dev.Credential); err != nil {
+		return dev, err
+	}
+	if dev.WorkerPortMin == 0 && dev.WorkerPortMax != 0 {
+		return dev, fmt.Errorf("worker_port_max requires worker_port_min")
+	}
+	if dev.WorkerPortMin != 0 {
+		if dev.WorkerPortMax == 0 {
+			dev.WorkerPortMax = dev.WorkerPortMin
+		}
+		ports := orchestrator.PortRange{Min: dev.WorkerPortMin, Max: dev.WorkerPortMax}
+		if err := ports.Validate(); err != nil {
+			return dev, err
+		}
+	}
+	if dev.Arch != "" {
+		if err := orchestrator.ValidateArch(dev.Arch); err != nil {
+			return dev, err
+		}
+	}
+	if err := orchestrator.ValidateInstall(dev); err != nil {
+		return dev, err
+	}
+	if err := orchestrator.ValidateJump(dev, h.db.GetDevice); err != nil {
+		return dev, err
+	}
+	return dev, nil
+}
+
+// evictOnWorkerChange drops the pooled connection when the device's arch or
+// install_dir was changed, since the connection remembers the worker it verified.
+// A connected agent is dropped when the device no longer uses one.
+func (h *Handler) evictOnWorkerChange(stored *db.Device, dev db.Device) {
+	if stored != nil && (stored.Arch != dev.Arch || stored.InstallDir != dev.InstallDir) {
+		h.orch.Pool.Evict(dev.ID)
+	}
+	if stored != nil && stored.Transport == db.TransportAgent && dev.Transport != db.TransportAgent {
+		h.orch.Agents.Disconnect(dev.ID)
+	}
+}
+
+// secretMask stands in for stored secrets in API responses. Sending it back
+// in an update keeps the stored value.
+const secretMask = "********"
+
+// maskDevice hides the device's secrets
+func maskDevice(dev db.Device) db.Device {
+	for _, secret := range []*string{&dev.Credential.PrivateKey, &dev.Credential.Passphrase, &dev.Credential.Password} {
+		if *secret != "" {
+			*secret = secretMask
+		}
+	}
+	return dev
+}
+
+// keepMaskedSecrets replaces masked secrets in an update with the stored ones
+func keepMaskedSecrets(dev *db.Device, stored db.Device) {
+	pairs := [][2]*string{
+		{&dev.Credential.PrivateKey, &stored.Credential.PrivateKey},
+		{&dev.Credential.Passphrase, &stored.Credential.Passphrase},
+		{&dev.Credential.Password, &stored.Credential.Password},
+	}
+	for _, p := range pairs {
+		if *p[0] == secretMask {
+			*p[0] = *p[1]
+		}
+	}
+}
@@ -2,11 +2,16 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
 
 	"github.com/user/homelab-speedtest/internal/config"
 	"github.com/user/homelab-speedtest/internal/db"
@@ -49,3 +54,427 @@ func TestGetLatestResultsAPI(t *testing.T) {
 		t.Error("Expected at least one result")
 	}
 }
+
+func TestGetResultSamplesAPI(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "api-test-*")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	database, _ := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	defer func() { _ = database.Close() }()
+
+	orch := orchestrator.NewOrchestrator("./worker", 8090)
+	handler := NewHandler(database, orch, orchestrator.NewScheduler(database, orch), notify.NewManager(database))
+
+	id, _ := database.SaveResult(db.Result{SourceID: 1, TargetID: 2, Type: "speed", BandwidthMbps: 940})
+	_ = database.SaveSamples(id, []db.Sample{{StartSeconds: 0, EndSeconds: 1, BytesSent: 117_500_000, BandwidthMbps: 940}})
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/results/%d/samples", id), nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	var samples []db.Sample
+	if err := json.NewDecoder(rr.Body).Decode(&samples); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(samples) != 1 || samples[0].BandwidthMbps != 940 {
+		t.Errorf("Expected one 940 Mbps sample, got %+v", samples)
+	}
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/results/%d/samples", id+1), nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown result, got %d", rr.Code)
+	}
+}
+
+func TestTraceAPIValidation(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "api-test-*")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	database, _ := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	defer func() { _ = database.Close() }()
+
+	orch := orchestrator.NewOrchestrator("./worker", 8090)
+	handler := NewHandler(database, orch, orchestrator.NewScheduler(database, orch), notify.NewManager(database))
+
+	_ = database.AddDevice(db.Device{Name: "S", Hostname: "s", SSHUser: "u", SSHPort: 22})
+
+	cases := []struct {
+		body string
+		want int
+	}{
+		{`{"source_id": 1, "target_id": 1}`, http.StatusBadRequest},
+		{`{"source_id": 1, "target_id": 2, "protocol": "icmp"}`, http.StatusBadRequest},
+		{`{"source_id": 1, "target_id": 2, "max_hops": 100}`, http.StatusBadRequest},
+		{`{"source_id": 1, "target_id": 2}`, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("POST", "/test/trace", strings.NewReader(c.body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.want {
+			t.Errorf("%s: expected status %d, got %d", c.body, c.want, rr.Code)
+		}
+	}
+}
+
+func TestDeviceWorkerPortRange(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "api-test-*")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	database, _ := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	defer func() { _ = database.Close() }()
+
+	orch := orchestrator.NewOrchestrator("./worker", 8090)
+	handler := NewHandler(database, orch, orchestrator.NewScheduler(database, orch), notify.NewManager(database))
+
+	cases := []struct {
+		body string
+		want int
+	}{
+		{`{"name": "A", "hostname": "a", "ssh_user": "u", "ssh_port": 22, "worker_port_max": 9000}`, http.StatusBadRequest},
+		{`{"name": "A", "hostname": "a", "ssh_user": "u", "ssh_port": 22, "worker_port_min": 9010, "worker_port_max": 9000}`, http.StatusBadRequest},
+		{`{"name": "A", "hostname": "a", "ssh_user": "u", "ssh_port": 22, "worker_port_min": 9000, "arch": "../../etc"}`, http.StatusBadRequest},
+		{`{"name": "A", "hostname": "a", "ssh_user": "u", "ssh_port": 22, "worker_port_min": 9000, "install_dir": "relative"}`, http.StatusBadRequest},
+		{`{"name": "A", "hostname": "a", "ssh_user": "u", "ssh_port": 22, "worker_port_min": 9000, "worker_cleanup": "sometimes"}`, http.StatusBadRequest},
+		{`{"name": "A", "hostname": "a", "ssh_user": "u", "ssh_port": 22, "worker_port_min": 9000, "transport": "telnet"}`, http.StatusBadRequest},
+		{`{"name": "A", "hostname": "a", "ssh_user": "u", "ssh_port": 22, "worker_port_min": 9000, "arch": "linux/armv7"}`, http.StatusCreated},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("POST", "/devices", strings.NewReader(c.body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.want {
+			t.Errorf("%s: expected status %d, got %d", c.body, c.want, rr.Code)
+		}
+	}
+
+	devices, _ := database.GetDevices()
+	if len(devices) != 1 || devices[0].WorkerPortMin != 9000 || devices[0].WorkerPortMax != 9000 || devices[0].Arch != "linux/armv7" {
+		t.Errorf("Expected one armv7 device with port range 9000-9000, got %+v", devices)
+	}
+}
+
+func TestDeviceHostKeyAPI(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "api-test-*")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	database, _ := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	defer func() { _ = database.Close() }()
+
+	orch := orchestrator.NewOrchestrator("./worker", 8090)
+	handler := NewHandler(database, orch, orchestrator.NewScheduler(database, orch), notify.NewManager(database))
+
+	_ = database.AddDevice(db.Device{Name: "S", Hostname: "s", SSHUser: "u", SSHPort: 22})
+	_ = database.SetHostKey(db.HostKey{DeviceID: 1, KeyType: "ssh-ed25519", PublicKey: "AAAA", Fingerprint: "SHA256:abc"})
+
+	req, _ := http.NewRequest("GET", "/devices/1/hostkey", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var key db.HostKey
+	if rr.Code != http.StatusOK || json.NewDecoder(rr.Body).Decode(&key) != nil || key.Fingerprint != "SHA256:abc" {
+		t.Fatalf("Expected the pinned key, got %d %+v", rr.Code, key)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/devices/1/hostkey", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/devices/1/hostkey", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 after reset, got %d", rr.Code)
+	}
+}
+
+func TestUninstallWorkerUnknownDevice(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "api-test-*")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	database, _ := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	defer func() { _ = database.Close() }()
+
+	orch := orchestrator.NewOrchestrator("./worker", 8090)
+	handler := NewHandler(database, orch, orchestrator.NewScheduler(database, orch), notify.NewManager(database))
+
+	req, _ := http.NewRequest("DELETE", "/devices/42/worker", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", rr.Code)
+	}
+}
+
+func TestDeviceJumpHost(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "api-test-*")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	database, _ := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	defer func() { _ = database.Close() }()
+
+	orch := orchestrator.NewOrchestrator("./worker", 8090)
+	handler := NewHandler(database, orch, orchestrator.NewScheduler(database, orch), notify.NewManager(database))
+
+	send := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	_ = database.AddDevice(db.Device{Name: "bastion", Hostname: "bastion", SSHUser: "u", SSHPort: 22})
+	if code := send("POST", "/devices", `{"name": "nas", "hostname": "nas", "ssh_user": "u", "ssh_port": 22, "jump_device_id": 7}`); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a missing jump device, got %d", code)
+	}
+	if code := send("POST", "/devices", `{"name": "nas", "hostname": "nas", "ssh_user": "u", "ssh_port": 22, "jump_device_id": 1}`); code != http.StatusCreated {
+		t.Errorf("Expected status 201, got %d", code)
+	}
+	// The bastion can't jump through the device behind it
+	if code := send("PUT", "/devices/1", `{"name": "bastion", "hostname": "bastion", "ssh_user": "u", "ssh_port": 22, "jump_device_id": 2}`); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a jump loop, got %d", code)
+	}
+	if code := send("DELETE", "/devices/1", ""); code != http.StatusConflict {
+		t.Errorf("Expected status 409 when deleting a jump device in use, got %d", code)
+	}
+}
+
+func TestDeviceCredentialMasking(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "api-test-*")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	database, _ := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	defer func() { _ = database.Close() }()
+	_ = database.SetMasterKey(make([]byte, db.MasterKeySize))
+
+	orch := orchestrator.NewOrchestrator("./worker", 8090)
+	handler := NewHandler(database, orch, orchestrator.NewScheduler(database, orch), notify.NewManager(database))
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send("POST", "/devices", `{"name": "A", "hostname": "a", "ssh_user": "u", "ssh_port": 22,
+		"credential": {"type": "password", "password": "hunter2"}}`); rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rr.Code, rr.Body)
+	}
+
+	rr := send("GET", "/devices", "")
+	if strings.Contains(rr.Body.String(), "hunter2") || !strings.Contains(rr.Body.String(), secretMask) {
+		t.Errorf("Expected the password to be masked, got %s", rr.Body)
+	}
+
+	// Sending the mask back keeps the stored password
+	if rr := send("PUT", "/devices/1", `{"name": "A2", "hostname": "a", "ssh_user": "u", "ssh_port": 22,
+		"credential": {"type": "password", "password": "********"}}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body)
+	}
+	dev, _ := database.GetDevice(1)
+	if dev == nil || dev.Name != "A2" || dev.Credential.Password != "hunter2" {
+		t.Errorf("Expected the stored password to survive the update, got %+v", dev)
+	}
+
+	if rr := send("POST", "/devices", `{"name": "B", "hostname": "b", "ssh_user": "u", "ssh_port": 22,
+		"credential": {"type": "key_file"}}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a key_file credential without a path, got %d", rr.Code)
+	}
+}
+
+func TestAgentEnrollment(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "api-test-*")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	database, _ := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	defer func() { _ = database.Close() }()
+
+	orch := orchestrator.NewOrchestrator("./worker", 8090)
+	handler := NewHandler(database, orch, orchestrator.NewScheduler(database, orch), notify.NewManager(database))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	_ = database.AddDevice(db.Device{Name: "appliance", Hostname: "appliance", SSHUser: "-", Transport: db.TransportAgent})
+	_ = database.AddDevice(db.Device{Name: "nas", Hostname: "nas", SSHUser: "root", SSHPort: 22})
+
+	issue := func(id int) string {
+		resp, err := http.Post(fmt.Sprintf("%s/devices/%d/agent-token", srv.URL, id), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201 issuing a token, got %d", resp.StatusCode)
+		}
+		var body struct{ Token string }
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return body.Token
+	}
+	if resp, _ := http.Post(srv.URL+"/devices/42/agent-token", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown device, got %d", resp.StatusCode)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/agent/ws"
+	dial := func(token string) (*websocket.Conn, int) {
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + token}})
+		if err != nil {
+			return nil, resp.StatusCode
+		}
+		return conn, resp.StatusCode
+	}
+	if _, code := dial("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a wrong token, got %d", code)
+	}
+	if _, code := dial(issue(2)); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a device not using the agent transport, got %d", code)
+	}
+
+	conn, code := dial(issue(1))
+	if conn == nil {
+		t.Fatalf("Expected the agent to connect, got status %d", code)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.WriteJSON(orchestrator.AgentMessage{Type: orchestrator.AgentHello, ProtocolVersion: orchestrator.ProtocolVersion})
+
+	online := func() bool {
+		resp, err := http.Get(srv.URL + "/devices")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		var devs []db.Device
+		_ = json.NewDecoder(resp.Body).Decode(&devs)
+		return len(devs) == 2 && devs[0].AgentOnline
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !online() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the agent to be reported online")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A new token disconnects the agent
+	issue(1)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("Expected the connection to be closed after issuing a new token")
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for orch.Agents.Online(1) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the agent to be offline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueueAPI(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "api-test-*")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	database, _ := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	defer func() { _ = database.Close() }()
+
+	orch := orchestrator.NewOrchestrator("./worker", 8090)
+	// Not started, so tasks stay queued
+	scheduler := orchestrator.NewScheduler(database, orch)
+	handler := NewHandler(database, orch, scheduler, notify.NewManager(database))
+	var events []orchestrator.QueueStatus
+	scheduler.OnQueueStatus = func(status orchestrator.QueueStatus) { events = append(events, status) }
+
+	scheduler.RunAllPings(orchestrator.SourceAPI)
+	scheduler.RunAllSpeeds(orchestrator.SourceManual, nil)
+	scheduler.RunAllBufferbloat(orchestrator.SourceAPI, nil)
+	ids := map[orchestrator.TaskType]string{}
+	for _, task := range scheduler.GetQueueStatus().Queued {
+		ids[task.Type] = task.ID
+	}
+	order := func() []orchestrator.TaskType {
+		var types []orchestrator.TaskType
+		for _, task := range scheduler.GetQueueStatus().Queued {
+			types = append(types, task.Type)
+		}
+		return types
+	}
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Bumping without a body moves the task to the front
+	if rr := do("POST", "/queue/"+ids[orchestrator.TaskBufferbloatAll]+"/priority", ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the bump to succeed, got %d: %s", rr.Code, rr.Body)
+	}
+	if got := fmt.Sprint(order()); got != "[bufferbloat_all ping_all speed_all]" {
+		t.Errorf("Unexpected order after bump: %s", got)
+	}
+	if rr := do("POST", "/queue/"+ids[orchestrator.TaskPingAll]+"/priority", `{"priority": 0}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the demotion to succeed, got %d: %s", rr.Code, rr.Body)
+	}
+	if got := fmt.Sprint(order()); got != "[bufferbloat_all speed_all ping_all]" {
+		t.Errorf("Unexpected order after demotion: %s", got)
+	}
+	if rr := do("POST", "/queue/"+ids[orchestrator.TaskPingAll]+"/priority", `{"priority": 7}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown priority, got %d", rr.Code)
+	}
+	if rr := do("POST", "/queue/nope/priority", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown task, got %d", rr.Code)
+	}
+
+	if rr := do("DELETE", "/queue/"+ids[orchestrator.TaskSpeedAll], ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 for a cancelled task, got %d", rr.Code)
+	}
+	if rr := do("DELETE", "/queue/"+ids[orchestrator.TaskSpeedAll], ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a task cancelled twice, got %d", rr.Code)
+	}
+	if got := fmt.Sprint(order()); got != "[bufferbloat_all ping_all]" {
+		t.Errorf("Unexpected order after cancel: %s", got)
+	}
+
+	var status orchestrator.QueueStatus
+	rr := do("POST", "/queue/pause", "")
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil || !status.Paused || status.Length != 2 {
+		t.Errorf("Expected a paused queue keeping its tasks, got %+v, %v", status, err)
+	}
+	rr = do("POST", "/queue/resume", "")
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil || status.Paused {
+		t.Errorf("Expected the queue resumed, got %+v, %v", status, err)
+	}
+
+	// Every change was broadcast
+	if len(events) != 8 || !events[len(events)-2].Paused || events[len(events)-1].Paused {
+		t.Errorf("Expected 8 queue events ending with pause and resume, got %+v", events)
+	}
+	// The history keeps the cancelled task
+	var page struct {
+		Tasks []db.Task `json:"tasks"`
+		Total int       `json:"total"`
+	}
+	rr = do("GET", "/tasks?status=cancelled", "")
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil || page.Total != 1 || len(page.Tasks) != 1 {
+		t.Fatalf("Expected one cancelled task, got %+v, %v", page, err)
+	}
+	if task := page.Tasks[0]; task.ID != ids[orchestrator.TaskSpeedAll] || task.Source != "manual" || task.FinishedAt == "" {
+		t.Errorf("Unexpected cancelled task: %+v", task)
+	}
+	rr = do("GET", "/tasks?limit=1&offset=1", "")
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil || page.Total != 3 || len(page.Tasks) != 1 {
+		t.Errorf("Expected a page of one of three tasks, got %+v, %v", page, err)
+	}
+	for _, query := range []string{"status=lost", "limit=0", "offset=-1"} {
+		if rr := do("GET", "/tasks?"+query, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", query, rr.Code)
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package db
 
 import (
+	"crypto/cipher"
+	"crypto/sha256"
 	"database/sql"
 	_ "embed"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"log"
 	"strings"
 
 	_ "modernc.org/sqlite"
@@ -14,8 +19,60 @@ import (
 //go:embed schema.sql
 var schema string
 
+// migrations are applied on every start; each one must be safe to fail when already applied
+var migrations = []string{
+	"ALTER TABLE results ADD COLUMN error TEXT",
+	"ALTER TABLE results ADD COLUMN direction TEXT",
+	"ALTER TABLE results ADD COLUMN reverse_bandwidth_mbps REAL",
+	"ALTER TABLE results ADD COLUMN streams INTEGER",
+	"ALTER TABLE results ADD COLUMN duration_seconds INTEGER",
+	"ALTER TABLE results ADD COLUMN buffer_size INTEGER",
+	"ALTER TABLE results ADD COLUMN omit_seconds INTEGER",
+	"ALTER TABLE schedules ADD COLUMN duration_seconds INTEGER",
+	"ALTER TABLE schedules ADD COLUMN buffer_size INTEGER",
+	"ALTER TABLE schedules ADD COLUMN omit_seconds INTEGER",
+	"ALTER TABLE results ADD COLUMN loaded_latency_ms REAL",
+	"ALTER TABLE results ADD COLUMN bufferbloat_ms REAL",
+	"ALTER TABLE results ADD COLUMN bufferbloat_grade TEXT",
+	"ALTER TABLE results ADD COLUMN tcp_retransmits INTEGER",
+	"ALTER TABLE results ADD COLUMN tcp_rtt_ms REAL",
+	"ALTER TABLE results ADD COLUMN tcp_rttvar_ms REAL",
+	"ALTER TABLE results ADD COLUMN tcp_cwnd INTEGER",
+	"ALTER TABLE results ADD COLUMN sender_bandwidth_mbps REAL",
+	"ALTER TABLE results ADD COLUMN receiver_bandwidth_mbps REAL",
+	"ALTER TABLE results ADD COLUMN reverse_sender_bandwidth_mbps REAL",
+	"ALTER TABLE results ADD COLUMN protocol TEXT",
+	"ALTER TABLE results ADD COLUMN hop_count INTEGER",
+	"ALTER TABLE results ADD COLUMN path_mtu INTEGER",
+	"ALTER TABLE devices ADD COLUMN worker_port_min INTEGER",
+	"ALTER TABLE devices ADD COLUMN worker_port_max INTEGER",
+	"ALTER TABLE devices ADD COLUMN auth_type TEXT",
+	"ALTER TABLE devices ADD COLUMN key_path TEXT",
+	"ALTER TABLE devices ADD COLUMN private_key TEXT",
+	"ALTER TABLE devices ADD COLUMN passphrase TEXT",
+	"ALTER TABLE devices ADD COLUMN agent_socket TEXT",
+	"ALTER TABLE devices ADD COLUMN password TEXT",
+	"ALTER TABLE devices ADD COLUMN worker_version TEXT",
+	"ALTER TABLE devices ADD COLUMN worker_sha256 TEXT",
+	"ALTER TABLE devices ADD COLUMN worker_deployed_at TIMESTAMP",
+	"ALTER TABLE devices ADD COLUMN arch TEXT",
+	"ALTER TABLE devices ADD COLUMN install_dir TEXT",
+	"ALTER TABLE devices ADD COLUMN worker_cleanup TEXT",
+	"ALTER TABLE devices ADD COLUMN worker_path TEXT",
+	"ALTER TABLE devices ADD COLUMN jump_device_id INTEGER",
+	"ALTER TABLE devices ADD COLUMN jump_host TEXT",
+	"ALTER TABLE devices ADD COLUMN transport TEXT",
+	"ALTER TABLE devices ADD COLUMN agent_token_hash TEXT",
+	"ALTER TABLE devices ADD COLUMN agent_last_seen TIMESTAMP",
+	"ALTER TABLE results ADD COLUMN error_class TEXT",
+	"ALTER TABLE pair_settings ADD COLUMN timeout_seconds INTEGER",
+}
+
 type DB struct {
 	*sql.DB
+
+	// secrets encrypts device credentials; nil until SetMasterKey
+	secrets cipher.AEAD
 }
 
 func New(cfg config.DatabaseConfig) (*DB, error) {
@@ -34,10 +91,12 @@ func New(cfg config.DatabaseConfig) (*DB, error) {
 		return nil, fmt.Errorf("failed to apply schema: %w", err)
 	}
 
-	// Simple migration: check if error column exists, if not add it
+	// Simple migrations: add columns introduced after the initial schema
 	// (This is a quick fix for existing DBs)
-	// We ignore the error because if it exists, it's fine.
-	_, _ = db.Exec("ALTER TABLE results ADD COLUMN error TEXT")
+	// We ignore the error because if the column exists, it's fine.
+	for _, m := range migrations {
+		_, _ = db.Exec(m)
+	}
 
 	return &DB{DB: db}, nil
 }
@@ -49,10 +108,123 @@ type Device struct {
 	IP       string `json:"ip"` // Added IP
 	SSHUser  string `json:"ssh_user"`
 	SSHPort  int    `json:"ssh_port"`
+
+	// Transport is how the worker is run: over SSH (default), locally on the
+	// server host, or by an agent on the device that dials in
+	Transport string `json:"transport,omitempty"`
+
+	// Ports the worker server may listen on; unset uses the global WORKER_PORT_RANGE
+	WorkerPortMin int `json:"worker_port_min,omitempty"`
+	WorkerPortMax int `json:"worker_port_max,omitempty"`
+
+	Credential Credential `json:"credential"`
+
+	// SSH goes through another device or a comma-separated [user@]host[:port]
+	// list of jump hosts; test traffic still flows directly
+	JumpDeviceID int    `json:"jump_device_id,omitempty"`
+	JumpHost     string `json:"jump_host,omitempty"`
+
+	// Arch selects the worker build, e.g. linux/arm64; detected with uname when empty
+	Arch string `json:"arch,omitempty"`
+
+	// InstallDir is where the worker is installed; empty picks /tmp or an exec-capable fallback
+	InstallDir    string `json:"install_dir,omitempty"`
+	WorkerCleanup string `json:"worker_cleanup,omitempty"` // one of the Cleanup* policies
+
+	// Worker build last verified on the device; maintained by the orchestrator
+	WorkerPath       string `json:"worker_path,omitempty"`
+	WorkerVersion    string `json:"worker_version,omitempty"`
+	WorkerSHA256     string `json:"worker_sha256,omitempty"`
+	WorkerDeployedAt string `json:"worker_deployed_at,omitempty"`
+
+	// Agent state: the last heartbeat, and whether the agent is connected
+	// right now (filled in by the API, not stored)
+	AgentLastSeen string `json:"agent_last_seen,omitempty"`
+	AgentOnline   bool   `json:"agent_online,omitempty"`
+}
+
+// Transports of a Device
+const (
+	TransportSSH   = "ssh"
+	TransportLocal = "local" // the server host itself; SSH settings are ignored
+	TransportAgent = "agent" // a worker in agent mode connected to the server
+)
+
+// When the worker binary is removed from a device
+const (
+	CleanupKeep     = "keep"      // never (the default)
+	CleanupAfterRun = "after_run" // after every test that used it
+	CleanupOnDelete = "on_delete" // when the device is deleted
+)
+
+// WorkerInfo identifies the worker build installed on a device
+type WorkerInfo struct {
+	Arch    string `json:"arch"`
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	SHA256  string `json:"sha256"`
+}
+
+// SSH authentication types of a Credential
+const (
+	AuthDefault    = ""            // the server's own key, /root/.ssh/id_rsa
+	AuthKeyFile    = "key_file"    // a private key file on the server
+	AuthPrivateKey = "private_key" // a private key stored in the database
+	AuthAgent      = "agent"       // keys held by an ssh-agent
+	AuthPassword   = "password"
+)
+
+// Credential is how the server authenticates to a device over SSH.
+// PrivateKey, Passphrase and Password are encrypted at rest.
+type Credential struct {
+	Type        string `json:"type"`
+	KeyPath     string `json:"key_path,omitempty"`
+	PrivateKey  string `json:"private_key,omitempty"`
+	Passphrase  string `json:"passphrase,omitempty"`   // for KeyPath or PrivateKey
+	AgentSocket string `json:"agent_socket,omitempty"` // default $SSH_AUTH_SOCK
+	Password    string `json:"password,omitempty"`
+}
+
+// HasSecrets reports whether the credential carries anything to encrypt
+func (c Credential) HasSecrets() bool {
+	return c.PrivateKey != "" || c.Passphrase != "" || c.Password != ""
+}
+
+// deviceColumns are the devices columns scanDevice reads, in order
+const deviceColumns = `id, name, hostname, IFNULL(ip, ''), ssh_user, ssh_port, IFNULL(transport, ''),
+	IFNULL(worker_port_min, 0), IFNULL(worker_port_max, 0), IFNULL(arch, ''),
+	IFNULL(install_dir, ''), IFNULL(worker_cleanup, ''), IFNULL(jump_device_id, 0), IFNULL(jump_host, ''),
+	IFNULL(auth_type, ''), IFNULL(key_path, ''), IFNULL(agent_socket, ''),
+	IFNULL(private_key, ''), IFNULL(passphrase, ''), IFNULL(password, ''),
+	IFNULL(worker_path, ''), IFNULL(worker_version, ''), IFNULL(worker_sha256, ''), IFNULL(worker_deployed_at, ''),
+	IFNULL(agent_last_seen, '')`
+
+// scanDevice reads a row selected with deviceColumns and decrypts its secrets.
+// A secret that can't be decrypted is dropped, so the device fails to
+// authenticate rather than hiding every device.
+func (d *DB) scanDevice(row interface{ Scan(...any) error }) (Device, error) {
+	var dev Device
+	c := &dev.Credential
+	if err := row.Scan(&dev.ID, &dev.Name, &dev.Hostname, &dev.IP, &dev.SSHUser, &dev.SSHPort, &dev.Transport,
+		&dev.WorkerPortMin, &dev.WorkerPortMax, &dev.Arch, &dev.InstallDir, &dev.WorkerCleanup,
+		&dev.JumpDeviceID, &dev.JumpHost,
+		&c.Type, &c.KeyPath, &c.AgentSocket, &c.PrivateKey, &c.Passphrase, &c.Password,
+		&dev.WorkerPath, &dev.WorkerVersion, &dev.WorkerSHA256, &dev.WorkerDeployedAt,
+		&dev.AgentLastSeen); err != nil {
+		return dev, err
+	}
+	for _, secret := range []*string{&c.PrivateKey, &c.Passphrase, &c.Password} {
+		plain, err := d.open(*secret)
+		if err != nil {
+			log.Printf("Device %s: %v", dev.Name, err)
+		}
+		*secret = plain
+	}
+	return dev, nil
 }
 
 func (d *DB) GetDevices() ([]Device, error) {
-	rows, err := d.Query("SELECT id, name, hostname, IFNULL(ip, ''), ssh_user, ssh_port FROM devices")
+	rows, err := d.Query("SELECT " + deviceColumns + " FROM devices")
 	if err != nil {
 		return nil, err
 	}
@@ -60,8 +232,8 @@ func (d *DB) GetDevices() ([]Device, error) {
 
 	devices := []Device{}
 	for rows.Next() {
-		var dev Device
-		if err := rows.Scan(&dev.ID, &dev.Name, &dev.Hostname, &dev.IP, &dev.SSHUser, &dev.SSHPort); err != nil {
+		dev, err := d.scanDevice(rows)
+		if err != nil {
 			return nil, err
 		}
 		devices = append(devices, dev)
@@ -69,15 +241,59 @@ func (d *DB) GetDevices() ([]Device, error) {
 	return devices, nil
 }
 
+// GetDevice returns one device, or nil if it doesn't exist
+func (d *DB) GetDevice(id int) (*Device, error) {
+	dev, err := d.scanDevice(d.QueryRow("SELECT "+deviceColumns+" FROM devices WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
+// credentialArgs returns the credential column values with secrets encrypted
+func (d *DB) credentialArgs(c Credential) ([]any, error) {
+	args := []any{c.Type, c.KeyPath, c.AgentSocket}
+	for _, secret := range []string{c.PrivateKey, c.Passphrase, c.Password} {
+		sealed, err := d.seal(secret)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, sealed)
+	}
+	return args, nil
+}
+
 func (d *DB) AddDevice(dev Device) error {
-	_, err := d.Exec("INSERT INTO devices (name, hostname, ip, ssh_user, ssh_port) VALUES (?, ?, ?, ?, ?)",
-		dev.Name, dev.Hostname, dev.IP, dev.SSHUser, dev.SSHPort)
+	cred, err := d.credentialArgs(dev.Credential)
+	if err != nil {
+		return err
+	}
+	args := append([]any{dev.Name, dev.Hostname, dev.IP, dev.SSHUser, dev.SSHPort, dev.Transport,
+		nullIfZero(dev.WorkerPortMin), nullIfZero(dev.WorkerPortMax), dev.Arch, dev.InstallDir, dev.WorkerCleanup,
+		nullIfZero(dev.JumpDeviceID), dev.JumpHost}, cred...)
+	_, err = d.Exec(`INSERT INTO devices (name, hostname, ip, ssh_user, ssh_port, transport,
+		worker_port_min, worker_port_max, arch, install_dir, worker_cleanup, jump_device_id, jump_host,
+		auth_type, key_path, agent_socket, private_key, passphrase, password)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, args...)
 	return err
 }
 
 func (d *DB) UpdateDevice(dev Device) error {
-	res, err := d.Exec("UPDATE devices SET name = ?, hostname = ?, ip = ?, ssh_user = ?, ssh_port = ? WHERE id = ?",
-		dev.Name, dev.Hostname, dev.IP, dev.SSHUser, dev.SSHPort, dev.ID)
+	cred, err := d.credentialArgs(dev.Credential)
+	if err != nil {
+		return err
+	}
+	args := append([]any{dev.Name, dev.Hostname, dev.IP, dev.SSHUser, dev.SSHPort, dev.Transport,
+		nullIfZero(dev.WorkerPortMin), nullIfZero(dev.WorkerPortMax), dev.Arch, dev.InstallDir, dev.WorkerCleanup,
+		nullIfZero(dev.JumpDeviceID), dev.JumpHost}, cred...)
+	res, err := d.Exec(`UPDATE devices SET name = ?, hostname = ?, ip = ?, ssh_user = ?, ssh_port = ?, transport = ?,
+		worker_port_min = ?, worker_port_max = ?, arch = ?, install_dir = ?, worker_cleanup = ?,
+		jump_device_id = ?, jump_host = ?,
+		auth_type = ?, key_path = ?, agent_socket = ?, private_key = ?, passphrase = ?, password = ?
+		WHERE id = ?`, append(args, dev.ID)...)
 	if err != nil {
 		return err
 	}
@@ -91,28 +307,269 @@ func (d *DB) UpdateDevice(dev Device) error {
 	return nil
 }
 
-func (d *DB) DeleteDevice(id int) error {
-	_, err := d.Exec("DELETE FROM devices WHERE id = ?", id)
+// SetWorkerInfo records the arch and worker build found on a device. The
+// deploy time only moves when the checksum changes.
+func (d *DB) SetWorkerInfo(deviceID int, info WorkerInfo) error {
+	_, err := d.Exec(`UPDATE devices SET arch = ?, worker_path = ?, worker_version = ?,
+		worker_deployed_at = CASE WHEN IFNULL(worker_sha256, '') = ? THEN IFNULL(worker_deployed_at, CURRENT_TIMESTAMP)
+			ELSE CURRENT_TIMESTAMP END,
+		worker_sha256 = ? WHERE id = ?`, info.Arch, info.Path, info.Version, info.SHA256, info.SHA256, deviceID)
+	return err
+}
+
+// ClearWorkerInfo forgets the worker build of a device after it was removed
+func (d *DB) ClearWorkerInfo(deviceID int) error {
+	_, err := d.Exec(`UPDATE devices SET worker_path = NULL, worker_version = NULL, worker_sha256 = NULL,
+		worker_deployed_at = NULL WHERE id = ?`, deviceID)
+	return err
+}
+
+// SetAgentToken replaces the enrollment token of a device's agent. Only its
+// SHA-256 is stored.
+func (d *DB) SetAgentToken(deviceID int, token string) error {
+	res, err := d.Exec("UPDATE devices SET agent_token_hash = ? WHERE id = ?", hashToken(token), deviceID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("device with id %d not found", deviceID)
+	}
+	return nil
+}
+
+// GetDeviceByAgentToken returns the device an agent token was issued for, or nil
+func (d *DB) GetDeviceByAgentToken(token string) (*Device, error) {
+	if token == "" {
+		return nil, nil
+	}
+	dev, err := d.scanDevice(d.QueryRow("SELECT "+deviceColumns+" FROM devices WHERE agent_token_hash = ?", hashToken(token)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
+// SetAgentSeen records a heartbeat from a device's agent
+func (d *DB) SetAgentSeen(deviceID int) error {
+	_, err := d.Exec("UPDATE devices SET agent_last_seen = CURRENT_TIMESTAMP WHERE id = ?", deviceID)
 	return err
 }
 
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *DB) DeleteDevice(id int) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Foreign keys aren't enforced, so drop the pinned key and pair settings
+	// explicitly; a device reusing the ID mustn't inherit them
+	for _, query := range []string{
+		"DELETE FROM devices WHERE id = ?",
+		"DELETE FROM host_keys WHERE device_id = ?",
+		"DELETE FROM pair_settings WHERE source_device_id = ?1 OR target_device_id = ?1",
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (d *DB) AddResult(sourceID, targetID int, type_ string, latency, jitter, loss, bandwidth float64, errorMsg string) error {
-	_, err := d.Exec(`INSERT INTO results 
-		(source_device_id, target_device_id, type, latency_ms, jitter_ms, packet_loss, bandwidth_mbps, error) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		sourceID, targetID, type_, latency, jitter, loss, bandwidth, errorMsg)
+	_, err := d.SaveResult(Result{
+		SourceID:      sourceID,
+		TargetID:      targetID,
+		Type:          type_,
+		LatencyMs:     latency,
+		JitterMs:      jitter,
+		PacketLoss:    loss,
+		BandwidthMbps: bandwidth,
+		Error:         errorMsg,
+	})
 	return err
 }
 
+// SaveResult stores a result including the fields AddResult doesn't cover and returns its ID
+func (d *DB) SaveResult(res Result) (int64, error) {
+	// TCP statistics are NULL when the worker couldn't collect them
+	var tcp struct{ retransmits, rtt, rttVar, cwnd any }
+	if res.TCP != nil {
+		tcp.retransmits, tcp.rtt, tcp.rttVar, tcp.cwnd = res.TCP.Retransmits, res.TCP.RttMs, res.TCP.RttVarMs, res.TCP.Cwnd
+	}
+	r, err := d.Exec(`INSERT INTO results 
+		(source_device_id, target_device_id, type, latency_ms, jitter_ms, packet_loss, bandwidth_mbps,
+		 direction, reverse_bandwidth_mbps, streams, duration_seconds, buffer_size, omit_seconds,
+		 loaded_latency_ms, bufferbloat_ms, bufferbloat_grade,
+		 tcp_retransmits, tcp_rtt_ms, tcp_rttvar_ms, tcp_cwnd,
+		 sender_bandwidth_mbps, receiver_bandwidth_mbps, reverse_sender_bandwidth_mbps,
+		 protocol, hop_count, path_mtu, error, error_class) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		res.SourceID, res.TargetID, res.Type, res.LatencyMs, res.JitterMs, res.PacketLoss, res.BandwidthMbps,
+		res.Direction, res.ReverseBandwidthMbps, nullIfZero(res.Streams),
+		nullIfZero(res.DurationSeconds), nullIfZero(res.BufferSize), nullIfZero(res.OmitSeconds),
+		res.LoadedLatencyMs, res.BufferbloatMs, res.BufferbloatGrade,
+		tcp.retransmits, tcp.rtt, tcp.rttVar, tcp.cwnd,
+		res.SenderBandwidthMbps, res.ReceiverBandwidthMbps, res.ReverseSenderBandwidthMbps,
+		res.Protocol, nullIfZero(res.HopCount), nullIfZero(res.PathMTU), res.Error, errorClass(res))
+	if err != nil {
+		return 0, err
+	}
+	return r.LastInsertId()
+}
+
+// Sample is one interval of a speed test's throughput time series
+type Sample struct {
+	StartSeconds         float64 `json:"start_seconds"` // offset from the start of the measured window
+	EndSeconds           float64 `json:"end_seconds"`
+	BytesSent            int64   `json:"bytes_sent"`
+	BytesReceived        int64   `json:"bytes_received"`
+	BandwidthMbps        float64 `json:"bandwidth_mbps"`
+	ReverseBandwidthMbps float64 `json:"reverse_bandwidth_mbps"`
+}
+
+// SaveSamples stores the throughput time series of a result
+func (d *DB) SaveSamples(resultID int64, samples []Sample) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.Prepare(`INSERT INTO result_samples
+		(result_id, seq, start_seconds, end_seconds, bytes_sent, bytes_received, bandwidth_mbps, reverse_bandwidth_mbps)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+
+	for i, sm := range samples {
+		if _, err := stmt.Exec(resultID, i, sm.StartSeconds, sm.EndSeconds, sm.BytesSent, sm.BytesReceived,
+			sm.BandwidthMbps, sm.ReverseBandwidthMbps); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetSamples returns the throughput time series of a result in order
+func (d *DB) GetSamples(resultID int64) ([]Sample, error) {
+	rows, err := d.Query(`SELECT start_seconds, end_seconds, bytes_sent, bytes_received, bandwidth_mbps, reverse_bandwidth_mbps
+		FROM result_samples WHERE result_id = ? ORDER BY seq`, resultID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	samples := []Sample{}
+	for rows.Next() {
+		var sm Sample
+		if err := rows.Scan(&sm.StartSeconds, &sm.EndSeconds, &sm.BytesSent, &sm.BytesReceived,
+			&sm.BandwidthMbps, &sm.ReverseBandwidthMbps); err != nil {
+			return nil, err
+		}
+		samples = append(samples, sm)
+	}
+	return samples, rows.Err()
+}
+
+// TraceHop is one TTL step of a traceroute result. Address is empty when no probe was answered.
+type TraceHop struct {
+	TTL      int     `json:"ttl"`
+	Address  string  `json:"address"`
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	RttMinMs float64 `json:"rtt_min_ms"`
+	RttAvgMs float64 `json:"rtt_avg_ms"`
+	RttMaxMs float64 `json:"rtt_max_ms"`
+}
+
+// SaveTraceHops stores the hops of a traceroute result
+func (d *DB) SaveTraceHops(resultID int64, hops []TraceHop) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.Prepare(`INSERT INTO trace_hops
+		(result_id, ttl, address, sent, received, rtt_min_ms, rtt_avg_ms, rtt_max_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+
+	for _, h := range hops {
+		if _, err := stmt.Exec(resultID, h.TTL, h.Address, h.Sent, h.Received,
+			h.RttMinMs, h.RttAvgMs, h.RttMaxMs); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetTraceHops returns the hops of a traceroute result in TTL order
+func (d *DB) GetTraceHops(resultID int64) ([]TraceHop, error) {
+	rows, err := d.Query(`SELECT ttl, address, sent, received, rtt_min_ms, rtt_avg_ms, rtt_max_ms
+		FROM trace_hops WHERE result_id = ? ORDER BY ttl`, resultID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	hops := []TraceHop{}
+	for rows.Next() {
+		var h TraceHop
+		if err := rows.Scan(&h.TTL, &h.Address, &h.Sent, &h.Received,
+			&h.RttMinMs, &h.RttAvgMs, &h.RttMaxMs); err != nil {
+			return nil, err
+		}
+		hops = append(hops, h)
+	}
+	return hops, rows.Err()
+}
+
+// ResultExists reports whether a result with the given ID is stored
+func (d *DB) ResultExists(id int64) (bool, error) {
+	var n int
+	if err := d.QueryRow("SELECT COUNT(*) FROM results WHERE id = ?", id).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// TestOptions are the tunable worker settings of a speed test; 0 means "use the default"
+type TestOptions struct {
+	DurationSeconds int `json:"duration_seconds"`
+	BufferSize      int `json:"buffer_size"`
+	OmitSeconds     int `json:"omit_seconds"`
+}
+
 type Schedule struct {
 	ID      int    `json:"id"`
-	Type    string `json:"type"` // 'ping' or 'speed'
+	Type    string `json:"type"` // 'ping', 'speed' or 'bufferbloat'
 	Cron    string `json:"cron"`
 	Enabled bool   `json:"enabled"`
+	TestOptions
 }
 
 func (d *DB) GetSchedules() ([]Schedule, error) {
-	rows, err := d.Query("SELECT id, type, cron, enabled FROM schedules")
+	rows, err := d.Query(`SELECT id, type, cron, enabled,
+		IFNULL(duration_seconds, 0), IFNULL(buffer_size, 0), IFNULL(omit_seconds, 0) FROM schedules`)
 	if err != nil {
 		return nil, err
 	}
@@ -121,7 +578,7 @@ func (d *DB) GetSchedules() ([]Schedule, error) {
 	schedules := []Schedule{}
 	for rows.Next() {
 		var s Schedule
-		if err := rows.Scan(&s.ID, &s.Type, &s.Cron, &s.Enabled); err != nil {
+		if err := rows.Scan(&s.ID, &s.Type, &s.Cron, &s.Enabled, &s.DurationSeconds, &s.BufferSize, &s.OmitSeconds); err != nil {
 			return nil, err
 		}
 		schedules = append(schedules, s)
@@ -150,19 +607,36 @@ func (d *DB) UpdateSchedule(type_ string, cron string, enabled bool) error {
 	return err
 }
 
+// UpdateScheduleOptions sets the speed test options used by a schedule type
+func (d *DB) UpdateScheduleOptions(type_ string, opts TestOptions) error {
+	res, err := d.Exec("UPDATE schedules SET duration_seconds = ?, buffer_size = ?, omit_seconds = ? WHERE type = ?",
+		nullIfZero(opts.DurationSeconds), nullIfZero(opts.BufferSize), nullIfZero(opts.OmitSeconds), type_)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("schedule %q not found", type_)
+	}
+	return nil
+}
+
+// nullIfZero stores unset options as NULL so they keep following the defaults
+func nullIfZero(v int) any {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
 func (d *DB) GetHistory(limit int, typeFilter string) ([]Result, error) {
-	query := `
-		SELECT 
-			source_device_id, 
-			target_device_id, 
-			type, 
-			IFNULL(latency_ms, 0), 
-			IFNULL(bandwidth_mbps, 0), 
-			timestamp,
-			IFNULL(error, '')
-		FROM results 
-		WHERE (? = '' OR type = ?)
-		ORDER BY timestamp DESC 
+	query := `SELECT ` + resultColumns + `
+		FROM results r
+		WHERE (? = '' OR r.type = ?)
+		ORDER BY r.timestamp DESC 
 		LIMIT ?
 	`
 	rows, err := d.Query(query, typeFilter, typeFilter, limit)
@@ -173,26 +647,235 @@ func (d *DB) GetHistory(limit int, typeFilter string) ([]Result, error) {
 
 	results := []Result{}
 	for rows.Next() {
-		var res Result
-		if err := rows.Scan(&res.SourceID, &res.TargetID, &res.Type, &res.LatencyMs, &res.BandwidthMbps, &res.Timestamp, &res.Error); err != nil {
+		res, err := scanResult(rows)
+		if err != nil {
 			return nil, err
 		}
-		res.Error = strings.TrimSpace(res.Error)
 		results = append(results, res)
 	}
 	return results, nil
 }
 
+// resultColumns is the select list read by scanResult; the results table must be aliased as r
+const resultColumns = `
+			r.id,
+			r.source_device_id, 
+			r.target_device_id, 
+			r.type, 
+			IFNULL(r.latency_ms, 0), 
+			IFNULL(r.jitter_ms, 0), 
+			IFNULL(r.packet_loss, 0), 
+			IFNULL(r.bandwidth_mbps, 0), 
+			IFNULL(r.direction, ''), 
+			IFNULL(r.reverse_bandwidth_mbps, 0), 
+			IFNULL(r.streams, 0), 
+			IFNULL(r.duration_seconds, 0), 
+			IFNULL(r.buffer_size, 0), 
+			IFNULL(r.omit_seconds, 0), 
+			IFNULL(r.loaded_latency_ms, 0), 
+			IFNULL(r.bufferbloat_ms, 0), 
+			IFNULL(r.bufferbloat_grade, ''), 
+			r.tcp_retransmits, 
+			r.tcp_rtt_ms, 
+			r.tcp_rttvar_ms, 
+			r.tcp_cwnd, 
+			IFNULL(r.sender_bandwidth_mbps, 0), 
+			IFNULL(r.receiver_bandwidth_mbps, 0), 
+			IFNULL(r.reverse_sender_bandwidth_mbps, 0), 
+			IFNULL(r.protocol, ''), 
+			IFNULL(r.hop_count, 0), 
+			IFNULL(r.path_mtu, 0), 
+			r.timestamp,
+			IFNULL(r.error, ''),
+			IFNULL(r.error_class, '')`
+
+func scanResult(rows *sql.Rows) (Result, error) {
+	var res Result
+	var retransmits, cwnd sql.NullInt64
+	var rtt, rttVar sql.NullFloat64
+	err := rows.Scan(&res.ID, &res.SourceID, &res.TargetID, &res.Type, &res.LatencyMs, &res.JitterMs, &res.PacketLoss,
+		&res.BandwidthMbps, &res.Direction, &res.ReverseBandwidthMbps, &res.Streams,
+		&res.DurationSeconds, &res.BufferSize, &res.OmitSeconds,
+		&res.LoadedLatencyMs, &res.BufferbloatMs, &res.BufferbloatGrade,
+		&retransmits, &rtt, &rttVar, &cwnd,
+		&res.SenderBandwidthMbps, &res.ReceiverBandwidthMbps, &res.ReverseSenderBandwidthMbps,
+		&res.Protocol, &res.HopCount, &res.PathMTU, &res.Timestamp, &res.Error, &res.ErrorClass)
+	if retransmits.Valid {
+		res.TCP = &TCPStats{
+			Retransmits: int(retransmits.Int64),
+			RttMs:       rtt.Float64,
+			RttVarMs:    rttVar.Float64,
+			Cwnd:        int(cwnd.Int64),
+		}
+	}
+	// If error is present, we might want to trim it or just pass it through
+	res.Error = strings.TrimSpace(res.Error)
+	return res, err
+}
+
 type Result struct {
+	ID            int64   `json:"id"`
 	SourceID      int     `json:"source_id"`
 	TargetID      int     `json:"target_id"`
-	Type          string  `json:"type"`
+	Type          string  `json:"type"` // 'ping', 'speed', 'bufferbloat', 'trace' or 'pmtu'
 	LatencyMs     float64 `json:"latency_ms"`
 	JitterMs      float64 `json:"jitter_ms"`
 	PacketLoss    float64 `json:"packet_loss"`
 	BandwidthMbps float64 `json:"bandwidth_mbps"`
 	Timestamp     string  `json:"timestamp"`
 	Error         string  `json:"error"`
+	ErrorClass    string  `json:"error_class,omitempty"` // one of the ErrorClass* values when Error is set
+
+	// Speed test direction and the target -> source throughput (reverse/bidir)
+	Direction            string  `json:"direction,omitempty"`
+	ReverseBandwidthMbps float64 `json:"reverse_bandwidth_mbps"`
+	Streams              int     `json:"streams,omitempty"` // Parallel TCP streams used
+	TestOptions
+
+	// Latency under load (type "bufferbloat"); LatencyMs holds the idle latency
+	LoadedLatencyMs  float64 `json:"loaded_latency_ms,omitempty"`
+	BufferbloatMs    float64 `json:"bufferbloat_ms,omitempty"`
+	BufferbloatGrade string  `json:"bufferbloat_grade,omitempty"`
+
+	// Kernel TCP statistics from the client side, nil if unavailable
+	TCP *TCPStats `json:"tcp,omitempty"`
+
+	// Sender- and receiver-measured throughput. BandwidthMbps is the receiver's figure
+	// when available; ReverseBandwidthMbps is always receiver-measured.
+	SenderBandwidthMbps        float64 `json:"sender_bandwidth_mbps,omitempty"`
+	ReceiverBandwidthMbps      float64 `json:"receiver_bandwidth_mbps,omitempty"`
+	ReverseSenderBandwidthMbps float64 `json:"reverse_sender_bandwidth_mbps,omitempty"`
+
+	// Traceroute (type "trace", LatencyMs is the RTT to the target; hops are
+	// stored separately) and path MTU discovery (type "pmtu")
+	Protocol string `json:"protocol,omitempty"` // trace probe protocol, udp or tcp
+	HopCount int    `json:"hop_count,omitempty"`
+	PathMTU  int    `json:"path_mtu,omitempty"`
+}
+
+// Error classes of a failed Result
+const (
+	ErrorClassError     = "error"     // the test failed
+	ErrorClassTimeout   = "timeout"   // the test or its task ran out of time
+	ErrorClassCancelled = "cancelled" // the task was cancelled or the server shut down
+)
+
+// errorClass returns the stored class of a result; failures without one are plain errors
+func errorClass(res Result) any {
+	switch {
+	case res.Error == "":
+		return nil
+	case res.ErrorClass == "":
+		return ErrorClassError
+	}
+	return res.ErrorClass
+}
+
+// TCPStats are TCP_INFO figures collected by the worker during a TCP test
+type TCPStats struct {
+	Retransmits int     `json:"retransmits"`
+	RttMs       float64 `json:"rtt_ms"`    // smoothed RTT
+	RttVarMs    float64 `json:"rttvar_ms"` // RTT variance
+	Cwnd        int     `json:"cwnd"`      // final congestion window in segments
+}
+
+// Pair Settings
+
+// PairSetting holds per source/target preferences; nil fields fall back to global defaults
+type PairSetting struct {
+	SourceID        int  `json:"source_id"`
+	TargetID        int  `json:"target_id"`
+	ParallelStreams *int `json:"parallel_streams"`
+	TimeoutSeconds  *int `json:"timeout_seconds"` // per test, on top of its duration; NULL = TEST_TIMEOUT
+}
+
+func (d *DB) GetPairSettings() ([]PairSetting, error) {
+	rows, err := d.Query("SELECT source_device_id, target_device_id, parallel_streams, timeout_seconds FROM pair_settings")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	settings := []PairSetting{}
+	for rows.Next() {
+		var ps PairSetting
+		if err := rows.Scan(&ps.SourceID, &ps.TargetID, &ps.ParallelStreams, &ps.TimeoutSeconds); err != nil {
+			return nil, err
+		}
+		settings = append(settings, ps)
+	}
+	return settings, nil
+}
+
+func (d *DB) SetPairSetting(ps PairSetting) error {
+	_, err := d.Exec(`INSERT INTO pair_settings (source_device_id, target_device_id, parallel_streams, timeout_seconds)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(source_device_id, target_device_id) DO UPDATE SET parallel_streams = excluded.parallel_streams,
+			timeout_seconds = excluded.timeout_seconds`,
+		ps.SourceID, ps.TargetID, ps.ParallelStreams, ps.TimeoutSeconds)
+	return err
+}
+
+func (d *DB) DeletePairSetting(sourceID, targetID int) error {
+	_, err := d.Exec("DELETE FROM pair_settings WHERE source_device_id = ? AND target_device_id = ?", sourceID, targetID)
+	return err
+}
+
+// Host Keys
+
+// HostKey is the SSH host key pinned for a device on first contact
+type HostKey struct {
+	DeviceID    int    `json:"device_id"`
+	KeyType     string `json:"key_type"`
+	PublicKey   string `json:"public_key"`  // base64 wire format, as in known_hosts
+	Fingerprint string `json:"fingerprint"` // SHA256:...
+	FirstSeen   string `json:"first_seen"`
+}
+
+// GetHostKey returns the key pinned for a device, or nil if none is
+func (d *DB) GetHostKey(deviceID int) (*HostKey, error) {
+	var k HostKey
+	err := d.QueryRow("SELECT device_id, key_type, public_key, fingerprint, first_seen FROM host_keys WHERE device_id = ?",
+		deviceID).Scan(&k.DeviceID, &k.KeyType, &k.PublicKey, &k.Fingerprint, &k.FirstSeen)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// PinHostKey pins k unless the device already has a key. It returns the
+// pinned key, so concurrent first connections agree on one, and whether k
+// was newly pinned.
+func (d *DB) PinHostKey(k HostKey) (*HostKey, bool, error) {
+	res, err := d.Exec(`INSERT OR IGNORE INTO host_keys (device_id, key_type, public_key, fingerprint)
+		VALUES (?, ?, ?, ?)`, k.DeviceID, k.KeyType, k.PublicKey, k.Fingerprint)
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	pinned, err := d.GetHostKey(k.DeviceID)
+	return pinned, n > 0, err
+}
+
+// SetHostKey replaces the key pinned for a device
+func (d *DB) SetHostKey(k HostKey) error {
+	_, err := d.Exec(`INSERT INTO host_keys (device_id, key_type, public_key, fingerprint) VALUES (?, ?, ?, ?)
+		ON CONFLICT(device_id) DO UPDATE SET key_type = excluded.key_type, public_key = excluded.public_key,
+		fingerprint = excluded.fingerprint, first_seen = CURRENT_TIMESTAMP`,
+		k.DeviceID, k.KeyType, k.PublicKey, k.Fingerprint)
+	return err
+}
+
+// DeleteHostKey forgets the pinned key so the next connection pins a new one
+func (d *DB) DeleteHostKey(deviceID int) error {
+	_, err := d.Exec("DELETE FROM host_keys WHERE device_id = ?", deviceID)
+	return err
 }
 
 // Notification Settings
@@ -235,7 +918,7 @@ func (d *DB) GetAllNotificationSettings() (map[string]string, error) {
 type AlertRule struct {
 	ID              int      `json:"id"`
 	Name            string   `json:"name"`
-	EventType       string   `json:"event_type"` // 'speed_below', 'ping_above', 'packet_loss_above', 'test_error'
+	EventType       string   `json:"event_type"` // 'speed_below', 'ping_above', 'packet_loss_above', 'loaded_latency_above', 'test_error'
 	Threshold       *float64 `json:"threshold"`  // NULL for test_error
 	SourceDeviceID  *int     `json:"source_device_id"`
 	TargetDeviceID  *int     `json:"target_device_id"`
@@ -297,14 +980,7 @@ func (d *DB) DeleteAlertRule(id int) error {
 
 func (d *DB) GetLatestResults() ([]Result, error) {
 	query := `
-		SELECT 
-			r.source_device_id, 
-			r.target_device_id, 
-			r.type, 
-			IFNULL(r.latency_ms, 0), 
-			IFNULL(r.bandwidth_mbps, 0), 
-			r.timestamp,
-			IFNULL(r.error, '')
+		SELECT ` + resultColumns + `
 		FROM results r
 		INNER JOIN (
 			SELECT source_device_id, target_device_id, type, MAX(timestamp) as max_ts
@@ -323,13 +999,149 @@ func (d *DB) GetLatestResults() ([]Result, error) {
 
 	results := []Result{}
 	for rows.Next() {
-		var res Result
-		if err := rows.Scan(&res.SourceID, &res.TargetID, &res.Type, &res.LatencyMs, &res.BandwidthMbps, &res.Timestamp, &res.Error); err != nil {
+		res, err := scanResult(rows)
+		if err != nil {
 			return nil, err
 		}
-		// If error is present, we might want to trim it or just pass it through
-		res.Error = strings.TrimSpace(res.Error)
 		results = append(results, res)
 	}
 	return results, nil
 }
+
+// Tasks
+
+// Task statuses
+const (
+	TaskQueued    = "queued"
+	TaskRunning   = "running"
+	TaskDone      = "done"
+	TaskFailed    = "failed"
+	TaskCancelled = "cancelled"
+)
+
+// Task is a run of the test queue, queued or past
+type Task struct {
+	ID       string          `json:"id"`
+	Type     string          `json:"type"`
+	Priority int             `json:"priority"`
+	Source   string          `json:"source"` // schedule, manual or api
+	Status   string          `json:"status"`
+	Payload  json.RawMessage `json:"payload,omitempty"` // the task's options
+	Error    string          `json:"error,omitempty"`
+
+	CreatedAt       string  `json:"created_at"`
+	StartedAt       string  `json:"started_at,omitempty"`
+	FinishedAt      string  `json:"finished_at,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"` // from start to finish
+
+	// Outcomes of the device pairs tested; pairs not reached before the task
+	// ended count towards the total only
+	PairsTotal     int `json:"pairs_total"`
+	PairsSucceeded int `json:"pairs_succeeded"`
+	PairsFailed    int `json:"pairs_failed"`
+	PairsTimedOut  int `json:"pairs_timed_out"`
+	PairsCancelled int `json:"pairs_cancelled"`
+}
+
+// AddTask stores a newly queued task
+func (d *DB) AddTask(t Task) error {
+	var payload any
+	if len(t.Payload) > 0 {
+		payload = string(t.Payload)
+	}
+	_, err := d.Exec(`INSERT INTO tasks (id, type, priority, source, status, payload, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		t.ID, t.Type, t.Priority, t.Source, TaskQueued, payload, t.CreatedAt)
+	return err
+}
+
+// DeleteTask forgets a task, e.g. one the queue turned down as a duplicate
+func (d *DB) DeleteTask(id string) error {
+	_, err := d.Exec("DELETE FROM tasks WHERE id = ?", id)
+	return err
+}
+
+// SetTaskPriority records a queued task's new priority
+func (d *DB) SetTaskPriority(id string, priority int) error {
+	_, err := d.Exec("UPDATE tasks SET priority = ? WHERE id = ?", priority, id)
+	return err
+}
+
+// StartTask marks a task as running
+func (d *DB) StartTask(id string) error {
+	_, err := d.Exec("UPDATE tasks SET status = ?, started_at = CURRENT_TIMESTAMP WHERE id = ?", TaskRunning, id)
+	return err
+}
+
+// FinishTask records how a task ended: its status, error and pair outcomes
+func (d *DB) FinishTask(t Task) error {
+	_, err := d.Exec(`UPDATE tasks SET status = ?, error = ?, finished_at = CURRENT_TIMESTAMP,
+		pairs_total = ?, pairs_succeeded = ?, pairs_failed = ?, pairs_timed_out = ?, pairs_cancelled = ?
+		WHERE id = ?`,
+		t.Status, t.Error,
+		t.PairsTotal, t.PairsSucceeded, t.PairsFailed, t.PairsTimedOut, t.PairsCancelled, t.ID)
+	return err
+}
+
+// FailRunningTasks fails the tasks a previous server process left running
+// and returns how many there were
+func (d *DB) FailRunningTasks(reason string) (int64, error) {
+	res, err := d.Exec("UPDATE tasks SET status = ?, error = ?, finished_at = CURRENT_TIMESTAMP WHERE status = ?",
+		TaskFailed, reason, TaskRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetQueuedTasks returns the tasks waiting to run, oldest first
+func (d *DB) GetQueuedTasks() ([]Task, error) {
+	return d.queryTasks(`SELECT `+taskColumns+` FROM tasks WHERE status = ? ORDER BY created_at, rowid`, TaskQueued)
+}
+
+// GetTasks returns a page of the task history, newest first, optionally
+// only tasks with the given status, and how many tasks match in total
+func (d *DB) GetTasks(limit, offset int, status string) ([]Task, int, error) {
+	var total int
+	if err := d.QueryRow("SELECT COUNT(*) FROM tasks WHERE (? = '' OR status = ?)", status, status).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	tasks, err := d.queryTasks(`SELECT `+taskColumns+` FROM tasks
+		WHERE (? = '' OR status = ?)
+		ORDER BY created_at DESC, rowid DESC
+		LIMIT ? OFFSET ?`, status, status, limit, offset)
+	return tasks, total, err
+}
+
+// taskColumns is the select list read by queryTasks. Timestamps are
+// formatted in SQL, the driver would return bare TIMESTAMP columns as RFC3339.
+const taskColumns = `id, type, priority, source, status, IFNULL(payload, ''), IFNULL(error, ''),
+	strftime('%Y-%m-%d %H:%M:%S', created_at),
+	IFNULL(strftime('%Y-%m-%d %H:%M:%S', started_at), ''),
+	IFNULL(strftime('%Y-%m-%d %H:%M:%S', finished_at), ''),
+	IFNULL((julianday(finished_at) - julianday(started_at)) * 86400, 0),
+	pairs_total, pairs_succeeded, pairs_failed, pairs_timed_out, pairs_cancelled`
+
+func (d *DB) queryTasks(query string, args ...any) ([]Task, error) {
+	rows, err := d.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	tasks := []Task{}
+	for rows.Next() {
+		var t Task
+		var payload string
+		if err := rows.Scan(&t.ID, &t.Type, &t.Priority, &t.Source, &t.Status, &payload, &t.Error,
+			&t.CreatedAt, &t.StartedAt, &t.FinishedAt, &t.DurationSeconds,
+			&t.PairsTotal, &t.PairsSucceeded, &t.PairsFailed, &t.PairsTimedOut, &t.PairsCancelled); err != nil {
+			return nil, err
+		}
+		if payload != "" {
+			t.Payload = json.RawMessage(payload)
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
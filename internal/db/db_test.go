@@ -1,8 +1,11 @@
 package db
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/user/homelab-speedtest/internal/config"
@@ -158,3 +161,520 @@ func TestGetLatestResults(t *testing.T) {
 	// If the test is too fast, CURRENT_TIMESTAMP might be the same.
 	// But the logic should still hold.
 }
+
+func TestSaveResultBidirectional(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "speedtest-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	db, errNew := New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if errNew != nil {
+		t.Fatalf("Failed to create database: %v", errNew)
+	}
+	defer func() { _ = db.Close() }()
+
+	_ = db.AddDevice(Device{Name: "D1", Hostname: "d1", SSHUser: "r", SSHPort: 22})
+	_ = db.AddDevice(Device{Name: "D2", Hostname: "d2", SSHUser: "r", SSHPort: 22})
+
+	_, err = db.SaveResult(Result{SourceID: 1, TargetID: 2, Type: "speed", Direction: "bidir", BandwidthMbps: 900, ReverseBandwidthMbps: 400})
+	if err != nil {
+		t.Fatalf("SaveResult failed: %v", err)
+	}
+
+	history, err := db.GetHistory(10, "speed")
+	if err != nil {
+		t.Fatalf("GetHistory failed: %v", err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(history))
+	}
+	if history[0].Direction != "bidir" || history[0].BandwidthMbps != 900 || history[0].ReverseBandwidthMbps != 400 {
+		t.Errorf("Unexpected result: %+v", history[0])
+	}
+}
+
+func TestSaveResultErrorClass(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "speedtest-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	db, errNew := New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if errNew != nil {
+		t.Fatalf("Failed to create database: %v", errNew)
+	}
+	defer func() { _ = db.Close() }()
+
+	_ = db.AddDevice(Device{Name: "D1", Hostname: "d1", SSHUser: "r", SSHPort: 22})
+	_ = db.AddDevice(Device{Name: "D2", Hostname: "d2", SSHUser: "r", SSHPort: 22})
+
+	_ = db.AddResult(1, 2, "ping", 1, 0, 0, 0, "")
+	_ = db.AddResult(1, 2, "ping", 0, 0, 0, 0, "connection refused")
+	_, _ = db.SaveResult(Result{SourceID: 1, TargetID: 2, Type: "ping", Error: "test timed out after 2m2s", ErrorClass: ErrorClassTimeout})
+
+	history, err := db.GetHistory(10, "ping")
+	if err != nil || len(history) != 3 {
+		t.Fatalf("Expected 3 results, got %d, %v", len(history), err)
+	}
+	classes := map[string]bool{}
+	for _, r := range history {
+		classes[r.ErrorClass] = true
+	}
+	// Successes have no class and unclassified errors default to "error"
+	if !classes[""] || !classes[ErrorClassError] || !classes[ErrorClassTimeout] {
+		t.Errorf("Unexpected error classes %v", classes)
+	}
+}
+
+func TestPairSettings(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "speedtest-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	db, errNew := New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if errNew != nil {
+		t.Fatalf("Failed to create database: %v", errNew)
+	}
+	defer func() { _ = db.Close() }()
+
+	four, eight := 4, 8
+	if err := db.SetPairSetting(PairSetting{SourceID: 1, TargetID: 2, ParallelStreams: &four}); err != nil {
+		t.Fatalf("SetPairSetting failed: %v", err)
+	}
+	// Second write for the same pair must update in place
+	if err := db.SetPairSetting(PairSetting{SourceID: 1, TargetID: 2, ParallelStreams: &eight}); err != nil {
+		t.Fatalf("SetPairSetting update failed: %v", err)
+	}
+
+	settings, err := db.GetPairSettings()
+	if err != nil {
+		t.Fatalf("GetPairSettings failed: %v", err)
+	}
+	if len(settings) != 1 || settings[0].ParallelStreams == nil || *settings[0].ParallelStreams != 8 {
+		t.Fatalf("Expected one pair with 8 streams, got %+v", settings)
+	}
+
+	timeout := 30
+	if err := db.SetPairSetting(PairSetting{SourceID: 1, TargetID: 2, ParallelStreams: &eight, TimeoutSeconds: &timeout}); err != nil {
+		t.Fatalf("SetPairSetting with timeout failed: %v", err)
+	}
+	settings, _ = db.GetPairSettings()
+	if len(settings) != 1 || settings[0].TimeoutSeconds == nil || *settings[0].TimeoutSeconds != 30 {
+		t.Fatalf("Expected a 30s timeout, got %+v", settings)
+	}
+
+	if err := db.DeletePairSetting(1, 2); err != nil {
+		t.Fatalf("DeletePairSetting failed: %v", err)
+	}
+	settings, _ = db.GetPairSettings()
+	if len(settings) != 0 {
+		t.Errorf("Expected no pair settings after delete, got %d", len(settings))
+	}
+	// Deleting a device drops the settings of its pairs in both directions
+	_ = db.SetPairSetting(PairSetting{SourceID: 1, TargetID: 2, ParallelStreams: &four})
+	_ = db.SetPairSetting(PairSetting{SourceID: 3, TargetID: 1, ParallelStreams: &four})
+	_ = db.SetPairSetting(PairSetting{SourceID: 2, TargetID: 3, ParallelStreams: &eight})
+	if err := db.DeleteDevice(1); err != nil {
+		t.Fatalf("DeleteDevice failed: %v", err)
+	}
+	settings, _ = db.GetPairSettings()
+	if len(settings) != 1 || settings[0].SourceID != 2 || settings[0].TargetID != 3 {
+		t.Errorf("Expected only the 2->3 setting to remain, got %+v", settings)
+	}
+}
+
+func TestScheduleOptions(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "speedtest-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	db, errNew := New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if errNew != nil {
+		t.Fatalf("Failed to create database: %v", errNew)
+	}
+	defer func() { _ = db.Close() }()
+
+	if err := db.UpdateScheduleOptions("speed", TestOptions{DurationSeconds: 20}); err == nil {
+		t.Error("Expected error for a schedule that doesn't exist")
+	}
+	if err := db.UpdateSchedule("speed", "15m", true); err != nil {
+		t.Fatalf("UpdateSchedule failed: %v", err)
+	}
+	opts := TestOptions{DurationSeconds: 20, BufferSize: 65536, OmitSeconds: 2}
+	if err := db.UpdateScheduleOptions("speed", opts); err != nil {
+		t.Fatalf("UpdateScheduleOptions failed: %v", err)
+	}
+
+	schedules, err := db.GetSchedules()
+	if err != nil {
+		t.Fatalf("GetSchedules failed: %v", err)
+	}
+	if len(schedules) != 1 || schedules[0].TestOptions != opts {
+		t.Fatalf("Expected speed schedule with %+v, got %+v", opts, schedules)
+	}
+
+	if _, err := db.SaveResult(Result{SourceID: 1, TargetID: 2, Type: "speed", BandwidthMbps: 900, TestOptions: opts}); err != nil {
+		t.Fatalf("SaveResult failed: %v", err)
+	}
+	history, err := db.GetHistory(1, "speed")
+	if err != nil || len(history) != 1 {
+		t.Fatalf("GetHistory failed: %v", err)
+	}
+	if history[0].TestOptions != opts {
+		t.Errorf("Expected result options %+v, got %+v", opts, history[0].TestOptions)
+	}
+}
+
+func TestResultSamples(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "speedtest-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	db, errNew := New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if errNew != nil {
+		t.Fatalf("Failed to create database: %v", errNew)
+	}
+	defer func() { _ = db.Close() }()
+
+	id, err := db.SaveResult(Result{SourceID: 1, TargetID: 2, Type: "speed", BandwidthMbps: 500})
+	if err != nil {
+		t.Fatalf("SaveResult failed: %v", err)
+	}
+	samples := []Sample{
+		{StartSeconds: 0, EndSeconds: 1, BytesSent: 100_000_000, BandwidthMbps: 800},
+		{StartSeconds: 1, EndSeconds: 2, BytesSent: 25_000_000, BandwidthMbps: 200},
+	}
+	if err := db.SaveSamples(id, samples); err != nil {
+		t.Fatalf("SaveSamples failed: %v", err)
+	}
+
+	got, err := db.GetSamples(id)
+	if err != nil {
+		t.Fatalf("GetSamples failed: %v", err)
+	}
+	if len(got) != 2 || got[0] != samples[0] || got[1] != samples[1] {
+		t.Errorf("Expected %+v, got %+v", samples, got)
+	}
+
+	history, _ := db.GetHistory(1, "")
+	if len(history) != 1 || history[0].ID != id {
+		t.Errorf("Expected history to carry result ID %d, got %+v", id, history)
+	}
+	if exists, _ := db.ResultExists(id + 1); exists {
+		t.Error("Expected unknown result ID to not exist")
+	}
+}
+
+func TestSaveResultTCPStats(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "speedtest-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	db, errNew := New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if errNew != nil {
+		t.Fatalf("Failed to create database: %v", errNew)
+	}
+	defer func() { _ = db.Close() }()
+
+	stats := &TCPStats{Retransmits: 0, RttMs: 1.5, RttVarMs: 0.25, Cwnd: 64}
+	if _, err := db.SaveResult(Result{SourceID: 1, TargetID: 2, Type: "speed", BandwidthMbps: 900, TCP: stats}); err != nil {
+		t.Fatalf("SaveResult failed: %v", err)
+	}
+	if _, err := db.SaveResult(Result{SourceID: 2, TargetID: 1, Type: "speed", BandwidthMbps: 800}); err != nil {
+		t.Fatalf("SaveResult failed: %v", err)
+	}
+
+	results, err := db.GetLatestResults()
+	if err != nil {
+		t.Fatalf("GetLatestResults failed: %v", err)
+	}
+	for _, r := range results {
+		switch r.SourceID {
+		case 1:
+			// Zero retransmits must survive the round trip as a value, not as "unknown"
+			if r.TCP == nil || *r.TCP != *stats {
+				t.Errorf("Expected TCP stats %+v, got %+v", stats, r.TCP)
+			}
+		case 2:
+			if r.TCP != nil {
+				t.Errorf("Expected no TCP stats, got %+v", r.TCP)
+			}
+		}
+	}
+}
+
+func TestTraceHops(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "speedtest-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	db, errNew := New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if errNew != nil {
+		t.Fatalf("Failed to create database: %v", errNew)
+	}
+	defer func() { _ = db.Close() }()
+
+	id, err := db.SaveResult(Result{SourceID: 1, TargetID: 2, Type: "trace", Protocol: "udp", HopCount: 2, LatencyMs: 1.5})
+	if err != nil {
+		t.Fatalf("SaveResult failed: %v", err)
+	}
+	hops := []TraceHop{
+		{TTL: 2, Address: "192.0.2.2", Sent: 3, Received: 3, RttMinMs: 1, RttAvgMs: 1.5, RttMaxMs: 2},
+		{TTL: 1, Address: "", Sent: 3},
+	}
+	if err := db.SaveTraceHops(id, hops); err != nil {
+		t.Fatalf("SaveTraceHops failed: %v", err)
+	}
+	if _, err := db.SaveResult(Result{SourceID: 1, TargetID: 2, Type: "pmtu", PathMTU: 1500}); err != nil {
+		t.Fatalf("SaveResult failed: %v", err)
+	}
+
+	got, err := db.GetTraceHops(id)
+	if err != nil {
+		t.Fatalf("GetTraceHops failed: %v", err)
+	}
+	if len(got) != 2 || got[0] != hops[1] || got[1] != hops[0] {
+		t.Errorf("Expected hops in TTL order, got %+v", got)
+	}
+
+	history, _ := db.GetHistory(10, "")
+	for _, r := range history {
+		switch r.Type {
+		case "trace":
+			if r.Protocol != "udp" || r.HopCount != 2 {
+				t.Errorf("Unexpected trace result: %+v", r)
+			}
+		case "pmtu":
+			if r.PathMTU != 1500 {
+				t.Errorf("Expected path MTU 1500, got %d", r.PathMTU)
+			}
+		}
+	}
+}
+
+func TestDeviceCredentialEncryption(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "speedtest-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	db, errNew := New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if errNew != nil {
+		t.Fatalf("Failed to create database: %v", errNew)
+	}
+	defer func() { _ = db.Close() }()
+
+	dev := Device{Name: "nas", Hostname: "nas", SSHUser: "root", SSHPort: 22,
+		Credential: Credential{Type: AuthPassword, Password: "hunter2"}}
+	if err := db.AddDevice(dev); err != ErrNoMasterKey {
+		t.Errorf("Expected ErrNoMasterKey without a master key, got %v", err)
+	}
+
+	key, err := LoadMasterKey(filepath.Join(tmpDir, "master.key"))
+	if err != nil {
+		t.Fatalf("LoadMasterKey failed: %v", err)
+	}
+	if again, _ := LoadMasterKey(filepath.Join(tmpDir, "master.key")); string(again) != string(key) {
+		t.Error("Expected the generated master key to be reused")
+	}
+	if err := db.SetMasterKey(key); err != nil {
+		t.Fatalf("SetMasterKey failed: %v", err)
+	}
+	if err := db.AddDevice(dev); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+
+	var stored string
+	_ = db.QueryRow("SELECT password FROM devices").Scan(&stored)
+	if strings.Contains(stored, "hunter2") || !strings.HasPrefix(stored, secretPrefix) {
+		t.Errorf("Expected the password to be encrypted at rest, got %q", stored)
+	}
+
+	got, err := db.GetDevice(1)
+	if err != nil || got == nil {
+		t.Fatalf("GetDevice failed: %v", err)
+	}
+	if got.Credential != dev.Credential {
+		t.Errorf("Expected credential %+v, got %+v", dev.Credential, got.Credential)
+	}
+
+	// With another master key the secret is unreadable but the device still lists
+	other := make([]byte, MasterKeySize)
+	_ = db.SetMasterKey(other)
+	devices, err := db.GetDevices()
+	if err != nil || len(devices) != 1 || devices[0].Credential.Password != "" {
+		t.Errorf("Expected the device without its password, got %+v, %v", devices, err)
+	}
+}
+
+func TestSetWorkerInfo(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "speedtest-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	db, errNew := New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if errNew != nil {
+		t.Fatalf("Failed to create database: %v", errNew)
+	}
+	defer func() { _ = db.Close() }()
+
+	_ = db.AddDevice(Device{Name: "nas", Hostname: "nas", SSHUser: "root", SSHPort: 22})
+	if err := db.SetWorkerInfo(1, WorkerInfo{Arch: "linux/arm64", Path: "/tmp/hl-speedtest-worker", Version: "1.0.0", SHA256: "aaa"}); err != nil {
+		t.Fatalf("SetWorkerInfo failed: %v", err)
+	}
+	_, _ = db.Exec("UPDATE devices SET worker_deployed_at = '2020-01-01 00:00:00'")
+
+	// Verifying the same build keeps the deploy time
+	_ = db.SetWorkerInfo(1, WorkerInfo{Arch: "linux/arm64", Path: "/tmp/hl-speedtest-worker", Version: "1.0.0", SHA256: "aaa"})
+	dev, _ := db.GetDevice(1)
+	if dev.Arch != "linux/arm64" || dev.WorkerVersion != "1.0.0" || dev.WorkerSHA256 != "aaa" || dev.WorkerDeployedAt != "2020-01-01 00:00:00" {
+		t.Errorf("Unexpected worker info after re-verifying: %+v", dev)
+	}
+
+	_ = db.SetWorkerInfo(1, WorkerInfo{Arch: "linux/arm64", Path: "/tmp/hl-speedtest-worker", Version: "1.1.0", SHA256: "bbb"})
+	dev, _ = db.GetDevice(1)
+	if dev.WorkerVersion != "1.1.0" || dev.WorkerSHA256 != "bbb" || dev.WorkerDeployedAt == "2020-01-01 00:00:00" {
+		t.Errorf("Expected a new deploy time after redeploying, got %+v", dev)
+	}
+
+	// Editing the device doesn't clear what the orchestrator recorded
+	dev.Name = "nas2"
+	_ = db.UpdateDevice(*dev)
+	if dev, _ = db.GetDevice(1); dev.WorkerSHA256 != "bbb" || dev.Arch != "linux/arm64" {
+		t.Errorf("Expected the worker info to survive an update, got %+v", dev)
+	}
+
+	_ = db.ClearWorkerInfo(1)
+	if dev, _ = db.GetDevice(1); dev.WorkerPath != "" || dev.WorkerSHA256 != "" || dev.WorkerDeployedAt != "" || dev.Arch != "linux/arm64" {
+		t.Errorf("Expected the worker info to be cleared but the arch kept, got %+v", dev)
+	}
+}
+
+func TestAgentToken(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "speedtest-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	db, errNew := New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if errNew != nil {
+		t.Fatalf("Failed to create database: %v", errNew)
+	}
+	defer func() { _ = db.Close() }()
+
+	_ = db.AddDevice(Device{Name: "appliance", Hostname: "appliance", SSHUser: "root", SSHPort: 22, Transport: TransportAgent})
+	if err := db.SetAgentToken(1, "secret-token"); err != nil {
+		t.Fatalf("SetAgentToken failed: %v", err)
+	}
+	if err := db.SetAgentToken(2, "other"); err == nil {
+		t.Error("Expected an error for a missing device")
+	}
+
+	var stored string
+	_ = db.QueryRow("SELECT agent_token_hash FROM devices WHERE id = 1").Scan(&stored)
+	if stored == "" || stored == "secret-token" {
+		t.Errorf("Expected the token to be stored hashed, got %q", stored)
+	}
+
+	dev, err := db.GetDeviceByAgentToken("secret-token")
+	if err != nil || dev == nil || dev.ID != 1 {
+		t.Fatalf("Expected the token to find the device, got %+v, %v", dev, err)
+	}
+	for _, token := range []string{"", "wrong", stored} {
+		if dev, err := db.GetDeviceByAgentToken(token); dev != nil || err != nil {
+			t.Errorf("Expected token %q to match nothing, got %+v, %v", token, dev, err)
+		}
+	}
+
+	// A new token replaces the old one
+	_ = db.SetAgentToken(1, "rotated")
+	if dev, _ := db.GetDeviceByAgentToken("secret-token"); dev != nil {
+		t.Error("Expected the old token to stop working")
+	}
+
+	_ = db.SetAgentSeen(1)
+	if dev, _ = db.GetDevice(1); dev.AgentLastSeen == "" {
+		t.Error("Expected the heartbeat to be recorded")
+	}
+}
+
+func TestTasks(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "speedtest-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	db, errNew := New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if errNew != nil {
+		t.Fatalf("Failed to create database: %v", errNew)
+	}
+	defer func() { _ = db.Close() }()
+
+	for i, id := range []string{"a", "b", "c", "d"} {
+		task := Task{ID: id, Type: "ping_all", Source: "schedule", CreatedAt: fmt.Sprintf("2026-01-01 00:00:0%d", i)}
+		if id == "b" {
+			task.Type, task.Source, task.Payload = "speed_all", "api", json.RawMessage(`{"options":{"duration":5}}`)
+		}
+		if err := db.AddTask(task); err != nil {
+			t.Fatalf("AddTask failed: %v", err)
+		}
+	}
+
+	_ = db.StartTask("a")
+	_ = db.FinishTask(Task{ID: "a", Status: TaskFailed, PairsTotal: 6, PairsSucceeded: 4, PairsFailed: 1, PairsTimedOut: 1})
+	_ = db.StartTask("c")
+	if n, err := db.FailRunningTasks("interrupted"); err != nil || n != 1 {
+		t.Errorf("Expected one running task to be failed, got %d, %v", n, err)
+	}
+
+	queued, err := db.GetQueuedTasks()
+	if err != nil || len(queued) != 2 || queued[0].ID != "b" || queued[1].ID != "d" {
+		t.Fatalf("Expected tasks b and d queued in order, got %+v, %v", queued, err)
+	}
+	if string(queued[0].Payload) != `{"options":{"duration":5}}` || queued[0].Source != "api" {
+		t.Errorf("Expected the payload and source to be kept, got %+v", queued[0])
+	}
+
+	tasks, total, err := db.GetTasks(2, 0, "")
+	if err != nil || total != 4 || len(tasks) != 2 || tasks[0].ID != "d" || tasks[1].ID != "c" {
+		t.Fatalf("Expected the newest two of four tasks, got %+v, %d, %v", tasks, total, err)
+	}
+	if tasks[1].Status != TaskFailed || tasks[1].Error != "interrupted" || tasks[1].FinishedAt == "" {
+		t.Errorf("Expected the interrupted task failed, got %+v", tasks[1])
+	}
+	// Every timestamp comes back in the same format
+	if c := tasks[1]; c.CreatedAt != "2026-01-01 00:00:02" || len(c.StartedAt) != len(c.CreatedAt) || len(c.FinishedAt) != len(c.CreatedAt) {
+		t.Errorf("Expected timestamps like %q, got %q, %q, %q", "2026-01-01 00:00:02", c.CreatedAt, c.StartedAt, c.FinishedAt)
+	}
+
+	tasks, total, _ = db.GetTasks(10, 0, TaskFailed)
+	if total != 2 || len(tasks) != 2 || tasks[1].ID != "a" {
+		t.Fatalf("Expected two failed tasks, got %+v, %d", tasks, total)
+	}
+	if a := tasks[1]; a.StartedAt == "" || a.PairsTotal != 6 || a.PairsSucceeded != 4 || a.PairsFailed != 1 || a.PairsTimedOut != 1 {
+		t.Errorf("Expected the outcome of task a, got %+v", a)
+	}
+
+	_ = db.DeleteTask("d")
+	if _, total, _ := db.GetTasks(10, 0, ""); total != 3 {
+		t.Errorf("Expected 3 tasks after a delete, got %d", total)
+	}
+}
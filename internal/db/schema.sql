@@ -5,14 +5,37 @@ CREATE TABLE IF NOT EXISTS devices (
     ip TEXT,
     ssh_user TEXT NOT NULL,
     ssh_port INTEGER DEFAULT 22,
+    transport TEXT,            -- ssh (NULL), local or agent
+    worker_port_min INTEGER,   -- worker server port range, NULL = global default
+    worker_port_max INTEGER,
+    arch TEXT,                 -- worker build, e.g. linux/arm64; detected with uname when NULL
+    install_dir TEXT,          -- where the worker goes, NULL = /tmp or an exec-capable fallback
+    worker_cleanup TEXT,       -- keep (NULL), after_run, on_delete
+    jump_device_id INTEGER,    -- SSH through this device, or
+    jump_host TEXT,            -- through [user@]host[:port] jump hosts, comma separated
+    auth_type TEXT,            -- '' (server key), key_file, private_key, agent, password
+    key_path TEXT,
+    agent_socket TEXT,
+    private_key TEXT,          -- secrets are AES-GCM encrypted with the master key
+    passphrase TEXT,
+    password TEXT,
+    worker_path TEXT,          -- worker build last verified on the device
+    worker_version TEXT,
+    worker_sha256 TEXT,
+    worker_deployed_at TIMESTAMP,
+    agent_token_hash TEXT,     -- SHA-256 of the agent's enrollment token
+    agent_last_seen TIMESTAMP, -- last agent heartbeat
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
 CREATE TABLE IF NOT EXISTS schedules (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    type TEXT NOT NULL UNIQUE, -- 'ping', 'speed'
+    type TEXT NOT NULL UNIQUE, -- 'ping', 'speed', 'bufferbloat'
     cron TEXT NOT NULL,
     enabled BOOLEAN DEFAULT 1,
+    duration_seconds INTEGER,  -- speed test options, NULL = worker default
+    buffer_size INTEGER,
+    omit_seconds INTEGER,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -20,7 +43,7 @@ CREATE TABLE IF NOT EXISTS results (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     source_device_id INTEGER NOT NULL,
     target_device_id INTEGER NOT NULL,
-    type TEXT NOT NULL, -- 'ping', 'speed'
+    type TEXT NOT NULL, -- 'ping', 'speed', 'bufferbloat', 'trace', 'pmtu'
     timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     
     -- Ping specific
@@ -29,10 +52,34 @@ CREATE TABLE IF NOT EXISTS results (
     packet_loss REAL,
 
     -- Speed specific
-    bandwidth_mbps REAL,
+    bandwidth_mbps REAL,         -- source -> target, receiver-measured when available
+    direction TEXT,              -- 'forward', 'reverse', 'bidir'
+    reverse_bandwidth_mbps REAL, -- target -> source, measured by the source as receiver
+    sender_bandwidth_mbps REAL,          -- source write rate
+    receiver_bandwidth_mbps REAL,        -- measured by the target's worker
+    reverse_sender_bandwidth_mbps REAL,  -- target write rate
+    protocol TEXT,               -- trace probe protocol, 'udp' or 'tcp'
+    hop_count INTEGER,           -- trace hops up to and including the target
+    path_mtu INTEGER,            -- largest unfragmented IP packet in bytes (pmtu)
+    streams INTEGER,             -- parallel TCP streams used
+    duration_seconds INTEGER,    -- effective test options
+    buffer_size INTEGER,
+    omit_seconds INTEGER,
+
+    -- Latency under load (latency_ms is the idle latency)
+    loaded_latency_ms REAL,
+    bufferbloat_ms REAL,         -- loaded - idle
+    bufferbloat_grade TEXT,      -- 'A+' .. 'F'
+
+    -- TCP_INFO from the client sockets (NULL when not collected)
+    tcp_retransmits INTEGER,
+    tcp_rtt_ms REAL,             -- smoothed RTT
+    tcp_rttvar_ms REAL,
+    tcp_cwnd INTEGER,            -- final congestion window in segments
 
     -- Error reporting
     error TEXT,
+    error_class TEXT,          -- error, timeout or cancelled when error is set
     
     FOREIGN KEY(source_device_id) REFERENCES devices(id),
     FOREIGN KEY(target_device_id) REFERENCES devices(id)
@@ -42,6 +89,76 @@ CREATE INDEX IF NOT EXISTS idx_results_timestamp ON results(timestamp);
 CREATE INDEX IF NOT EXISTS idx_results_source ON results(source_device_id);
 CREATE INDEX IF NOT EXISTS idx_results_target ON results(target_device_id);
 
+-- Per interval throughput of a speed test
+CREATE TABLE IF NOT EXISTS result_samples (
+    result_id INTEGER NOT NULL,
+    seq INTEGER NOT NULL,        -- 0-based sample index
+    start_seconds REAL NOT NULL, -- offset from the start of the measured window
+    end_seconds REAL NOT NULL,
+    bytes_sent INTEGER,
+    bytes_received INTEGER,
+    bandwidth_mbps REAL,
+    reverse_bandwidth_mbps REAL,
+    PRIMARY KEY (result_id, seq),
+    FOREIGN KEY(result_id) REFERENCES results(id) ON DELETE CASCADE
+);
+
+-- Per hop RTTs of a traceroute
+CREATE TABLE IF NOT EXISTS trace_hops (
+    result_id INTEGER NOT NULL,
+    ttl INTEGER NOT NULL,
+    address TEXT,                -- empty when no probe was answered
+    sent INTEGER,
+    received INTEGER,
+    rtt_min_ms REAL,
+    rtt_avg_ms REAL,
+    rtt_max_ms REAL,
+    PRIMARY KEY (result_id, ttl),
+    FOREIGN KEY(result_id) REFERENCES results(id) ON DELETE CASCADE
+);
+
+-- Per device pair test preferences
+CREATE TABLE IF NOT EXISTS pair_settings (
+    source_device_id INTEGER NOT NULL,
+    target_device_id INTEGER NOT NULL,
+    parallel_streams INTEGER,  -- NULL = use the global default
+    timeout_seconds INTEGER,   -- per test, on top of its duration; NULL = TEST_TIMEOUT
+    PRIMARY KEY (source_device_id, target_device_id),
+    FOREIGN KEY(source_device_id) REFERENCES devices(id) ON DELETE CASCADE,
+    FOREIGN KEY(target_device_id) REFERENCES devices(id) ON DELETE CASCADE
+);
+
+-- SSH host keys pinned on first use
+CREATE TABLE IF NOT EXISTS host_keys (
+    device_id INTEGER PRIMARY KEY,
+    key_type TEXT NOT NULL,
+    public_key TEXT NOT NULL,  -- base64 wire format
+    fingerprint TEXT NOT NULL,
+    first_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(device_id) REFERENCES devices(id) ON DELETE CASCADE
+);
+
+-- Tasks of the test queue: queued ones survive restarts, finished ones are the task history
+CREATE TABLE IF NOT EXISTS tasks (
+    id TEXT PRIMARY KEY,
+    type TEXT NOT NULL,        -- 'ping_all', 'speed_all', 'bufferbloat_all', 'trace'
+    priority INTEGER NOT NULL DEFAULT 0,
+    source TEXT NOT NULL,      -- 'schedule', 'manual', 'api'
+    status TEXT NOT NULL,      -- 'queued', 'running', 'done', 'failed', 'cancelled'
+    payload TEXT,              -- task options as JSON
+    error TEXT,
+    created_at TIMESTAMP NOT NULL,
+    started_at TIMESTAMP,
+    finished_at TIMESTAMP,
+    pairs_total INTEGER NOT NULL DEFAULT 0,
+    pairs_succeeded INTEGER NOT NULL DEFAULT 0,
+    pairs_failed INTEGER NOT NULL DEFAULT 0,
+    pairs_timed_out INTEGER NOT NULL DEFAULT 0,
+    pairs_cancelled INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_tasks_status ON tasks(status);
+CREATE INDEX IF NOT EXISTS idx_tasks_created_at ON tasks(created_at);
+
 -- Notification settings (SMTP + ntfy defaults)
 CREATE TABLE IF NOT EXISTS notification_settings (
     key TEXT PRIMARY KEY,
@@ -52,7 +169,7 @@ CREATE TABLE IF NOT EXISTS notification_settings (
 CREATE TABLE IF NOT EXISTS alert_rules (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     name TEXT NOT NULL,
-    event_type TEXT NOT NULL,  -- 'speed_below', 'ping_above', 'packet_loss_above', 'test_error'
+    event_type TEXT NOT NULL,  -- 'speed_below', 'ping_above', 'packet_loss_above', 'loaded_latency_above', 'test_error'
     threshold REAL,            -- NULL for test_error
     source_device_id INTEGER,  -- NULL = global (all pairs)
     target_device_id INTEGER,  -- NULL = global (all pairs)
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MasterKeySize is the length of the AES-256 key that encrypts stored secrets
+const MasterKeySize = 32
+
+// secretPrefix marks an encrypted value; the version allows changing the scheme later
+const secretPrefix = "enc:v1:"
+
+// ErrNoMasterKey is returned when a secret has to be stored or read without a master key
+var ErrNoMasterKey = errors.New("no master key configured for encrypting secrets")
+
+// SetMasterKey enables encryption of device secrets with an AES-256-GCM key
+func (d *DB) SetMasterKey(key []byte) error {
+	if len(key) != MasterKeySize {
+		return fmt.Errorf("master key must be %d bytes, got %d", MasterKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	d.secrets = aead
+	return nil
+}
+
+// seal encrypts a secret for storage; empty secrets are stored as NULL
+func (d *DB) seal(plain string) (any, error) {
+	if plain == "" {
+		return nil, nil
+	}
+	if d.secrets == nil {
+		return nil, ErrNoMasterKey
+	}
+	nonce := make([]byte, d.secrets.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := d.secrets.Seal(nonce, nonce, []byte(plain), nil)
+	return secretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a secret written by seal
+func (d *DB) open(stored string) (string, error) {
+	if stored == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(stored, secretPrefix) {
+		return "", errors.New("secret is not encrypted")
+	}
+	if d.secrets == nil {
+		return "", ErrNoMasterKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, secretPrefix))
+	if err != nil {
+		return "", err
+	}
+	n := d.secrets.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("secret is truncated")
+	}
+	plain, err := d.secrets.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", errors.New("secret can't be decrypted, the master key has changed")
+	}
+	return string(plain), nil
+}
+
+// LoadMasterKey reads a master key from a file holding it hex or base64
+// encoded, creating the file with a random key if it doesn't exist
+func LoadMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, MasterKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseMasterKey(string(data))
+}
+
+// ParseMasterKey decodes a hex or base64 encoded master key
+func ParseMasterKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == MasterKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == MasterKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("master key must be %d bytes, hex or base64 encoded", MasterKeySize)
+}
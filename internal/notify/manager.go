@@ -17,6 +17,8 @@ const (
 	EventPingAbove       = "ping_above"
 	EventPacketLossAbove = "packet_loss_above"
 	EventTestError       = "test_error"
+
+	EventLoadedLatencyAbove = "loaded_latency_above" // bufferbloat tests
 )
 
 // EnvConfigStatus indicates which settings are configured via environment variables
@@ -359,10 +361,15 @@ func (m *Manager) CheckAndNotify(result db.Result, devices []db.Device) {
 		switch rule.EventType {
 		case EventSpeedBelow:
 			if result.Type == "speed" && result.Error == "" && rule.Threshold != nil {
-				if result.BandwidthMbps < *rule.Threshold {
+				// Only check the directions that were actually measured
+				if result.Direction != "reverse" && result.BandwidthMbps < *rule.Threshold {
 					triggered = true
 					title = fmt.Sprintf("Speed Alert: %s -> %s", sourceName, targetName)
 					message = fmt.Sprintf("Bandwidth %.2f Mbps is below threshold %.2f Mbps", result.BandwidthMbps, *rule.Threshold)
+				} else if (result.Direction == "reverse" || result.Direction == "bidir") && result.ReverseBandwidthMbps < *rule.Threshold {
+					triggered = true
+					title = fmt.Sprintf("Speed Alert: %s -> %s", targetName, sourceName)
+					message = fmt.Sprintf("Reverse bandwidth %.2f Mbps is below threshold %.2f Mbps", result.ReverseBandwidthMbps, *rule.Threshold)
 				}
 			}
 		case EventPingAbove:
@@ -381,10 +388,23 @@ func (m *Manager) CheckAndNotify(result db.Result, devices []db.Device) {
 					message = fmt.Sprintf("Packet loss %.2f%% is above threshold %.2f%%", result.PacketLoss, *rule.Threshold)
 				}
 			}
+		case EventLoadedLatencyAbove:
+			if result.Type == "bufferbloat" && result.Error == "" && rule.Threshold != nil {
+				if result.LoadedLatencyMs > *rule.Threshold {
+					triggered = true
+					title = fmt.Sprintf("Bufferbloat Alert: %s -> %s", sourceName, targetName)
+					message = fmt.Sprintf("Loaded latency %.2f ms is above threshold %.2f ms (idle %.2f ms, grade %s)",
+						result.LoadedLatencyMs, *rule.Threshold, result.LatencyMs, result.BufferbloatGrade)
+				}
+			}
 		case EventTestError:
-			if result.Error != "" {
+			// Tests cancelled on purpose aren't failures
+			if result.Error != "" && result.ErrorClass != db.ErrorClassCancelled {
 				triggered = true
 				title = fmt.Sprintf("Test Error: %s -> %s", sourceName, targetName)
+				if result.ErrorClass == db.ErrorClassTimeout {
+					title = fmt.Sprintf("Test Timeout: %s -> %s", sourceName, targetName)
+				}
 				message = fmt.Sprintf("Test failed: %s", result.Error)
 			}
 		}
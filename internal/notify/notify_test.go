@@ -1,9 +1,14 @@
 package notify
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/user/homelab-speedtest/internal/config"
+	"github.com/user/homelab-speedtest/internal/db"
 )
 
 func TestNewNtfyService(t *testing.T) {
@@ -36,3 +41,48 @@ func TestSendDisabled(t *testing.T) {
 		t.Errorf("Expected no error when disabled, got %v", err)
 	}
 }
+
+func TestLoadedLatencyAlert(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "notify-test-*")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	database, err := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	var titles []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		titles = append(titles, r.Header.Get("Title"))
+	}))
+	defer srv.Close()
+
+	m := NewManager(database)
+	m.ntfy = New(config.NtfyConfig{Enabled: true, Server: srv.URL})
+	threshold := 100.0
+	if _, err := database.CreateAlertRule(db.AlertRule{Name: "bloat", EventType: EventLoadedLatencyAbove, Threshold: &threshold,
+		NotifyNtfy: true, NtfyTopic: "alerts", Enabled: true}); err != nil {
+		t.Fatalf("CreateAlertRule failed: %v", err)
+	}
+	devices := []db.Device{{ID: 1, Name: "nas"}, {ID: 2, Name: "pi"}}
+
+	for _, tc := range []struct {
+		name   string
+		result db.Result
+		fires  bool
+	}{
+		{"above", db.Result{Type: "bufferbloat", LatencyMs: 5, LoadedLatencyMs: 150, BufferbloatGrade: "C"}, true},
+		{"below", db.Result{Type: "bufferbloat", LatencyMs: 5, LoadedLatencyMs: 80}, false},
+		{"failed", db.Result{Type: "bufferbloat", LoadedLatencyMs: 150, Error: "connection refused"}, false},
+		{"other type", db.Result{Type: "ping", LatencyMs: 150, LoadedLatencyMs: 150}, false},
+	} {
+		titles = nil
+		tc.result.SourceID, tc.result.TargetID = 1, 2
+		m.CheckAndNotify(tc.result, devices)
+		if fired := len(titles) == 1; fired != tc.fires {
+			t.Errorf("%s: expected fired=%v, got notifications %q", tc.name, tc.fires, titles)
+		} else if fired && titles[0] != "Bufferbloat Alert: nas -> pi" {
+			t.Errorf("%s: unexpected title %q", tc.name, titles[0])
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/user/homelab-speedtest/internal/db"
+)
+
+// DefaultAgentTimeout is how long an agent may stay silent before it is
+// considered offline: three missed heartbeats
+const DefaultAgentTimeout = 3 * DefaultAgentHeartbeat
+
+// errAgentDisconnected fails the jobs of an agent whose channel closed
+var errAgentDisconnected = errors.New("agent disconnected")
+
+// AgentConn is the control channel of a connected agent, such as a *websocket.Conn
+type AgentConn interface {
+	ReadJSON(v any) error
+	WriteJSON(v any) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// AgentStatus is the connection state of a device's agent
+type AgentStatus struct {
+	DeviceID int       `json:"device_id"`
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// AgentHub keeps track of the agents connected to the server and runs
+// workers through them
+type AgentHub struct {
+	// Timeout disconnects agents that haven't sent anything for this long
+	Timeout time.Duration
+
+	// OnHello is called with the worker build an agent reported on connecting
+	OnHello func(dev db.Device, info db.WorkerInfo)
+	// OnHeartbeat is called for every heartbeat
+	OnHeartbeat func(dev db.Device)
+	// OnStatus is called when an agent comes online or goes offline
+	OnStatus func(status AgentStatus)
+
+	mu       sync.Mutex
+	sessions map[int]*agentSession // by device ID
+}
+
+func NewAgentHub() *AgentHub {
+	return &AgentHub{Timeout: DefaultAgentTimeout, sessions: map[int]*agentSession{}}
+}
+
+// agentSession is one connection of an agent
+type agentSession struct {
+	dev   db.Device
+	conn  AgentConn
+	hello AgentMessage
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	jobs     map[string]*agentJob
+	lastSeen time.Time
+	closed   bool
+}
+
+// agentJob is a run waiting for its result or a started worker
+type agentJob struct {
+	result chan AgentMessage // runs
+
+	// started workers
+	stdout *io.PipeWriter
+	stderr io.Writer
+	exited chan struct{}
+	err    error // why the worker failed, once exited
+}
+
+// Serve runs the control channel of dev's agent until it disconnects. A
+// second connection for the same device replaces the first.
+func (h *AgentHub) Serve(dev db.Device, conn AgentConn) error {
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetReadDeadline(time.Now().Add(h.Timeout))
+	var hello AgentMessage
+	if err := conn.ReadJSON(&hello); err != nil {
+		return err
+	}
+	if hello.Type != AgentHello {
+		return fmt.Errorf("expected a hello from the agent of %s, got %q", dev.Name, hello.Type)
+	}
+
+	s := &agentSession{dev: dev, conn: conn, hello: hello, jobs: map[string]*agentJob{}, lastSeen: time.Now()}
+	h.mu.Lock()
+	old := h.sessions[dev.ID]
+	h.sessions[dev.ID] = s
+	h.mu.Unlock()
+	if old != nil {
+		log.Printf("Agent of %s reconnected, dropping its previous connection", dev.Name)
+		_ = old.conn.Close()
+	}
+	log.Printf("Agent of %s connected (%s, worker %s)", dev.Name, hello.Arch, hello.WorkerVersion)
+	if h.OnHello != nil {
+		h.OnHello(dev, db.WorkerInfo{Arch: hello.Arch, Path: hello.WorkerPath, Version: hello.WorkerVersion, SHA256: hello.WorkerSHA256})
+	}
+	h.status(s, true)
+
+	err := h.read(s)
+
+	h.mu.Lock()
+	current := h.sessions[dev.ID] == s
+	if current {
+		delete(h.sessions, dev.ID)
+	}
+	h.mu.Unlock()
+	s.fail()
+	if current {
+		log.Printf("Agent of %s disconnected: %v", dev.Name, err)
+		h.status(s, false)
+	}
+	return err
+}
+
+// read handles the agent's messages until the channel fails or times out
+func (h *AgentHub) read(s *agentSession) error {
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(h.Timeout))
+		var msg AgentMessage
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.lastSeen = time.Now()
+		s.mu.Unlock()
+		if msg.Type == AgentHeartbeat {
+			if h.OnHeartbeat != nil {
+				h.OnHeartbeat(s.dev)
+			}
+			continue
+		}
+		s.deliver(msg)
+	}
+}
+
+func (h *AgentHub) status(s *agentSession, online bool) {
+	if h.OnStatus == nil {
+		return
+	}
+	s.mu.Lock()
+	lastSeen := s.lastSeen
+	s.mu.Unlock()
+	h.OnStatus(AgentStatus{DeviceID: s.dev.ID, Online: online, LastSeen: lastSeen})
+}
+
+// Online reports whether the agent of a device is connected
+func (h *AgentHub) Online(deviceID int) bool {
+	return h.session(deviceID) != nil
+}
+
+// Disconnect drops the connection of a device's agent, e.g. after its token changed
+func (h *AgentHub) Disconnect(deviceID int) {
+	if s := h.session(deviceID); s != nil {
+		_ = s.conn.Close()
+	}
+}
+
+func (h *AgentHub) session(deviceID int) *agentSession {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sessions[deviceID]
+}
+
+func (s *agentSession) send(msg AgentMessage) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteJSON(msg)
+}
+
+// add registers a job, failing once the agent is gone
+func (s *agentSession) add(id string, job *agentJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errAgentDisconnected
+	}
+	s.jobs[id] = job
+	return nil
+}
+
+func (s *agentSession) remove(id string) *agentJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.jobs[id]
+	delete(s.jobs, id)
+	return job
+}
+
+// deliver routes a message from the agent to the job it belongs to
+func (s *agentSession) deliver(msg AgentMessage) {
+	switch msg.Type {
+	case AgentResult:
+		if job := s.remove(msg.ID); job != nil && job.result != nil {
+			job.result <- msg
+		}
+	case AgentOutput:
+		s.mu.Lock()
+		job := s.jobs[msg.ID]
+		s.mu.Unlock()
+		if job == nil || job.stdout == nil {
+			return
+		}
+		if msg.Stderr != "" && job.stderr != nil {
+			_, _ = io.WriteString(job.stderr, msg.Stderr)
+		}
+		if msg.Stdout != "" {
+			_, _ = io.WriteString(job.stdout, msg.Stdout)
+		}
+	case AgentExit:
+		if job := s.remove(msg.ID); job != nil && job.stdout != nil {
+			job.finish(msg.Error)
+		}
+	default:
+		log.Printf("Agent of %s sent an unexpected %q message", s.dev.Name, msg.Type)
+	}
+}
+
+// fail ends every job of a closed connection
+func (s *agentSession) fail() {
+	s.mu.Lock()
+	s.closed = true
+	jobs := s.jobs
+	s.jobs = map[string]*agentJob{}
+	s.mu.Unlock()
+	for _, job := range jobs {
+		if job.result != nil {
+			job.result <- AgentMessage{Type: AgentResult, Error: errAgentDisconnected.Error()}
+		} else {
+			job.finish(errAgentDisconnected.Error())
+		}
+	}
+}
+
+func (j *agentJob) finish(errMsg string) {
+	if errMsg != "" {
+		j.err = errors.New(errMsg)
+		_ = j.stdout.CloseWithError(j.err)
+	} else {
+		_ = j.stdout.Close()
+	}
+	close(j.exited)
+}
+
+// agentExecutor runs the worker through the connected agent of a device
+type agentExecutor struct {
+	hub *AgentHub
+	dev db.Device
+	s   *agentSession
+}
+
+func (o *Orchestrator) agentExecutor(dev db.Device) (*agentExecutor, error) {
+	s := o.Agents.session(dev.ID)
+	if s == nil {
+		return nil, fmt.Errorf("the agent of %s is offline", dev.Name)
+	}
+	return &agentExecutor{hub: o.Agents, dev: dev, s: s}, nil
+}
+
+// Deploy checks the agent's protocol; agents are installed and upgraded on the device
+func (e *agentExecutor) Deploy(ctx context.Context) error {
+	if v := e.s.hello.ProtocolVersion; v != ProtocolVersion {
+		return fmt.Errorf("%w: the agent of %s speaks protocol %d, expected %d; upgrade the worker on the device",
+			ErrIncompatibleWorker, e.dev.Name, v, ProtocolVersion)
+	}
+	return nil
+}
+
+func (e *agentExecutor) Run(ctx context.Context, input []byte) (string, string, error) {
+	id := uuid.NewString()
+	job := &agentJob{result: make(chan AgentMessage, 1)}
+	if err := e.s.add(id, job); err != nil {
+		return "", "", err
+	}
+	if err := e.s.send(AgentMessage{Type: AgentRun, ID: id, Input: string(input)}); err != nil {
+		e.s.remove(id)
+		return "", "", err
+	}
+	var res AgentMessage
+	select {
+	case res = <-job.result:
+	case <-ctx.Done():
+		// The agent kills the worker right away and answers with a result
+		// nobody waits for any more
+		if e.s.remove(id) != nil {
+			_ = e.s.send(AgentMessage{Type: AgentStop, ID: id})
+		}
+		return "", "", context.Cause(ctx)
+	}
+	if res.Error != "" {
+		return res.Stdout, res.Stderr, errors.New(res.Error)
+	}
+	return res.Stdout, res.Stderr, nil
+}
+
+func (e *agentExecutor) Start(input []byte, stderr io.Writer) (Process, error) {
+	id := uuid.NewString()
+	stdout, w := io.Pipe()
+	job := &agentJob{stdout: w, stderr: stderr, exited: make(chan struct{})}
+	if err := e.s.add(id, job); err != nil {
+		return nil, err
+	}
+	if err := e.s.send(AgentMessage{Type: AgentStart, ID: id, Input: string(input)}); err != nil {
+		if e.s.remove(id) != nil {
+			job.finish(err.Error())
+		}
+		return nil, err
+	}
+	return &agentProcess{s: e.s, id: id, job: job, stdout: stdout}, nil
+}
+
+func (e *agentExecutor) Close() error {
+	return nil
+}
+
+// agentProcess is a worker started through an agent
+type agentProcess struct {
+	s      *agentSession
+	id     string
+	job    *agentJob
+	stdout *io.PipeReader
+}
+
+func (p *agentProcess) Output() io.Reader {
+	return p.stdout
+}
+
+func (p *agentProcess) Wait() error {
+	<-p.job.exited
+	return p.job.err
+}
+
+func (p *agentProcess) Stop(timeout time.Duration) {
+	// The agent kills the worker after timeout; allow the same again for the
+	// exit message to arrive before giving up on it
+	if err := p.s.send(AgentMessage{Type: AgentStop, ID: p.id, TimeoutMs: int(timeout / time.Millisecond)}); err == nil {
+		select {
+		case <-p.job.exited:
+			return
+		case <-time.After(2*timeout + time.Second):
+		}
+	}
+	if p.s.remove(p.id) != nil {
+		p.job.finish("")
+	}
+}
@@ -0,0 +1,93 @@
+package orchestrator
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// WorkerArches are the builds the Docker image ships, as <os>/<arch>
+var WorkerArches = []string{"linux/amd64", "linux/arm64", "linux/armv7"}
+
+// ParseUname maps the output of `uname -sm` to a worker arch such as
+// linux/arm64. 32-bit ARM is split by GOARM level: armv6 and armv7.
+func ParseUname(out string) (string, error) {
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("unexpected uname output %q", out)
+	}
+	goos := strings.ToLower(fields[0])
+	machine := strings.ToLower(fields[1])
+	var arch string
+	switch {
+	case machine == "x86_64" || machine == "amd64":
+		arch = "amd64"
+	case machine == "aarch64" || machine == "arm64":
+		arch = "arm64"
+	// armv8l is a 64-bit CPU running a 32-bit userland
+	case strings.HasPrefix(machine, "armv7") || machine == "armv8l":
+		arch = "armv7"
+	case strings.HasPrefix(machine, "armv6"):
+		arch = "armv6"
+	case machine == "i386" || machine == "i486" || machine == "i586" || machine == "i686":
+		arch = "386"
+	default:
+		return "", fmt.Errorf("unsupported machine type %q", fields[1])
+	}
+	return goos + "/" + arch, nil
+}
+
+// ValidateArch checks that arch has the <os>/<arch> form ParseUname returns
+func ValidateArch(arch string) error {
+	// arch ends up in a file name, so only allow plain lowercase words
+	word := func(s string) bool { return s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyz0123456789") == "" }
+	goos, goarch, ok := strings.Cut(arch, "/")
+	if !ok || !word(goos) || !word(goarch) {
+		return fmt.Errorf("invalid arch %q, expected <os>/<arch> such as linux/arm64", arch)
+	}
+	return nil
+}
+
+// HostArch is the arch this binary was built for, in the form ParseUname returns
+func HostArch() string {
+	arch := runtime.GOARCH
+	if arch == "arm" {
+		arch = "armv7"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range info.Settings {
+				if s.Key == "GOARM" {
+					arch = "armv" + strings.TrimSuffix(s.Value, ",softfloat")
+				}
+			}
+		}
+	}
+	return runtime.GOOS + "/" + arch
+}
+
+// workerBinary returns the local worker build for arch: <WorkerBinaryPath>-<os>-<arch>,
+// or WorkerBinaryPath itself when the device matches the server's own arch
+func (o *Orchestrator) workerBinary(arch string) (string, error) {
+	path := o.WorkerBinaryPath + "-" + strings.ReplaceAll(arch, "/", "-")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if arch == HostArch() {
+		if _, err := os.Stat(o.WorkerBinaryPath); err == nil {
+			return o.WorkerBinaryPath, nil
+		}
+	}
+	return "", fmt.Errorf("no worker build for %s, build it with: %s go build -o %s ./cmd/worker",
+		arch, buildEnv(arch), path)
+}
+
+// buildEnv returns the go build environment that targets arch
+func buildEnv(arch string) string {
+	goos, goarch, _ := strings.Cut(arch, "/")
+	env := "CGO_ENABLED=0 GOOS=" + goos
+	if level, ok := strings.CutPrefix(goarch, "armv"); ok {
+		return env + " GOARCH=arm GOARM=" + level
+	}
+	return env + " GOARCH=" + goarch
+}
@@ -0,0 +1,65 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/db"
+)
+
+// DefaultTestTimeout is how long a test between two devices may take on top of
+// its own duration: connecting, deploying, starting the server and the probes
+const DefaultTestTimeout = 2 * time.Minute
+
+// ErrCancelled ends the context of a task that was cancelled or of a queue
+// that was stopped
+var ErrCancelled = errors.New("cancelled")
+
+// TimeoutError ends the context of a test or task that ran out of time. It
+// matches context.DeadlineExceeded with errors.Is.
+type TimeoutError struct {
+	What  string // "test" or "task"
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.What, e.Limit)
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// withTimeout bounds ctx by limit, with a TimeoutError naming what timed out;
+// a zero limit only adds a cancel func
+func withTimeout(ctx context.Context, what string, limit time.Duration) (context.Context, context.CancelFunc) {
+	if limit <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, limit, &TimeoutError{What: what, Limit: limit})
+}
+
+// ErrorClass sorts a test error into one of the db.ErrorClass* classes
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return db.ErrorClassTimeout
+	case errors.Is(err, ErrCancelled), errors.Is(err, context.Canceled):
+		return db.ErrorClassCancelled
+	}
+	return db.ErrorClassError
+}
+
+// abortErr returns why ctx ended, wrapped with what was going on, or err if
+// ctx is still live. Errors caused by the abort itself (a killed worker, a
+// closed connection) aren't worth reporting.
+func abortErr(ctx context.Context, doing string, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s: %w", doing, context.Cause(ctx))
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/user/homelab-speedtest/internal/db"
+)
+
+// AuthMethods builds the SSH auth methods for a device credential. An empty
+// result means the server's default key. The returned func releases
+// resources (the agent connection) once the handshake is done.
+func AuthMethods(cred db.Credential) ([]ssh.AuthMethod, func(), error) {
+	noop := func() {}
+	switch cred.Type {
+	case db.AuthDefault:
+		return nil, noop, nil
+	case db.AuthKeyFile:
+		key, err := os.ReadFile(cred.KeyPath)
+		if err != nil {
+			return nil, noop, fmt.Errorf("failed to read private key: %w", err)
+		}
+		signer, err := parsePrivateKey(key, cred.Passphrase)
+		if err != nil {
+			return nil, noop, fmt.Errorf("failed to parse private key %s: %w", cred.KeyPath, err)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, noop, nil
+	case db.AuthPrivateKey:
+		signer, err := parsePrivateKey([]byte(cred.PrivateKey), cred.Passphrase)
+		if err != nil {
+			return nil, noop, fmt.Errorf("failed to parse stored private key: %w", err)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, noop, nil
+	case db.AuthAgent:
+		socket := cred.AgentSocket
+		if socket == "" {
+			socket = os.Getenv("SSH_AUTH_SOCK")
+		}
+		if socket == "" {
+			return nil, noop, errors.New("no ssh-agent socket configured and SSH_AUTH_SOCK is not set")
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, noop, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+		}
+		client := agent.NewClient(conn)
+		return []ssh.AuthMethod{ssh.PublicKeysCallback(client.Signers)}, func() { _ = conn.Close() }, nil
+	case db.AuthPassword:
+		// Many servers only offer keyboard-interactive for passwords
+		answer := func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = cred.Password
+			}
+			return answers, nil
+		}
+		return []ssh.AuthMethod{ssh.Password(cred.Password), ssh.KeyboardInteractive(answer)}, noop, nil
+	}
+	return nil, noop, fmt.Errorf("unknown auth type %q", cred.Type)
+}
+
+// ValidateCredential rejects credentials missing what their type needs
+func ValidateCredential(cred db.Credential) error {
+	switch cred.Type {
+	case db.AuthDefault, db.AuthAgent:
+	case db.AuthKeyFile:
+		if cred.KeyPath == "" {
+			return errors.New("key_path is required for key_file credentials")
+		}
+	case db.AuthPrivateKey:
+		if cred.PrivateKey == "" {
+			return errors.New("private_key is required for private_key credentials")
+		}
+		if _, err := parsePrivateKey([]byte(cred.PrivateKey), cred.Passphrase); err != nil {
+			return fmt.Errorf("invalid private_key: %w", err)
+		}
+	case db.AuthPassword:
+		if cred.Password == "" {
+			return errors.New("password is required for password credentials")
+		}
+	default:
+		return fmt.Errorf("unknown auth type %q", cred.Type)
+	}
+	return nil
+}
+
+func parsePrivateKey(pem []byte, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+	}
+	return ssh.ParsePrivateKey(pem)
+}
@@ -0,0 +1,286 @@
+package orchestrator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/db"
+)
+
+// workerFileName is the name of the worker binary on devices
+const workerFileName = "hl-speedtest-worker"
+
+// findInstallDir prints the first directory the worker can be executed from,
+// trying /tmp first and falling back for hosts that mount it noexec
+const findInstallDir = `for d in /tmp "$HOME/.cache/hl-speedtest" /var/tmp; do
+	f="$d/.hl-speedtest-exec.$$"
+	if mkdir -p "$d" 2>/dev/null && printf '#!/bin/sh\n' > "$f" 2>/dev/null && chmod 700 "$f" && "$f" 2>/dev/null; then
+		rm -f "$f"; echo "$d"; exit 0
+	fi
+	rm -f "$f" 2>/dev/null
+done
+exit 1`
+
+// legacyWorkerPath is where workers were installed before the install
+// directory became configurable
+const legacyWorkerPath = "/tmp/" + workerFileName
+
+// ValidateInstall checks a device's install_dir and worker_cleanup
+func ValidateInstall(dev db.Device) error {
+	if dev.InstallDir != "" && (!path.IsAbs(dev.InstallDir) || path.Clean(dev.InstallDir) != dev.InstallDir) {
+		return fmt.Errorf("install_dir must be a clean absolute path, got %q", dev.InstallDir)
+	}
+	switch dev.WorkerCleanup {
+	case "", db.CleanupKeep, db.CleanupAfterRun, db.CleanupOnDelete:
+		return nil
+	}
+	return fmt.Errorf("unknown worker_cleanup %q, expected %s, %s or %s",
+		dev.WorkerCleanup, db.CleanupKeep, db.CleanupAfterRun, db.CleanupOnDelete)
+}
+
+// localWorker caches the checksums of the local worker builds until the files change
+type localWorker struct {
+	mu    sync.Mutex
+	files map[string]fileChecksum
+}
+
+type fileChecksum struct {
+	modTime time.Time
+	size    int64
+	sha256  string
+}
+
+// checksum returns the SHA-256 of the binary at path
+func (w *localWorker) checksum(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("worker binary: %w", err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if c, ok := w.files[path]; ok && info.ModTime().Equal(c.modTime) && info.Size() == c.size {
+		return c.sha256, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("worker binary: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("worker binary: %w", err)
+	}
+	if w.files == nil {
+		w.files = make(map[string]fileChecksum)
+	}
+	c := fileChecksum{modTime: info.ModTime(), size: info.Size(), sha256: hex.EncodeToString(h.Sum(nil))}
+	w.files[path] = c
+	return c.sha256, nil
+}
+
+// detectArch asks a device for its OS and machine type
+func detectArch(client *SSHClient) (string, error) {
+	stdout, stderr, err := client.RunCommand("uname -sm")
+	if err != nil {
+		return "", fmt.Errorf("uname failed: %w (stderr: %s)", err, stderr)
+	}
+	return ParseUname(stdout)
+}
+
+// deployWorker makes sure the worker on dev is byte-identical to the local
+// build for its arch, replacing it atomically when its checksum differs, and
+// returns its remote path. The arch recorded on the device is trusted until
+// the worker fails to install.
+func (o *Orchestrator) deployWorker(client *SSHClient, dev db.Device) (string, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	arch, detected := client.arch, false
+	if arch == "" {
+		arch = dev.Arch
+	}
+	if arch == "" {
+		var err error
+		if arch, err = detectArch(client); err != nil {
+			return "", fmt.Errorf("detecting the arch of %s: %w", dev.Name, err)
+		}
+		detected = true
+	}
+	dest, err := installPath(client, dev)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := o.installWorker(client, dev, arch, dest)
+	if err != nil && !detected {
+		// The device may have been reinstalled on other hardware
+		if current, derr := detectArch(client); derr == nil && current != arch {
+			log.Printf("[Deploy] %s is now %s, not %s", dev.Name, current, arch)
+			arch = current
+			info, err = o.installWorker(client, dev, arch, dest)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if info == nil {
+		return dest, nil
+	}
+
+	client.arch, client.workerPath, client.workerSHA256 = arch, dest, info.SHA256
+	if o.OnWorkerDeployed != nil {
+		o.OnWorkerDeployed(dev, *info)
+	}
+	return dest, nil
+}
+
+// installPath returns where the worker goes on dev: its install_dir, or the
+// first directory that allows executing files. The caller holds client.mu.
+func installPath(client *SSHClient, dev db.Device) (string, error) {
+	if client.workerPath != "" {
+		return client.workerPath, nil
+	}
+	if dev.InstallDir != "" {
+		if _, stderr, err := client.RunCommand("mkdir -p " + shellQuote(dev.InstallDir)); err != nil {
+			return "", fmt.Errorf("creating install_dir %s on %s: %w (stderr: %s)", dev.InstallDir, dev.Name, err, stderr)
+		}
+		return path.Join(dev.InstallDir, workerFileName), nil
+	}
+	dir, _, err := client.RunCommand(findInstallDir)
+	if err != nil || dir == "" {
+		return "", fmt.Errorf("no directory on %s allows executing the worker (tried /tmp, ~/.cache/hl-speedtest, /var/tmp); "+
+			"set install_dir on the device", dev.Name)
+	}
+	if dir != "/tmp" {
+		log.Printf("[Deploy] /tmp on %s doesn't allow executing files, installing the worker in %s", dev.Name, dir)
+	}
+	return path.Join(dir, workerFileName), nil
+}
+
+// installWorker copies the build for arch to dest unless it is already there,
+// then checks that it runs. It returns nil when the build was already verified
+// on this connection. The caller holds client.mu.
+func (o *Orchestrator) installWorker(client *SSHClient, dev db.Device, arch, dest string) (*db.WorkerInfo, error) {
+	binary, err := o.workerBinary(arch)
+	if err != nil {
+		return nil, err
+	}
+	local, err := o.localWorker.checksum(binary)
+	if err != nil {
+		return nil, err
+	}
+	if client.arch == arch && client.workerPath == dest && client.workerSHA256 == local {
+		return nil, nil
+	}
+
+	remote, err := client.FileSHA256(dest)
+	if err != nil {
+		log.Printf("[Deploy] Can't checksum the worker on %s, redeploying: %v", dev.Name, err)
+	}
+	if remote != local {
+		if remote == "" {
+			log.Printf("[Deploy] Installing %s worker %.12s on %s at %s", arch, local, dev.Name, dest)
+		} else {
+			log.Printf("[Deploy] Worker on %s is %.12s, replacing it with %s build %.12s", dev.Name, remote, arch, local)
+		}
+		if err := client.CopyFile(binary, dest, 0755); err != nil {
+			return nil, err
+		}
+		if remote, err = client.FileSHA256(dest); err == nil && remote != local {
+			return nil, fmt.Errorf("worker checksum mismatch after copy: got %s, want %s", remote, local)
+		}
+	}
+
+	stdout, stderr, err := client.RunCommand(shellQuote(dest) + " -version")
+	if err != nil {
+		return nil, fmt.Errorf("%s worker doesn't run on %s: %w (stderr: %s)", arch, dev.Name, err, stderr)
+	}
+	version, err := parseWorkerVersion(stdout)
+	if err != nil {
+		return nil, fmt.Errorf("%w; rebuild the server's worker binary %s", err, binary)
+	}
+	return &db.WorkerInfo{Arch: arch, Path: dest, Version: version, SHA256: local}, nil
+}
+
+// useWorker marks the worker on client as used by a test until the returned
+// func is called. With the after_run cleanup policy the last test to finish
+// removes it.
+func (o *Orchestrator) useWorker(client *SSHClient, dev db.Device) func() {
+	client.mu.Lock()
+	client.workerUsers++
+	client.mu.Unlock()
+	return func() {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		client.workerUsers--
+		if client.workerUsers == 0 && dev.WorkerCleanup == db.CleanupAfterRun {
+			if err := o.removeWorker(client, dev); err != nil {
+				log.Printf("[Deploy] Failed to remove the worker from %s: %v", dev.Name, err)
+			}
+		}
+	}
+}
+
+// RemoveWorker uninstalls the worker from dev
+func (o *Orchestrator) RemoveWorker(dev db.Device) error {
+	if dev.Transport == db.TransportLocal {
+		return errors.New("local devices run the server's own worker binary, there is nothing to uninstall")
+	}
+	if dev.Transport == db.TransportAgent {
+		return errors.New("agents are installed by hand, uninstall the agent on the device itself")
+	}
+	client, release, err := o.Pool.Get(dev)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", dev.Name, err)
+	}
+	defer release()
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return o.removeWorker(client, dev)
+}
+
+// removeWorker deletes every copy of the worker the server knows of on dev.
+// The caller holds client.mu.
+func (o *Orchestrator) removeWorker(client *SSHClient, dev db.Device) error {
+	var args []string
+	seen := map[string]bool{}
+	for _, p := range []string{client.workerPath, dev.WorkerPath, legacyWorkerPath} {
+		if p != "" && !seen[p] {
+			seen[p] = true
+			args = append(args, shellQuote(p), shellQuote(p+".partial"))
+		}
+	}
+	if _, stderr, err := client.RunCommand("rm -f " + strings.Join(args, " ")); err != nil {
+		return fmt.Errorf("%w (stderr: %s)", err, stderr)
+	}
+	client.workerPath, client.workerSHA256 = "", ""
+	log.Printf("[Deploy] Removed the worker from %s", dev.Name)
+	if o.OnWorkerRemoved != nil {
+		o.OnWorkerRemoved(dev)
+	}
+	return nil
+}
+
+// parseWorkerVersion reads the output of worker -version and checks the protocol
+func parseWorkerVersion(out string) (string, error) {
+	var version string
+	var protocol int
+	if _, err := fmt.Sscanf(out, "hl-speedtest-worker %s (protocol %d)", &version, &protocol); err != nil {
+		return "", fmt.Errorf("%w: unexpected version output %q", ErrIncompatibleWorker, out)
+	}
+	if protocol != ProtocolVersion {
+		return "", fmt.Errorf("%w: worker %s speaks protocol version %d, expected %d",
+			ErrIncompatibleWorker, version, protocol, ProtocolVersion)
+	}
+	return version, nil
+}
@@ -0,0 +1,156 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/db"
+)
+
+// Executor runs the worker on one device over some transport
+type Executor interface {
+	// Deploy makes sure the worker is installed and speaks our protocol
+	Deploy(ctx context.Context) error
+	// Run runs the worker with input on its stdin and waits for it to exit.
+	// The worker is killed when ctx ends first.
+	Run(ctx context.Context, input []byte) (stdout, stderr string, err error)
+	// Start starts the worker in the background with input written to its
+	// stdin, which stays open until the process is stopped
+	Start(input []byte, stderr io.Writer) (Process, error)
+	// Close releases the transport
+	Close() error
+}
+
+// Process is a worker started with Executor.Start
+type Process interface {
+	// Output is the worker's stdout; the caller must keep reading it
+	Output() io.Reader
+	// Wait waits for the worker to exit and returns why it failed, if it did
+	Wait() error
+	// Stop closes the worker's stdin and kills it if it hasn't exited after timeout
+	Stop(timeout time.Duration)
+}
+
+// executor opens the transport the device is configured for
+func (o *Orchestrator) executor(dev db.Device) (Executor, error) {
+	if o.NewExecutor != nil {
+		return o.NewExecutor(dev)
+	}
+	switch dev.Transport {
+	case "", db.TransportSSH:
+		e, err := o.sshExecutor(dev)
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	case db.TransportLocal:
+		return &localExecutor{o: o, dev: dev}, nil
+	case db.TransportAgent:
+		e, err := o.agentExecutor(dev)
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", dev.Transport)
+}
+
+// ValidateTransport rejects unknown device transports
+func ValidateTransport(transport string) error {
+	switch transport {
+	case "", db.TransportSSH, db.TransportLocal, db.TransportAgent:
+		return nil
+	}
+	return fmt.Errorf("unknown transport %q, expected ssh, local or agent", transport)
+}
+
+// sshExecutor runs the worker on a device over a pooled SSH connection
+type sshExecutor struct {
+	o       *Orchestrator
+	dev     db.Device
+	client  *SSHClient
+	release func()
+	path    string // remote worker path, set by Deploy
+}
+
+func (o *Orchestrator) sshExecutor(dev db.Device) (*sshExecutor, error) {
+	client, release, err := o.Pool.Get(dev)
+	if err != nil {
+		return nil, err
+	}
+	doneUsing := o.useWorker(client, dev)
+	return &sshExecutor{o: o, dev: dev, client: client, release: func() {
+		doneUsing()
+		release()
+	}}, nil
+}
+
+func (e *sshExecutor) Deploy(ctx context.Context) error {
+	// SSH commands can't be interrupted one by one; closing the connection
+	// fails them all, and the pool reconnects next time
+	stop := context.AfterFunc(ctx, func() {
+		e.o.Pool.Evict(e.dev.ID)
+		_ = e.client.Close()
+	})
+	defer stop()
+	path, err := e.o.deployWorker(e.client, e.dev)
+	e.path = path
+	return abortErr(ctx, "deploying the worker", err)
+}
+
+func (e *sshExecutor) Run(ctx context.Context, input []byte) (string, string, error) {
+	return runToExit(ctx, e, input)
+}
+
+func (e *sshExecutor) Start(input []byte, stderr io.Writer) (Process, error) {
+	proc, err := e.client.StartCommand(shellQuote(e.path)+" -stdin", stderr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := proc.Stdin.Write(input); err != nil {
+		proc.Stop(0)
+		return nil, err
+	}
+	return proc, nil
+}
+
+func (e *sshExecutor) Close() error {
+	e.release()
+	return nil
+}
+
+// runToExit runs the worker as a started process and waits for it to exit,
+// stopping it when ctx ends first. Requests should set HoldStdin, so the
+// worker exits even when the transport can't deliver a kill.
+func runToExit(ctx context.Context, e Executor, input []byte) (string, string, error) {
+	stderr := &lockedBuffer{}
+	proc, err := e.Start(input, stderr)
+	if err != nil {
+		return "", "", err
+	}
+	var stdout []byte
+	exited := make(chan error, 1)
+	go func() {
+		stdout, _ = io.ReadAll(proc.Output())
+		exited <- proc.Wait()
+	}()
+
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		proc.Stop(0)
+		<-exited
+		err = context.Cause(ctx)
+	}
+	// Stopping an exited worker only releases its session
+	proc.Stop(0)
+	return cleanOutput(stdout), cleanOutput([]byte(stderr.String())), err
+}
+
+// cleanOutput trims worker output and drops the NUL bytes some shells emit
+func cleanOutput(b []byte) string {
+	return string(bytes.TrimSpace(bytes.ReplaceAll(b, []byte{0}, nil)))
+}
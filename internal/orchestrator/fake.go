@@ -0,0 +1,163 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// FakeExecutor is an in-memory Executor for tests. It records the requests
+// sent to it, answers server requests with a ready line and everything else
+// with Respond.
+type FakeExecutor struct {
+	// DeployErr is returned by Deploy
+	DeployErr error
+	// ServerPort is reported as bound by servers; 0 reports the requested port
+	ServerPort int
+	// Respond answers a non-server request; nil answers with a successful, empty result
+	Respond func(req WorkerRequest) (WorkerResponse, error)
+	// Delay holds every Run this long, or until its context ends
+	Delay time.Duration
+
+	mu       sync.Mutex
+	deploys  int
+	requests []WorkerRequest
+	running  int
+	closed   bool
+}
+
+// Deploys returns how often Deploy was called
+func (f *FakeExecutor) Deploys() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.deploys
+}
+
+// Requests returns the requests received so far
+func (f *FakeExecutor) Requests() []WorkerRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]WorkerRequest(nil), f.requests...)
+}
+
+// Running returns how many started processes haven't been stopped
+func (f *FakeExecutor) Running() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.running
+}
+
+// Closed reports whether Close was called
+func (f *FakeExecutor) Closed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *FakeExecutor) Deploy(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deploys++
+	return f.DeployErr
+}
+
+func (f *FakeExecutor) record(input []byte) (WorkerRequest, error) {
+	var req WorkerRequest
+	if err := json.Unmarshal(input, &req); err != nil {
+		return req, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	return req, nil
+}
+
+func (f *FakeExecutor) Run(ctx context.Context, input []byte) (string, string, error) {
+	req, err := f.record(input)
+	if err != nil {
+		return "", err.Error(), err
+	}
+	if f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-ctx.Done():
+			return "", "", context.Cause(ctx)
+		}
+	}
+	resp := WorkerResponse{Success: true}
+	if f.Respond != nil {
+		if resp, err = f.Respond(req); err != nil {
+			return "", err.Error(), err
+		}
+	}
+	now := time.Now()
+	out, err := json.Marshal(WorkerEnvelope{
+		ProtocolVersion: ProtocolVersion,
+		WorkerVersion:   "fake",
+		Hostname:        "fake",
+		StartedAt:       now,
+		FinishedAt:      now,
+		Response:        resp,
+	})
+	return string(out), "", err
+}
+
+func (f *FakeExecutor) Start(input []byte, stderr io.Writer) (Process, error) {
+	req, err := f.record(input)
+	if err != nil {
+		return nil, err
+	}
+	if req.Mode != ModeServer {
+		return nil, errors.New("the fake executor only starts servers")
+	}
+	port := f.ServerPort
+	if port == 0 {
+		port = req.Port
+	}
+	ready, _ := json.Marshal(ServerReady{Ready: true, Port: port, ProtocolVersion: ProtocolVersion, WorkerVersion: "fake"})
+
+	r, w := io.Pipe()
+	go func() { _, _ = w.Write(append(ready, '\n')) }()
+	f.mu.Lock()
+	f.running++
+	f.mu.Unlock()
+	return &fakeProcess{f: f, stdout: r, w: w, stopped: make(chan struct{})}, nil
+}
+
+func (f *FakeExecutor) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// fakeProcess is a server started by FakeExecutor; it runs until stopped
+type fakeProcess struct {
+	f       *FakeExecutor
+	stdout  *io.PipeReader
+	w       *io.PipeWriter
+	once    sync.Once
+	stopped chan struct{}
+}
+
+func (p *fakeProcess) Output() io.Reader {
+	return p.stdout
+}
+
+func (p *fakeProcess) Wait() error {
+	<-p.stopped
+	return nil
+}
+
+func (p *fakeProcess) Stop(timeout time.Duration) {
+	p.once.Do(func() {
+		_ = p.w.Close()
+		close(p.stopped)
+		p.f.mu.Lock()
+		p.f.running--
+		p.f.mu.Unlock()
+	})
+}
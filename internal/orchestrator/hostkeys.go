@@ -0,0 +1,106 @@
+package orchestrator
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/user/homelab-speedtest/internal/db"
+)
+
+// HostKeyMismatchError means a device presented a different SSH host key than
+// the one pinned for it or listed in known_hosts
+type HostKeyMismatchError struct {
+	Device    string
+	Address   string
+	Expected  string // fingerprint of the trusted key
+	Presented string // fingerprint of the key the host sent
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s (%s): expected %s, got %s; "+
+		"if the host was reinstalled, reset its key with DELETE /api/devices/{id}/hostkey",
+		e.Device, e.Address, e.Expected, e.Presented)
+}
+
+// HostKeyStore verifies SSH host keys: known_hosts files are consulted first,
+// hosts they don't list are pinned in the database on first use
+type HostKeyStore struct {
+	db         *db.DB
+	knownHosts ssh.HostKeyCallback
+}
+
+// NewHostKeyStore pins keys in d. knownHostsFiles may be empty.
+func NewHostKeyStore(d *db.DB, knownHostsFiles ...string) (*HostKeyStore, error) {
+	s := &HostKeyStore{db: d}
+	if len(knownHostsFiles) > 0 {
+		cb, err := knownhosts.New(knownHostsFiles...)
+		if err != nil {
+			return nil, fmt.Errorf("loading known_hosts: %w", err)
+		}
+		s.knownHosts = cb
+	}
+	return s, nil
+}
+
+// Callback returns the host key check for connections to dev
+func (s *HostKeyStore) Callback(dev db.Device) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		presented := db.HostKey{
+			DeviceID:    dev.ID,
+			KeyType:     key.Type(),
+			PublicKey:   base64.StdEncoding.EncodeToString(key.Marshal()),
+			Fingerprint: ssh.FingerprintSHA256(key),
+		}
+
+		if s.knownHosts != nil {
+			err := s.knownHosts(hostname, remote, key)
+			var keyErr *knownhosts.KeyError
+			switch {
+			case err == nil:
+				// known_hosts is authoritative; keep the pin in step with it
+				return s.db.SetHostKey(presented)
+			case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+				for _, want := range keyErr.Want {
+					// A listed key of another type only means the server picked a different algorithm
+					if want.Key.Type() == key.Type() {
+						return &HostKeyMismatchError{Device: dev.Name, Address: hostname,
+							Expected: ssh.FingerprintSHA256(want.Key), Presented: presented.Fingerprint}
+					}
+				}
+			case !errors.As(err, &keyErr):
+				return err
+			}
+		}
+
+		pinned, created, err := s.db.PinHostKey(presented)
+		if err != nil {
+			return fmt.Errorf("pinning host key: %w", err)
+		}
+		if pinned.PublicKey != presented.PublicKey {
+			return &HostKeyMismatchError{Device: dev.Name, Address: hostname,
+				Expected: pinned.Fingerprint, Presented: presented.Fingerprint}
+		}
+		if created {
+			log.Printf("[SSH] Pinned %s host key %s for %s on first use", pinned.KeyType, pinned.Fingerprint, dev.Name)
+		}
+		return nil
+	}
+}
+
+// JumpHostCallback verifies jump hosts that aren't devices. They have no pin
+// of their own, so they must be listed in known_hosts.
+func (s *HostKeyStore) JumpHostCallback() ssh.HostKeyCallback {
+	if s.knownHosts != nil {
+		return s.knownHosts
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return fmt.Errorf("can't verify jump host %s (%s): list it in SSH_KNOWN_HOSTS or add it as a device",
+			hostname, ssh.FingerprintSHA256(key))
+	}
+}
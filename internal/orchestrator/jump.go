@@ -0,0 +1,161 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/user/homelab-speedtest/internal/db"
+)
+
+// maxJumps bounds a chain of jump devices, which also stops loops
+const maxJumps = 8
+
+// JumpHost is one hop of a device's jump_host list
+type JumpHost struct {
+	User string
+	Host string
+	Port int
+}
+
+// ParseJumpHosts parses a comma-separated [user@]host[:port] list, like ssh -J.
+// Hops without a user log in as defaultUser, hops without a port use 22.
+func ParseJumpHosts(s, defaultUser string) ([]JumpHost, error) {
+	var hops []JumpHost
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		hop := JumpHost{User: defaultUser, Port: 22}
+		if user, rest, ok := strings.Cut(spec, "@"); ok {
+			hop.User, spec = user, rest
+		}
+		hop.Host = spec
+		// A bare IPv6 address has several colons; a port needs [brackets]
+		if strings.HasPrefix(spec, "[") || strings.Count(spec, ":") == 1 {
+			host, port, err := net.SplitHostPort(spec)
+			if err != nil {
+				return nil, fmt.Errorf("invalid jump host %q: %w", spec, err)
+			}
+			p, err := strconv.Atoi(port)
+			if err != nil || p < 1 || p > 65535 {
+				return nil, fmt.Errorf("invalid port in jump host %q", spec)
+			}
+			hop.Host, hop.Port = host, p
+		}
+		if hop.Host == "" || hop.User == "" {
+			return nil, fmt.Errorf("invalid jump host %q, expected [user@]host[:port]", spec)
+		}
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// ValidateJump checks a device's jump settings, resolving jump devices with lookup
+func ValidateJump(dev db.Device, lookup func(id int) (*db.Device, error)) error {
+	if dev.JumpDeviceID != 0 && dev.JumpHost != "" {
+		return errors.New("set either jump_device_id or jump_host, not both")
+	}
+	if dev.JumpHost != "" {
+		_, err := ParseJumpHosts(dev.JumpHost, dev.SSHUser)
+		return err
+	}
+	_, err := jumpChain(dev, lookup)
+	return err
+}
+
+// jumpChain returns the jump devices dev is reached through, the one the
+// server connects to first
+func jumpChain(dev db.Device, lookup func(id int) (*db.Device, error)) ([]db.Device, error) {
+	var chain []db.Device
+	seen := map[int]bool{dev.ID: true}
+	for id := dev.JumpDeviceID; id != 0; {
+		if seen[id] {
+			return nil, fmt.Errorf("the jump devices of %s form a loop", dev.Name)
+		}
+		if len(chain) == maxJumps {
+			return nil, fmt.Errorf("%s is more than %d jumps away", dev.Name, maxJumps)
+		}
+		seen[id] = true
+		jump, err := lookup(id)
+		if err != nil {
+			return nil, err
+		}
+		if jump == nil {
+			return nil, fmt.Errorf("jump device %d of %s doesn't exist", id, dev.Name)
+		}
+		if jump.Transport == db.TransportLocal || jump.Transport == db.TransportAgent {
+			return nil, fmt.Errorf("%s isn't reached over SSH, so it can't be a jump device", jump.Name)
+		}
+		chain = append([]db.Device{*jump}, chain...)
+		id = jump.JumpDeviceID
+	}
+	return chain, nil
+}
+
+// jumpDevices returns the jump devices dev is tunnelled through, if any
+func (o *Orchestrator) jumpDevices(dev db.Device) ([]db.Device, error) {
+	if dev.JumpDeviceID == 0 || o.LookupDevice == nil {
+		return nil, nil
+	}
+	return jumpChain(dev, o.LookupDevice)
+}
+
+// dialJump connects to the host dev is reached through: the pooled connection
+// of its jump device, or a fresh chain through its jump hosts. The client is
+// nil for devices reached directly; the returned func releases it.
+func (o *Orchestrator) dialJump(dev db.Device) (*SSHClient, func(), error) {
+	noop := func() {}
+	switch {
+	case dev.JumpDeviceID != 0:
+		if o.LookupDevice == nil {
+			return nil, noop, errors.New("jump devices need Orchestrator.LookupDevice")
+		}
+		chain, err := jumpChain(dev, o.LookupDevice)
+		if err != nil {
+			return nil, noop, err
+		}
+		// The jump device connects through the rest of the chain itself
+		via := chain[len(chain)-1]
+		client, release, err := o.Pool.Get(via)
+		if err != nil {
+			return nil, noop, fmt.Errorf("failed to connect to jump device %s: %w", via.Name, err)
+		}
+		return client, release, nil
+
+	case dev.JumpHost != "":
+		hops, err := ParseJumpHosts(dev.JumpHost, dev.SSHUser)
+		if err != nil {
+			return nil, noop, err
+		}
+		var hostKeyCallback ssh.HostKeyCallback
+		if o.HostKeys != nil {
+			hostKeyCallback = o.HostKeys.JumpHostCallback()
+		}
+		var jump *SSHClient
+		for _, hop := range hops {
+			// Jump hosts accept the device's own credential, as with ssh -J
+			auth, release, err := AuthMethods(dev.Credential)
+			if err != nil {
+				return nil, noop, err
+			}
+			next, err := ConnectSSH(hop.User, hop.Host, hop.Port, auth, hostKeyCallback, jump)
+			release()
+			if err != nil {
+				if jump != nil {
+					_ = jump.Close()
+				}
+				return nil, noop, fmt.Errorf("failed to connect to jump host %s: %w", hop.Host, err)
+			}
+			if jump != nil {
+				prev := jump
+				next.closeJump = func() { _ = prev.Close() }
+			}
+			jump = next
+		}
+		return jump, func() { _ = jump.Close() }, nil
+	}
+	return nil, noop, nil
+}
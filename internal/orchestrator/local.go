@@ -0,0 +1,112 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/db"
+)
+
+// localExecutor runs the server's own worker build as a child process, for
+// testing the server host without SSHing to itself
+type localExecutor struct {
+	o    *Orchestrator
+	dev  db.Device
+	path string // set by Deploy
+}
+
+func (e *localExecutor) Deploy(ctx context.Context) error {
+	arch := HostArch()
+	path, err := e.o.workerBinary(arch)
+	if err != nil {
+		return err
+	}
+	sha, err := e.o.localWorker.checksum(path)
+	if err != nil {
+		return err
+	}
+	e.path = path
+	if verified, ok := e.o.localVerified.Load(e.dev.ID); ok && verified == sha {
+		return nil
+	}
+
+	out, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return abortErr(ctx, "deploying the worker", fmt.Errorf("worker %s doesn't run: %w", path, err))
+	}
+	version, err := parseWorkerVersion(string(bytes.TrimSpace(out)))
+	if err != nil {
+		return fmt.Errorf("%w; rebuild the server's worker binary %s", err, path)
+	}
+	e.o.localVerified.Store(e.dev.ID, sha)
+	if e.o.OnWorkerDeployed != nil {
+		e.o.OnWorkerDeployed(e.dev, db.WorkerInfo{Arch: arch, Path: path, Version: version, SHA256: sha})
+	}
+	return nil
+}
+
+func (e *localExecutor) Run(ctx context.Context, input []byte) (string, string, error) {
+	return runToExit(ctx, e, input)
+}
+
+func (e *localExecutor) Start(input []byte, stderr io.Writer) (Process, error) {
+	cmd := exec.Command(e.path, "-stdin")
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// A pipe of our own, unlike StdoutPipe, may be read while Wait runs
+	stdout, stdoutWriter := io.Pipe()
+	cmd.Stdout = stdoutWriter
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	proc := &localProcess{cmd: cmd, stdin: stdin, stdout: stdout, done: make(chan struct{})}
+	go func() {
+		proc.err = cmd.Wait()
+		_ = stdoutWriter.CloseWithError(proc.err)
+		close(proc.done)
+	}()
+	if _, err := stdin.Write(input); err != nil {
+		proc.Stop(0)
+		return nil, err
+	}
+	return proc, nil
+}
+
+func (e *localExecutor) Close() error {
+	return nil
+}
+
+// localProcess is a worker started by localExecutor
+type localProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.Reader
+	done   chan struct{}
+	err    error // exit status, once done
+}
+
+func (p *localProcess) Output() io.Reader {
+	return p.stdout
+}
+
+func (p *localProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+func (p *localProcess) Stop(timeout time.Duration) {
+	_ = p.stdin.Close()
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		_ = p.cmd.Process.Kill()
+		<-p.done
+	}
+}
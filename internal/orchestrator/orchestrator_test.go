@@ -1,7 +1,26 @@
 package orchestrator
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/user/homelab-speedtest/internal/config"
+	"github.com/user/homelab-speedtest/internal/db"
 )
 
 func TestNewOrchestrator(t *testing.T) {
@@ -12,8 +31,8 @@ func TestNewOrchestrator(t *testing.T) {
 	if orch.WorkerBinaryPath != "/tmp/worker" {
 		t.Errorf("Expected WorkerBinaryPath '/tmp/worker', got '%s'", orch.WorkerBinaryPath)
 	}
-	if orch.WorkerPort != 8090 {
-		t.Errorf("Expected WorkerPort 8090, got %d", orch.WorkerPort)
+	if orch.PortRange != (PortRange{Min: 8090, Max: 8090}) {
+		t.Errorf("Expected PortRange 8090, got %s", orch.PortRange)
 	}
 }
 
@@ -22,8 +41,8 @@ func TestNewOrchestratorDefaultPort(t *testing.T) {
 	if orch == nil {
 		t.Fatal("NewOrchestrator returned nil")
 	}
-	if orch.WorkerPort != 8090 {
-		t.Errorf("Expected default WorkerPort 8090 when 0 is passed, got %d", orch.WorkerPort)
+	if orch.PortRange != (PortRange{Min: 8090, Max: 8090}) {
+		t.Errorf("Expected default PortRange 8090 when 0 is passed, got %s", orch.PortRange)
 	}
 }
 
@@ -54,3 +73,1065 @@ func TestWorkerResponseSerialization(t *testing.T) {
 		t.Errorf("Expected BandwidthMbps 1000.0, got %f", resp.BandwidthMbps)
 	}
 }
+
+func TestSpeedTestOptionsMerge(t *testing.T) {
+	none, two := 0, 2
+	manual := SpeedTestOptions{DurationSeconds: 30}
+	schedule := SpeedTestOptions{DurationSeconds: 5, OmitSeconds: &two, Parallel: 4}
+
+	opts := manual.Merge(schedule).WithDefaults()
+	if opts.DurationSeconds != 30 {
+		t.Errorf("Expected manual duration 30, got %d", opts.DurationSeconds)
+	}
+	if opts.Omit() != 2 || opts.Parallel != 4 {
+		t.Errorf("Expected schedule omit 2 and parallel 4, got %d and %d", opts.Omit(), opts.Parallel)
+	}
+	if opts.BufferSize != DefaultBufferSize || opts.Direction != DirectionForward {
+		t.Errorf("Expected default buffer and direction, got %d and %q", opts.BufferSize, opts.Direction)
+	}
+
+	// An explicit zero turns the schedule's warm-up off
+	manual.OmitSeconds = &none
+	if opts := manual.Merge(schedule).WithDefaults(); opts.OmitSeconds == nil || opts.Omit() != 0 {
+		t.Errorf("Expected the manual omit 0 to win, got %v", opts.OmitSeconds)
+	}
+}
+
+func TestSpeedTestOptionsValidate(t *testing.T) {
+	three, negative := 3, -1
+	valid := SpeedTestOptions{Direction: DirectionBidir, DurationSeconds: 60, BufferSize: 128 * 1024, OmitSeconds: &three}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected valid options, got %v", err)
+	}
+	for _, bad := range []SpeedTestOptions{
+		{Direction: "sideways"},
+		{DurationSeconds: 301},
+		{BufferSize: 100},
+		{OmitSeconds: &negative},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestBufferbloatGrade(t *testing.T) {
+	cases := map[float64]string{0: "A+", 4.9: "A+", 5: "A", 45: "B", 150: "C", 399: "D", 400: "F"}
+	for increase, want := range cases {
+		if got := BufferbloatGrade(increase); got != want {
+			t.Errorf("BufferbloatGrade(%v) = %s, want %s", increase, got, want)
+		}
+	}
+}
+
+func TestParseWorkerOutput(t *testing.T) {
+	ports := PortRange{Min: 8090, Max: 8090}
+
+	resp, err := parseWorkerOutput(`{"protocol_version":1,"worker_version":"1.2.0","hostname":"nas","response":{"success":true,"latency_ms":0.4}}`, "", ports)
+	if err != nil {
+		t.Fatalf("Expected envelope to parse, got %v", err)
+	}
+	if resp.LatencyMs != 0.4 {
+		t.Errorf("Expected latency 0.4, got %v", resp.LatencyMs)
+	}
+
+	// Log lines before the envelope are ignored
+	resp, err = parseWorkerOutput("warming up {sic}\n"+`{"protocol_version":1,"response":{"success":false,"error":"boom"}}`, "", ports)
+	if err == nil || resp == nil || resp.Error != "boom" {
+		t.Errorf("Expected worker failure with response, got %+v, %v", resp, err)
+	}
+
+	for name, stdout := range map[string]string{
+		"legacy":  `{"success":true,"latency_ms":0.4}`,
+		"version": `{"protocol_version":99,"worker_version":"9.0.0","hostname":"nas","response":{"success":true}}`,
+	} {
+		if _, err := parseWorkerOutput(stdout, "", ports); !errors.Is(err, ErrIncompatibleWorker) {
+			t.Errorf("%s: expected ErrIncompatibleWorker, got %v", name, err)
+		}
+	}
+}
+
+func TestWaitForReady(t *testing.T) {
+	out := strings.NewReader("starting\n" + `{"ready":true,"port":40123,"protocol_version":1,"worker_version":"dev"}` + "\n")
+	ready, err := waitForReady(context.Background(), out, time.Second)
+	if err != nil {
+		t.Fatalf("Expected ready line, got %v", err)
+	}
+	if ready.Port != 40123 {
+		t.Errorf("Expected port 40123, got %d", ready.Port)
+	}
+
+	if _, err := waitForReady(context.Background(), strings.NewReader("listen tcp :8090: address already in use\n"), time.Second); err == nil {
+		t.Error("Expected an error when the server exits without a ready line")
+	}
+
+	pr, pw := io.Pipe()
+	defer func() { _ = pw.Close() }()
+	start := time.Now()
+	if _, err := waitForReady(context.Background(), pr, 50*time.Millisecond); err == nil {
+		t.Error("Expected a timeout while the server stays silent")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Expected the timeout to be honored, waited %v", time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(ErrCancelled)
+	if _, err := waitForReady(ctx, pr, time.Minute); !errors.Is(err, ErrCancelled) {
+		t.Errorf("Expected the wait to end with the context, got %v", err)
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	cases := map[string]PortRange{
+		"8090":      {Min: 8090, Max: 8090},
+		"8090-8099": {Min: 8090, Max: 8099},
+		"0":         {},
+		"ephemeral": {},
+	}
+	for in, want := range cases {
+		got, err := ParsePortRange(in)
+		if err != nil || got != want {
+			t.Errorf("ParsePortRange(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "abc", "8099-8090", "0-10", "65535-65536"} {
+		if _, err := ParsePortRange(in); err == nil {
+			t.Errorf("ParsePortRange(%q): expected an error", in)
+		}
+	}
+}
+
+func TestEnhanceErrorMessagePortRange(t *testing.T) {
+	msg := enhanceErrorMessage("dial tcp: connect: no route to host", "", PortRange{Min: 8090, Max: 8099})
+	for _, want := range []string{"ports 8090-8099", "--dport 8090:8099", "--add-port=8090-8099/tcp", "ufw allow 8090:8099/tcp"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Expected hint to contain %q, got %s", want, msg)
+		}
+	}
+
+	msg = enhanceErrorMessage("connection refused", "", PortRange{})
+	if !strings.Contains(msg, "an ephemeral port") {
+		t.Errorf("Expected hint to mention the ephemeral port, got %s", msg)
+	}
+}
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyStore(t *testing.T) {
+	tmpDir := t.TempDir()
+	database, err := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	store, err := NewHostKeyStore(database)
+	if err != nil {
+		t.Fatalf("NewHostKeyStore failed: %v", err)
+	}
+	dev := db.Device{ID: 1, Name: "nas"}
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	original, other := newHostKey(t), newHostKey(t)
+
+	check := store.Callback(dev)
+	if err := check("nas:22", addr, original); err != nil {
+		t.Fatalf("Expected the first key to be pinned, got %v", err)
+	}
+	if err := check("nas:22", addr, original); err != nil {
+		t.Errorf("Expected the pinned key to be accepted, got %v", err)
+	}
+	var mismatch *HostKeyMismatchError
+	if err := check("nas:22", addr, other); !errors.As(err, &mismatch) {
+		t.Fatalf("Expected HostKeyMismatchError, got %v", err)
+	}
+	if mismatch.Expected != ssh.FingerprintSHA256(original) || mismatch.Presented != ssh.FingerprintSHA256(other) {
+		t.Errorf("Unexpected fingerprints in %v", mismatch)
+	}
+
+	// Resetting the pin trusts the next key
+	_ = database.DeleteHostKey(dev.ID)
+	if err := check("nas:22", addr, other); err != nil {
+		t.Errorf("Expected a new key to be pinned after reset, got %v", err)
+	}
+
+	// known_hosts overrides the pin
+	knownHostsFile := filepath.Join(tmpDir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("nas:22")}, original)
+	if err := os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewHostKeyStore(database, knownHostsFile)
+	if err != nil {
+		t.Fatalf("NewHostKeyStore failed: %v", err)
+	}
+	check = store.Callback(dev)
+	if err := check("nas:22", addr, original); err != nil {
+		t.Errorf("Expected the known_hosts key to be accepted, got %v", err)
+	}
+	if err := check("nas:22", addr, other); !errors.As(err, &mismatch) {
+		t.Errorf("Expected HostKeyMismatchError against known_hosts, got %v", err)
+	}
+	if err := store.Callback(db.Device{ID: 2, Name: "nuc"})("nuc:22", addr, other); err != nil {
+		t.Errorf("Expected hosts missing from known_hosts to be pinned, got %v", err)
+	}
+}
+
+func TestAuthMethods(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := string(pem.EncodeToMemory(block))
+
+	valid := []db.Credential{
+		{},
+		{Type: db.AuthPassword, Password: "hunter2"},
+		{Type: db.AuthPrivateKey, PrivateKey: encrypted, Passphrase: "secret"},
+	}
+	for _, cred := range valid {
+		if err := ValidateCredential(cred); err != nil {
+			t.Errorf("%s: unexpected validation error %v", cred.Type, err)
+		}
+		if _, release, err := AuthMethods(cred); err != nil {
+			t.Errorf("%s: unexpected error %v", cred.Type, err)
+		} else {
+			release()
+		}
+	}
+
+	invalid := []db.Credential{
+		{Type: "kerberos"},
+		{Type: db.AuthKeyFile},
+		{Type: db.AuthPassword},
+		{Type: db.AuthPrivateKey, PrivateKey: encrypted, Passphrase: "wrong"},
+	}
+	for _, cred := range invalid {
+		if err := ValidateCredential(cred); err == nil {
+			t.Errorf("%+v: expected a validation error", cred)
+		}
+	}
+
+	if _, _, err := AuthMethods(db.Credential{Type: db.AuthKeyFile, KeyPath: "/nonexistent/id_ed25519"}); err == nil {
+		t.Error("Expected an error for a missing key file")
+	}
+}
+
+// startTestSSHServer accepts any client and answers global requests. It
+// returns the port and a counter of accepted connections.
+func startTestSSHServer(t *testing.T) (int, *atomic.Int32) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for ch := range chans {
+					if ch.ChannelType() == "direct-tcpip" {
+						go forwardChannel(ch)
+						continue
+					}
+					_ = ch.Reject(ssh.Prohibited, "no sessions")
+				}
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, &accepted
+}
+
+// forwardChannel serves a jump host's direct-tcpip channel
+func forwardChannel(newCh ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newCh.ExtraData(), &target); err != nil {
+		_ = newCh.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+	if err != nil {
+		_ = newCh.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		_, _ = io.Copy(ch, conn)
+		_ = ch.CloseWrite()
+	}()
+	_, _ = io.Copy(conn, ch)
+	_ = conn.Close()
+}
+
+func TestSSHPool(t *testing.T) {
+	port, accepted := startTestSSHServer(t)
+	dial := func(dev db.Device) (*SSHClient, error) {
+		return ConnectSSH(dev.SSHUser, dev.Hostname, dev.SSHPort, []ssh.AuthMethod{ssh.Password("x")}, nil, nil)
+	}
+	pool := NewSSHPool(dial, time.Minute)
+	defer pool.Close()
+
+	dev := db.Device{ID: 1, Name: "nas", Hostname: "127.0.0.1", SSHUser: "u", SSHPort: port}
+	first, release, err := pool.Get(dev)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	release()
+	second, release, err := pool.Get(dev)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	release()
+	if first != second || accepted.Load() != 1 {
+		t.Errorf("Expected the connection to be reused, got %d connections", accepted.Load())
+	}
+
+	// A dead connection is replaced
+	_ = second.client.Close()
+	third, release, err := pool.Get(dev)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	release()
+	if third == second || accepted.Load() != 2 {
+		t.Errorf("Expected a reconnect after the connection died, got %d connections", accepted.Load())
+	}
+
+	// Changed settings reconnect
+	dev.SSHUser = "other"
+	fourth, release, err := pool.Get(dev)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	release()
+	if fourth == third || accepted.Load() != 3 {
+		t.Errorf("Expected a reconnect after the settings changed, got %d connections", accepted.Load())
+	}
+
+	// Idle connections are closed after the TTL
+	pool.closeIdle(time.Now().Add(2 * time.Minute))
+	deadline := time.Now().Add(time.Second)
+	for fourth.Alive(100*time.Millisecond) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fourth.Alive(100 * time.Millisecond) {
+		t.Error("Expected the idle connection to be closed")
+	}
+}
+
+func TestParseWorkerVersion(t *testing.T) {
+	version, err := parseWorkerVersion("hl-speedtest-worker 1.4.0 (protocol 1)")
+	if err != nil || version != "1.4.0" {
+		t.Errorf("Expected version 1.4.0, got %q, %v", version, err)
+	}
+	for _, out := range []string{"flag provided but not defined: -version", "hl-speedtest-worker 9.0.0 (protocol 99)"} {
+		if _, err := parseWorkerVersion(out); !errors.Is(err, ErrIncompatibleWorker) {
+			t.Errorf("%q: expected ErrIncompatibleWorker, got %v", out, err)
+		}
+	}
+}
+
+func TestLocalWorkerChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "worker")
+	_ = os.WriteFile(path, []byte("v1"), 0755)
+
+	var w localWorker
+	first, err := w.checksum(path)
+	if err != nil {
+		t.Fatalf("checksum failed: %v", err)
+	}
+	if first != "3bfc269594ef649228e9a74bab00f042efc91d5acc6fbee31a382e80d42388fe" {
+		t.Errorf("Unexpected checksum %s", first)
+	}
+
+	// A rebuilt binary is picked up
+	_ = os.WriteFile(path, []byte("v2.0"), 0755)
+	_ = os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	if second, _ := w.checksum(path); second == first {
+		t.Error("Expected a new checksum after the binary changed")
+	}
+}
+
+func TestParseUname(t *testing.T) {
+	cases := map[string]string{
+		"Linux x86_64\n":  "linux/amd64",
+		"Linux aarch64\n": "linux/arm64",
+		"Linux armv7l\n":  "linux/armv7",
+		"Linux armv8l\n":  "linux/armv7",
+		"Linux armv6l\n":  "linux/armv6",
+		"Linux i686\n":    "linux/386",
+		"Darwin arm64\n":  "darwin/arm64",
+		"FreeBSD amd64\n": "freebsd/amd64",
+	}
+	for out, want := range cases {
+		if got, err := ParseUname(out); err != nil || got != want {
+			t.Errorf("%q: expected %s, got %q, %v", out, want, got, err)
+		}
+	}
+	for _, out := range []string{"", "Linux", "Linux mips\n"} {
+		if _, err := ParseUname(out); err == nil {
+			t.Errorf("%q: expected an error", out)
+		}
+	}
+}
+
+func TestValidateArch(t *testing.T) {
+	for _, arch := range []string{"linux/amd64", "linux/armv7"} {
+		if err := ValidateArch(arch); err != nil {
+			t.Errorf("%s: unexpected error %v", arch, err)
+		}
+	}
+	for _, arch := range []string{"linux", "linux/", "/arm64", "linux/../x", "Linux/arm64", "linux/arm64/v8"} {
+		if err := ValidateArch(arch); err == nil {
+			t.Errorf("%s: expected an error", arch)
+		}
+	}
+}
+
+func TestWorkerBinary(t *testing.T) {
+	dir := t.TempDir()
+	orch := NewOrchestrator(filepath.Join(dir, "worker"), 0)
+
+	if _, err := orch.workerBinary("linux/armv7"); err == nil ||
+		!strings.Contains(err.Error(), "GOARCH=arm GOARM=7 go build -o "+filepath.Join(dir, "worker-linux-armv7")) {
+		t.Errorf("Expected a build hint for the missing arch, got %v", err)
+	}
+
+	// The plain binary is assumed to be built for the server's own arch
+	_ = os.WriteFile(filepath.Join(dir, "worker"), []byte("host"), 0755)
+	if path, err := orch.workerBinary(HostArch()); err != nil || path != filepath.Join(dir, "worker") {
+		t.Errorf("Expected the plain binary for the host arch, got %q, %v", path, err)
+	}
+
+	_ = os.WriteFile(filepath.Join(dir, "worker-linux-armv7"), []byte("arm"), 0755)
+	if path, err := orch.workerBinary("linux/armv7"); err != nil || path != filepath.Join(dir, "worker-linux-armv7") {
+		t.Errorf("Expected the armv7 build, got %q, %v", path, err)
+	}
+}
+
+func TestValidateInstall(t *testing.T) {
+	valid := []db.Device{
+		{},
+		{InstallDir: "/opt/hl-speedtest", WorkerCleanup: db.CleanupAfterRun},
+		{WorkerCleanup: db.CleanupOnDelete},
+	}
+	for _, dev := range valid {
+		if err := ValidateInstall(dev); err != nil {
+			t.Errorf("%+v: unexpected error %v", dev, err)
+		}
+	}
+	invalid := []db.Device{
+		{InstallDir: "opt/worker"},
+		{InstallDir: "/opt/../tmp"},
+		{InstallDir: "/opt/"},
+		{WorkerCleanup: "never"},
+	}
+	for _, dev := range invalid {
+		if err := ValidateInstall(dev); err == nil {
+			t.Errorf("%+v: expected an error", dev)
+		}
+	}
+}
+
+func TestParseJumpHosts(t *testing.T) {
+	hops, err := ParseJumpHosts("bastion, admin@10.0.0.1:2222,[fd00::1]:22,fd00::2", "pi")
+	want := []JumpHost{
+		{User: "pi", Host: "bastion", Port: 22},
+		{User: "admin", Host: "10.0.0.1", Port: 2222},
+		{User: "pi", Host: "fd00::1", Port: 22},
+		{User: "pi", Host: "fd00::2", Port: 22},
+	}
+	if err != nil || len(hops) != len(want) {
+		t.Fatalf("Expected %d hops, got %+v, %v", len(want), hops, err)
+	}
+	for i := range want {
+		if hops[i] != want[i] {
+			t.Errorf("Hop %d: expected %+v, got %+v", i, want[i], hops[i])
+		}
+	}
+	for _, s := range []string{"", "a,,b", "host:0", "host:ssh", "@host"} {
+		if _, err := ParseJumpHosts(s, "pi"); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestJumpChain(t *testing.T) {
+	devices := map[int]*db.Device{
+		1: {ID: 1, Name: "bastion"},
+		2: {ID: 2, Name: "inner", JumpDeviceID: 1},
+		3: {ID: 3, Name: "a", JumpDeviceID: 4},
+		4: {ID: 4, Name: "b", JumpDeviceID: 3},
+		6: {ID: 6, Name: "appliance", Transport: db.TransportAgent},
+	}
+	lookup := func(id int) (*db.Device, error) { return devices[id], nil }
+
+	chain, err := jumpChain(db.Device{ID: 5, Name: "nas", JumpDeviceID: 2}, lookup)
+	if err != nil || len(chain) != 2 || chain[0].Name != "bastion" || chain[1].Name != "inner" {
+		t.Errorf("Expected bastion then inner, got %+v, %v", chain, err)
+	}
+	if err := ValidateJump(*devices[3], lookup); err == nil || !strings.Contains(err.Error(), "loop") {
+		t.Errorf("Expected a loop error, got %v", err)
+	}
+	if err := ValidateJump(db.Device{Name: "nas", JumpDeviceID: 9}, lookup); err == nil {
+		t.Error("Expected an error for a missing jump device")
+	}
+	if err := ValidateJump(db.Device{Name: "nas", JumpDeviceID: 1, JumpHost: "bastion"}, lookup); err == nil {
+		t.Error("Expected an error when both jump settings are set")
+	}
+	if err := ValidateJump(db.Device{Name: "nas", JumpDeviceID: 6}, lookup); err == nil {
+		t.Error("Expected an error for an agent device as jump device")
+	}
+}
+
+func TestConnectThroughJumps(t *testing.T) {
+	bastion, bastionConns := startTestSSHServer(t)
+	inner, innerConns := startTestSSHServer(t)
+	target, targetConns := startTestSSHServer(t)
+	password := db.Credential{Type: db.AuthPassword, Password: "x"}
+
+	devices := map[int]*db.Device{
+		1: {ID: 1, Name: "bastion", Hostname: "127.0.0.1", SSHUser: "u", SSHPort: bastion, Credential: password},
+		2: {ID: 2, Name: "inner", Hostname: "127.0.0.1", SSHUser: "u", SSHPort: inner, Credential: password, JumpDeviceID: 1},
+	}
+	orch := NewOrchestrator("./worker", 0)
+	defer orch.Pool.Close()
+	orch.LookupDevice = func(id int) (*db.Device, error) { return devices[id], nil }
+
+	// Chained jump devices share their pooled connections
+	dev := db.Device{ID: 3, Name: "nas", Hostname: "127.0.0.1", SSHUser: "u", SSHPort: target, Credential: password, JumpDeviceID: 2}
+	client, release, err := orch.Pool.Get(dev)
+	if err != nil {
+		t.Fatalf("Connecting through jump devices failed: %v", err)
+	}
+	if !client.Alive(time.Second) || bastionConns.Load() != 1 || innerConns.Load() != 1 || targetConns.Load() != 1 {
+		t.Errorf("Expected one connection per hop, got %d, %d, %d", bastionConns.Load(), innerConns.Load(), targetConns.Load())
+	}
+	release()
+
+	// Changing a jump device reconnects the devices tunnelled through it
+	// instead of leaving them on its evicted connection
+	devices[1].SSHUser = "other"
+	client, release, err = orch.Pool.Get(dev)
+	if err != nil {
+		t.Fatalf("Reconnecting through the changed jump device failed: %v", err)
+	}
+	if !client.Alive(time.Second) || bastionConns.Load() != 2 || innerConns.Load() != 2 || targetConns.Load() != 2 {
+		t.Errorf("Expected every hop reconnected, got %d, %d, %d", bastionConns.Load(), innerConns.Load(), targetConns.Load())
+	}
+	release()
+
+	// A jump_host list is dialled hop by hop
+	dev = db.Device{ID: 4, Name: "pi", Hostname: "127.0.0.1", SSHUser: "u", SSHPort: target, Credential: password,
+		JumpHost: fmt.Sprintf("127.0.0.1:%d,127.0.0.1:%d", bastion, inner)}
+	client, err = orch.connect(dev)
+	if err != nil {
+		t.Fatalf("Connecting through jump hosts failed: %v", err)
+	}
+	if !client.Alive(time.Second) || bastionConns.Load() != 3 || innerConns.Load() != 3 {
+		t.Errorf("Expected a new connection per hop, got %d, %d", bastionConns.Load(), innerConns.Load())
+	}
+	_ = client.Close()
+}
+
+func TestRunWithFakeExecutors(t *testing.T) {
+	source := &FakeExecutor{Respond: func(req WorkerRequest) (WorkerResponse, error) {
+		return WorkerResponse{Success: true, LatencyMs: 1.5}, nil
+	}}
+	target := &FakeExecutor{ServerPort: 9005}
+	orch := NewOrchestrator("./worker", 0)
+	orch.NewExecutor = func(dev db.Device) (Executor, error) {
+		if dev.ID == 1 {
+			return source, nil
+		}
+		return target, nil
+	}
+
+	resp, err := orch.RunPing(context.Background(), db.Device{ID: 1, Name: "a"}, db.Device{ID: 2, Name: "b", Hostname: "b.lan", IP: "10.0.0.2"})
+	if err != nil || resp.LatencyMs != 1.5 {
+		t.Fatalf("Expected a 1.5ms ping, got %+v, %v", resp, err)
+	}
+	if reqs := target.Requests(); len(reqs) != 1 || reqs[0].Mode != ModeServer || reqs[0].Port != 8090 {
+		t.Errorf("Expected one server request on port 8090, got %+v", reqs)
+	}
+	if reqs := source.Requests(); len(reqs) != 1 || reqs[0].Mode != ModePing || reqs[0].Target != "10.0.0.2:9005" || !reqs[0].HoldStdin {
+		t.Errorf("Expected a ping to the bound port, got %+v", reqs)
+	}
+	if target.Running() != 0 || !source.Closed() || !target.Closed() {
+		t.Error("Expected the server stopped and both executors closed")
+	}
+
+	// A failed deploy never starts the server
+	target = &FakeExecutor{DeployErr: errors.New("read-only file system")}
+	if _, err := orch.RunPing(context.Background(), db.Device{ID: 1, Name: "a"}, db.Device{ID: 2, Name: "b"}); err == nil ||
+		!strings.Contains(err.Error(), "read-only file system") {
+		t.Errorf("Expected the deploy error, got %v", err)
+	}
+	if len(target.Requests()) != 0 {
+		t.Error("Expected no server to be started")
+	}
+
+	// A hung client is abandoned at the deadline and the server stopped
+	source = &FakeExecutor{Delay: time.Minute}
+	target = &FakeExecutor{}
+	ctx, cancel := withTimeout(context.Background(), "test", 50*time.Millisecond)
+	defer cancel()
+	_, err = orch.RunPing(ctx, db.Device{ID: 1, Name: "a"}, db.Device{ID: 2, Name: "b"})
+	if ErrorClass(err) != db.ErrorClassTimeout || !strings.Contains(err.Error(), "test timed out after 50ms") {
+		t.Errorf("Expected a test timeout, got %v", err)
+	}
+	if target.Running() != 0 {
+		t.Error("Expected the server stopped after the timeout")
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(ErrCancelled)
+	cases := map[error]string{
+		nil:                      "",
+		errors.New("no route"):   db.ErrorClassError,
+		&TimeoutError{"test", 1}: db.ErrorClassTimeout,
+		abortErr(ctx, "deploying the worker", errors.New("connection closed")): db.ErrorClassCancelled,
+		fmt.Errorf("ping: %w", context.DeadlineExceeded):                       db.ErrorClassTimeout,
+	}
+	for err, want := range cases {
+		if got := ErrorClass(err); got != want {
+			t.Errorf("ErrorClass(%v) = %q, want %q", err, got, want)
+		}
+	}
+}
+
+func TestTraceDuration(t *testing.T) {
+	// A default traceroute of 30 hops, 3 unanswered probes each
+	if got := traceDuration(TraceOptions{}); got != 90*time.Second {
+		t.Errorf("Expected 90s for the default hops, got %v", got)
+	}
+	if got := traceDuration(TraceOptions{MaxHops: 64}); got != 192*time.Second {
+		t.Errorf("Expected the budget to grow with max_hops, got %v", got)
+	}
+	if pmtuDuration() < 3*PMTUProbeTimeout {
+		t.Errorf("Expected room for every attempt at a size, got %v", pmtuDuration())
+	}
+}
+
+func TestTaskQueue(t *testing.T) {
+	q := NewTaskQueue()
+	started := make(chan string)
+	results := make(chan error, 2)
+	q.Start(func(ctx context.Context, task Task) {
+		started <- task.ID
+		<-ctx.Done()
+		results <- context.Cause(ctx)
+	})
+	defer q.Stop()
+
+	q.Enqueue(Task{ID: "one", Type: TaskPingAll})
+	q.Enqueue(Task{ID: "two", Type: TaskSpeedAll})
+	q.Enqueue(Task{ID: "three", Type: TaskBufferbloatAll})
+	if id := <-started; id != "one" {
+		t.Fatalf("Expected task one to run first, got %s", id)
+	}
+	if !q.Cancel("three") || q.GetStatus().Length != 1 {
+		t.Error("Expected the queued task to be dropped")
+	}
+	if q.Cancel("three") {
+		t.Error("Expected a dropped task not to be found again")
+	}
+
+	// A paused queue holds its tasks once the running one ends
+	q.Pause()
+	if !q.Cancel("one") {
+		t.Fatal("Expected the running task to be cancelled")
+	}
+	if err := <-results; !errors.Is(err, ErrCancelled) {
+		t.Errorf("Expected ErrCancelled, got %v", err)
+	}
+
+	select {
+	case id := <-started:
+		t.Fatalf("Expected no dispatch while paused, got %s", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if status := q.GetStatus(); !status.Paused || status.Running != nil || status.Length != 1 {
+		t.Errorf("Expected task two held, got %+v", status)
+	}
+	q.Resume()
+
+	// Stopping the queue cancels the task it runs
+	if id := <-started; id != "two" {
+		t.Fatalf("Expected task two to run next, got %s", id)
+	}
+	q.Stop()
+	if err := <-results; !errors.Is(err, ErrCancelled) {
+		t.Errorf("Expected ErrCancelled on stop, got %v", err)
+	}
+}
+
+func TestRestoreTasks(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "scheduler-test-*")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	database, err := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+	orch := NewOrchestrator("/tmp/worker", 8090)
+
+	// A server that queued two tasks and was running a third when it went down
+	before := NewScheduler(database, orch)
+	before.RunAllSpeeds(SourceAPI, &SpeedTestOptions{DurationSeconds: 5})
+	before.RunAllPings(SourceManual)
+	before.RunAllPings(SourceAPI) // already queued, not recorded
+	_ = database.AddTask(db.Task{ID: "old", Type: string(TaskBufferbloatAll), Source: string(SourceSchedule), CreatedAt: "2026-01-01 10:00:00"})
+	_ = database.AddTask(db.Task{ID: "crashed", Type: string(TaskPingAll), Source: string(SourceSchedule), CreatedAt: "2026-01-01 00:00:00"})
+	_ = database.StartTask("crashed")
+
+	s := NewScheduler(database, orch)
+	s.restoreTasks()
+	queued := s.GetQueueStatus().Queued
+	if len(queued) != 3 || queued[0].Type != TaskSpeedAll || queued[1].Type != TaskPingAll || queued[2].ID != "old" {
+		t.Fatalf("Expected the speed, ping and bufferbloat tasks requeued, got %+v", queued)
+	}
+	if o := queued[0].Options; o == nil || o.DurationSeconds != 5 || queued[0].Source != SourceAPI {
+		t.Errorf("Expected the speed task's options and source restored, got %+v", queued[0])
+	}
+	if want := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC); !queued[2].CreatedAt.Equal(want) {
+		t.Errorf("Expected the stored creation time %v, got %v", want, queued[2].CreatedAt)
+	}
+	if tasks, _, _ := database.GetTasks(10, 0, db.TaskFailed); len(tasks) != 1 || tasks[0].ID != "crashed" {
+		t.Errorf("Expected the interrupted task failed, got %+v", tasks)
+	}
+
+	// With no devices all three tasks finish right away
+	s.queue.Start(s.executeTask)
+	defer s.queue.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tasks, total, _ := database.GetTasks(10, 0, db.TaskDone)
+		if total == 3 {
+			if tasks[0].StartedAt == "" || tasks[0].FinishedAt == "" || tasks[0].PairsTotal != 0 {
+				t.Errorf("Unexpected finished task: %+v", tasks[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected all three tasks done, got %+v", tasks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRestartRunsQueuedTaskOnce(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "scheduler-test-*")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	database, err := db.New(config.DatabaseConfig{Path: filepath.Join(tmpDir, "test.db")})
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+	_ = database.AddDevice(db.Device{Name: "a", Hostname: "a", IP: "10.0.0.1", SSHUser: "root", SSHPort: 22})
+	_ = database.AddDevice(db.Device{Name: "b", Hostname: "b", IP: "10.0.0.2", SSHUser: "root", SSHPort: 22})
+
+	fake := &FakeExecutor{}
+	orch := NewOrchestrator("./worker", 0)
+	orch.NewExecutor = func(dev db.Device) (Executor, error) { return fake, nil }
+
+	// Queued by a server that went down before running it
+	NewScheduler(database, orch).RunAllPings(SourceManual)
+
+	s := NewScheduler(database, orch)
+	var mu sync.Mutex
+	var results []db.Result
+	s.OnResult = func(res db.Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, res)
+	}
+	s.Start()
+	defer s.queue.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, total, _ := database.GetTasks(10, 0, db.TaskDone); total == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the restored task to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Give a duplicate run the chance to show up
+	time.Sleep(50 * time.Millisecond)
+
+	pings := 0
+	for _, req := range fake.Requests() {
+		if req.Mode == ModePing {
+			pings++
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if pings != 2 || len(results) != 2 {
+		t.Errorf("Expected both pairs pinged once and reported, got %d pings and %+v", pings, results)
+	}
+	if status := s.GetQueueStatus(); status.Length != 0 || status.Running != nil {
+		t.Errorf("Expected an empty queue, got %+v", status)
+	}
+}
+
+func TestLocalExecutor(t *testing.T) {
+	// A stand-in worker answering -version, server and ping requests
+	script := `#!/bin/sh
+if [ "$1" = "-version" ]; then echo "hl-speedtest-worker test (protocol 1)"; exit 0; fi
+read -r req
+case "$req" in
+*'"mode":"server"'*) echo '{"ready":true,"port":9100}'; cat >/dev/null ;;
+*'"mode":"pmtu"'*) exec sleep 30 ;;
+*) echo '{"protocol_version":1,"response":{"success":true,"latency_ms":2.5}}' ;;
+esac
+`
+	path := filepath.Join(t.TempDir(), "worker")
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	orch := NewOrchestrator(path, 0)
+	var deployed []db.WorkerInfo
+	orch.OnWorkerDeployed = func(dev db.Device, info db.WorkerInfo) { deployed = append(deployed, info) }
+
+	source := db.Device{ID: 1, Name: "server", Hostname: "localhost", Transport: db.TransportLocal}
+	target := db.Device{ID: 2, Name: "also-server", Hostname: "127.0.0.1", Transport: db.TransportLocal}
+	resp, err := orch.RunPing(context.Background(), source, target)
+	if err != nil || resp.LatencyMs != 2.5 {
+		t.Fatalf("Expected a 2.5ms ping, got %+v, %v", resp, err)
+	}
+	if len(deployed) != 2 || deployed[0].Version != "test" || deployed[0].Arch != HostArch() {
+		t.Errorf("Expected both devices to report the local worker, got %+v", deployed)
+	}
+
+	// The verified worker isn't checked again
+	if _, err := orch.RunPing(context.Background(), source, target); err != nil || len(deployed) != 2 {
+		t.Errorf("Expected no new deploy reports, got %d, %v", len(deployed), err)
+	}
+
+	// A worker that hangs is killed when the test is cancelled
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(100*time.Millisecond, func() { cancel(ErrCancelled) })
+	start := time.Now()
+	if _, err := orch.RunPMTU(ctx, source, target); ErrorClass(err) != db.ErrorClassCancelled {
+		t.Errorf("Expected a cancelled error, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("Expected the hung worker to be killed, waited %v", time.Since(start))
+	}
+}
+
+// pipeAgentConn is an in-memory agent connection; the test plays the agent
+type pipeAgentConn struct {
+	toHub   chan AgentMessage
+	fromHub chan AgentMessage
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newPipeAgentConn() *pipeAgentConn {
+	return &pipeAgentConn{toHub: make(chan AgentMessage), fromHub: make(chan AgentMessage), closed: make(chan struct{})}
+}
+
+func (c *pipeAgentConn) ReadJSON(v any) error {
+	select {
+	case msg := <-c.toHub:
+		*v.(*AgentMessage) = msg
+		return nil
+	case <-c.closed:
+		return io.EOF
+	}
+}
+
+func (c *pipeAgentConn) WriteJSON(v any) error {
+	select {
+	case c.fromHub <- v.(AgentMessage):
+		return nil
+	case <-c.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *pipeAgentConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *pipeAgentConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestAgentExecutor(t *testing.T) {
+	orch := NewOrchestrator("./worker", 8090)
+	var statuses []bool
+	var mu sync.Mutex
+	orch.Agents.OnStatus = func(status AgentStatus) {
+		mu.Lock()
+		defer mu.Unlock()
+		statuses = append(statuses, status.Online)
+	}
+	var hello db.WorkerInfo
+	orch.Agents.OnHello = func(dev db.Device, info db.WorkerInfo) { hello = info }
+	dev := db.Device{ID: 1, Name: "appliance", Transport: db.TransportAgent}
+
+	if _, err := orch.executor(dev); err == nil || !strings.Contains(err.Error(), "offline") {
+		t.Fatalf("Expected an offline error before the agent connects, got %v", err)
+	}
+
+	conn := newPipeAgentConn()
+	served := make(chan error, 1)
+	go func() { served <- orch.Agents.Serve(dev, conn) }()
+	conn.toHub <- AgentMessage{Type: AgentHello, ProtocolVersion: ProtocolVersion, WorkerVersion: "1.2.3", Arch: "linux/armv7"}
+	conn.toHub <- AgentMessage{Type: AgentHeartbeat}
+	if !orch.Agents.Online(dev.ID) || hello.Version != "1.2.3" || hello.Arch != "linux/armv7" {
+		t.Fatalf("Expected the agent to be online with its hello recorded, got %+v", hello)
+	}
+
+	// The test plays the agent: runs are echoed, started servers print a
+	// ready line and exit when stopped
+	stopRequests := make(chan string, 1)
+	runs := map[string]bool{}
+	go func() {
+		for msg := range conn.fromHub {
+			switch msg.Type {
+			case AgentRun:
+				switch msg.Input {
+				case "hang":
+					_ = conn.Close()
+				case "slow":
+					runs[msg.ID] = true
+				default:
+					conn.toHub <- AgentMessage{Type: AgentResult, ID: msg.ID, Stdout: "ran " + msg.Input}
+				}
+			case AgentStart:
+				conn.toHub <- AgentMessage{Type: AgentOutput, ID: msg.ID, Stdout: `{"ready": true, "port": 5201}` + "\n"}
+			case AgentStop:
+				if runs[msg.ID] {
+					stopRequests <- msg.ID
+					continue
+				}
+				conn.toHub <- AgentMessage{Type: AgentExit, ID: msg.ID}
+			}
+		}
+	}()
+
+	e, err := orch.executor(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Deploy(context.Background()); err != nil {
+		t.Fatalf("Deploy failed: %v", err)
+	}
+	if stdout, _, err := e.Run(context.Background(), []byte("ping")); err != nil || stdout != "ran ping" {
+		t.Errorf("Unexpected run result %q, %v", stdout, err)
+	}
+
+	proc, err := e.Start([]byte("server"), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready, err := waitForReady(context.Background(), proc.Output(), time.Second)
+	if err != nil || ready.Port != 5201 {
+		t.Errorf("Unexpected ready line %+v, %v", ready, err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		proc.Stop(time.Second)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Expected Stop to return once the agent reported the exit")
+	}
+
+	// Cancelled runs tell the agent to stop the worker
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(50*time.Millisecond, func() { cancel(ErrCancelled) })
+	if _, _, err := e.Run(ctx, []byte("slow")); !errors.Is(err, ErrCancelled) {
+		t.Errorf("Expected the run to be cancelled, got %v", err)
+	}
+	select {
+	case id := <-stopRequests:
+		if id == "" {
+			t.Error("Expected the stop to name the run")
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a stop for the cancelled run")
+	}
+
+	// Runs in flight fail when the agent goes away
+	if _, _, err := e.Run(context.Background(), []byte("hang")); err == nil || !strings.Contains(err.Error(), "disconnected") {
+		t.Errorf("Expected a disconnected error, got %v", err)
+	}
+	<-served
+	if orch.Agents.Online(dev.ID) {
+		t.Error("Expected the agent to be offline")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(statuses) != 2 || !statuses[0] || statuses[1] {
+		t.Errorf("Expected online then offline, got %v", statuses)
+	}
+}
+
+func TestAgentProtocolMismatch(t *testing.T) {
+	orch := NewOrchestrator("./worker", 8090)
+	dev := db.Device{ID: 1, Name: "appliance", Transport: db.TransportAgent}
+	conn := newPipeAgentConn()
+	defer func() { _ = conn.Close() }()
+	go func() { _ = orch.Agents.Serve(dev, conn) }()
+	conn.toHub <- AgentMessage{Type: AgentHello, ProtocolVersion: ProtocolVersion + 1}
+	conn.toHub <- AgentMessage{Type: AgentHeartbeat}
+
+	e, err := orch.executor(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Deploy(context.Background()); !errors.Is(err, ErrIncompatibleWorker) {
+		t.Errorf("Expected ErrIncompatibleWorker, got %v", err)
+	}
+}
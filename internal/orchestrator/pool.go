@@ -0,0 +1,219 @@
+package orchestrator
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/user/homelab-speedtest/internal/db"
+)
+
+// DefaultSSHIdleTTL is how long an unused pooled SSH connection stays open
+const DefaultSSHIdleTTL = 5 * time.Minute
+
+// healthCheckTimeout bounds the keepalive round trip before a pooled connection is reused
+const healthCheckTimeout = 5 * time.Second
+
+// SSHPool keeps one SSH connection per device open across tests. Connections
+// are checked before reuse, closed after IdleTTL without use and replaced when
+// the device's SSH settings change.
+type SSHPool struct {
+	// IdleTTL closes connections unused for this long; 0 closes them as soon as they are released
+	IdleTTL time.Duration
+	// Jumps resolves the jump devices a device is reached through, so that a
+	// change to any of them reconnects the device as well; nil ignores them
+	Jumps func(db.Device) ([]db.Device, error)
+
+	dial func(db.Device) (*SSHClient, error)
+
+	mu     sync.Mutex
+	conns  map[int]*pooledConn
+	reaper sync.Once
+	closed bool
+	done   chan struct{}
+}
+
+type pooledConn struct {
+	deviceID int
+	client   *SSHClient
+	settings [sha256.Size]byte
+	lastUsed time.Time
+	inUse    int
+	evicted  bool
+}
+
+// NewSSHPool creates a pool that opens connections with dial
+func NewSSHPool(dial func(db.Device) (*SSHClient, error), idleTTL time.Duration) *SSHPool {
+	return &SSHPool{
+		IdleTTL: idleTTL,
+		dial:    dial,
+		conns:   make(map[int]*pooledConn),
+		done:    make(chan struct{}),
+	}
+}
+
+// sshTarget is what affects how a device or one of its jump devices is reached
+type sshTarget struct {
+	User         string
+	Host         string
+	Port         int
+	Credential   db.Credential
+	JumpDeviceID int
+	JumpHost     string
+}
+
+// sshSettings fingerprints everything that affects how a device is reached,
+// including the settings of the jump devices it is tunnelled through
+func sshSettings(dev db.Device, jumps []db.Device) [sha256.Size]byte {
+	targets := make([]sshTarget, 0, 1+len(jumps))
+	for _, d := range append([]db.Device{dev}, jumps...) {
+		targets = append(targets, sshTarget{d.SSHUser, d.Hostname, d.SSHPort, d.Credential, d.JumpDeviceID, d.JumpHost})
+	}
+	data, _ := json.Marshal(targets)
+	return sha256.Sum256(data)
+}
+
+// settings fingerprints dev with its jump chain. A chain that can't be
+// resolved is left out; dialling reports why.
+func (p *SSHPool) settings(dev db.Device) [sha256.Size]byte {
+	var jumps []db.Device
+	if p.Jumps != nil {
+		jumps, _ = p.Jumps(dev)
+	}
+	return sshSettings(dev, jumps)
+}
+
+// Get returns a connection to dev, reusing a healthy pooled one. The caller
+// must call release when done instead of closing the client.
+func (p *SSHPool) Get(dev db.Device) (client *SSHClient, release func(), err error) {
+	p.reaper.Do(func() { go p.reap() })
+	settings := p.settings(dev)
+
+	p.mu.Lock()
+	if c := p.conns[dev.ID]; c != nil {
+		if c.settings != settings {
+			log.Printf("[SSH] Settings of %s changed, reconnecting", dev.Name)
+			p.evictLocked(dev.ID)
+		} else {
+			c.inUse++
+			p.mu.Unlock()
+			if c.client.Alive(healthCheckTimeout) {
+				return c.client, p.releaser(c), nil
+			}
+			log.Printf("[SSH] Pooled connection to %s is dead, reconnecting", dev.Name)
+			p.mu.Lock()
+			c.inUse--
+			if p.conns[dev.ID] == c {
+				p.evictLocked(dev.ID)
+			} else if c.inUse == 0 {
+				go func() { _ = c.client.Close() }()
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	fresh, err := p.dial(dev)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		// Shutting down: hand out the connection unpooled
+		return fresh, func() { _ = fresh.Close() }, nil
+	}
+	if c := p.conns[dev.ID]; c != nil && c.settings == settings {
+		// Another test connected concurrently; share its connection
+		go func() { _ = fresh.Close() }()
+		c.inUse++
+		return c.client, p.releaser(c), nil
+	}
+	p.evictLocked(dev.ID)
+	c := &pooledConn{deviceID: dev.ID, client: fresh, settings: settings, inUse: 1}
+	p.conns[dev.ID] = c
+	return fresh, p.releaser(c), nil
+}
+
+// Evict closes the pooled connection to a device once it is no longer in use
+func (p *SSHPool) Evict(deviceID int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.evictLocked(deviceID)
+}
+
+// evictLocked removes a device's connection from the pool, closing it if idle
+func (p *SSHPool) evictLocked(deviceID int) {
+	c := p.conns[deviceID]
+	if c == nil {
+		return
+	}
+	delete(p.conns, deviceID)
+	c.evicted = true
+	if c.inUse == 0 {
+		go func() { _ = c.client.Close() }()
+	}
+}
+
+func (p *SSHPool) releaser(c *pooledConn) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			c.inUse--
+			c.lastUsed = time.Now()
+			switch {
+			case c.inUse > 0:
+			case c.evicted:
+				go func() { _ = c.client.Close() }()
+			case p.IdleTTL <= 0:
+				p.evictLocked(c.deviceID)
+			}
+		})
+	}
+}
+
+// reap closes connections that have been idle longer than IdleTTL
+func (p *SSHPool) reap() {
+	interval := 30 * time.Second
+	if p.IdleTTL > 0 {
+		interval = min(max(p.IdleTTL/2, time.Second), interval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.closeIdle(time.Now())
+		}
+	}
+}
+
+func (p *SSHPool) closeIdle(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, c := range p.conns {
+		if c.inUse == 0 && now.Sub(c.lastUsed) >= p.IdleTTL {
+			p.evictLocked(id)
+		}
+	}
+}
+
+// Close closes all idle connections and stops pooling; connections in use
+// are closed when released
+func (p *SSHPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		close(p.done)
+	}
+	p.closed = true
+	for id := range p.conns {
+		p.evictLocked(id)
+	}
+}
@@ -0,0 +1,95 @@
+package orchestrator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/user/homelab-speedtest/internal/db"
+)
+
+// PortRange is an inclusive range of ports the worker server may bind.
+// The zero value lets the kernel pick an ephemeral port.
+type PortRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// Ephemeral reports whether the kernel picks the port
+func (r PortRange) Ephemeral() bool {
+	return r.Min == 0
+}
+
+func (r PortRange) String() string {
+	if r.Ephemeral() {
+		return "ephemeral"
+	}
+	return r.format("-")
+}
+
+// format writes the range with sep between the bounds, as firewall tools want it
+func (r PortRange) format(sep string) string {
+	if r.Min == r.Max {
+		return strconv.Itoa(r.Min)
+	}
+	return fmt.Sprintf("%d%s%d", r.Min, sep, r.Max)
+}
+
+// describe names the range in a sentence
+func (r PortRange) describe() string {
+	switch {
+	case r.Ephemeral():
+		return "an ephemeral port"
+	case r.Min == r.Max:
+		return "port " + strconv.Itoa(r.Min)
+	}
+	return "ports " + r.format("-")
+}
+
+// Validate rejects ranges the worker can't bind
+func (r PortRange) Validate() error {
+	if r.Ephemeral() && r.Max == 0 {
+		return nil
+	}
+	if r.Min < 1 || r.Max > 65535 || r.Min > r.Max {
+		return fmt.Errorf("invalid port range %d-%d", r.Min, r.Max)
+	}
+	return nil
+}
+
+// ParsePortRange parses "8090", "8090-8099", or "0"/"ephemeral" for kernel-picked ports
+func ParsePortRange(s string) (PortRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "0" || s == "ephemeral" {
+		return PortRange{}, nil
+	}
+	lo, hi, isRange := strings.Cut(s, "-")
+	min, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	max := min
+	if isRange {
+		if max, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+			return PortRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	r := PortRange{Min: min, Max: max}
+	return r, r.Validate()
+}
+
+// DevicePortRange returns the device's own worker port range, if it has one
+func DevicePortRange(dev db.Device) (PortRange, bool) {
+	if dev.WorkerPortMin <= 0 {
+		return PortRange{}, false
+	}
+	return PortRange{Min: dev.WorkerPortMin, Max: max(dev.WorkerPortMax, dev.WorkerPortMin)}, true
+}
+
+// portRange is where the worker server on dev listens: the device's range, else the global one
+func (o *Orchestrator) portRange(dev db.Device) PortRange {
+	if r, ok := DevicePortRange(dev); ok {
+		return r
+	}
+	return o.PortRange
+}
@@ -1,23 +1,158 @@
 package orchestrator
 
+import "time"
+
+// ProtocolVersion is the version of the request/response format spoken between
+// the orchestrator and the worker. Bump it on incompatible changes; the
+// orchestrator rejects workers reporting a different version.
+const ProtocolVersion = 1
+
 // Mode constants
 const (
 	ModeServer = "server"
 	ModeClient = "client"
+	ModeUDP    = "udp"
 	ModePing   = "ping"
+
+	ModeBufferbloat = "bufferbloat" // TCP saturation with a concurrent probe train
+	ModeTrace       = "trace"       // traceroute with per-hop RTT
+	ModePMTU        = "pmtu"        // path MTU discovery with DF-bit probes
+)
+
+// Traceroute probe protocols
+const (
+	TraceUDP = "udp" // datagrams echoed by the target worker
+	TraceTCP = "tcp" // SYNs to the target worker's listener
+)
+
+// Speed test defaults shared by the orchestrator and the worker
+const (
+	DefaultDurationSeconds = 10
+	DefaultBufferSize      = 32 * 1024
+	DefaultSampleInterval  = 1000 // milliseconds between throughput samples
+)
+
+// Trace and path MTU defaults shared by the orchestrator and the worker
+const (
+	DefaultTraceMaxHops = 30
+	MaxTraceHops        = 64
+	DefaultTraceQueries = 3
+	// TraceProbeTimeout is how long each traceroute probe waits for an answer
+	TraceProbeTimeout = 1 * time.Second
+
+	// PMTUProbeTimeout and PMTUAttempts bound each size tried during PMTU discovery.
+	// A lost probe is retried since the echo may be dropped once while the
+	// target learns the return path's MTU.
+	PMTUProbeTimeout = 500 * time.Millisecond
+	PMTUAttempts     = 3
+)
+
+// Direction constants for TCP throughput tests
+const (
+	DirectionForward = "forward" // client sends to server (source -> target)
+	DirectionReverse = "reverse" // server sends to client (target -> source)
+	DirectionBidir   = "bidir"   // both at the same time
 )
 
-// WorkerRequest is the JSON payload sent to the worker to initiate a task
+// WorkerRequest is the JSON payload sent to the worker to initiate a task.
+// The orchestrator writes it to the worker's stdin (worker -stdin).
 type WorkerRequest struct {
-	Mode   string `json:"mode"`           // server, client, ping
-	Target string `json:"target"`         // For client/ping: "ip:port" or "ip"
-	Port   int    `json:"port,omitempty"` // For server: port to listen on
+	ProtocolVersion int `json:"protocol_version,omitempty"` // 0 = assume the worker's own
+
+	Mode    string `json:"mode"`               // server, client, udp, ping, bufferbloat, trace, pmtu
+	Target  string `json:"target"`             // For client/ping: "ip:port" or "ip"
+	Port    int    `json:"port"`               // For server: port to listen on, 0 for ephemeral
+	PortMax int    `json:"port_max,omitempty"` // For server: try Port..PortMax until one is free
 
 	// Options
-	DurationSeconds int `json:"duration,omitempty"`
+	DurationSeconds int    `json:"duration,omitempty"`
+	Direction       string `json:"direction,omitempty"`   // For client: forward, reverse, bidir
+	Parallel        int    `json:"parallel,omitempty"`    // For client: number of concurrent TCP streams
+	BufferSize      int    `json:"buffer_size,omitempty"` // For client: write/read buffer in bytes
+	OmitSeconds     int    `json:"omit,omitempty"`        // For client: TCP slow-start warm-up excluded from results
+
+	SampleIntervalMs int `json:"sample_interval_ms,omitempty"` // For client: throughput sample period
+
+	// Ping options
+	Count      int `json:"count,omitempty"`       // Number of probes to send
+	IntervalMs int `json:"interval_ms,omitempty"` // Delay between probes
+
+	// Datagram options (ping and udp)
+	PayloadSize int     `json:"payload_size,omitempty"` // Datagram size in bytes
+	BitrateMbps float64 `json:"bitrate_mbps,omitempty"` // UDP target send rate
+
+	// Traceroute options
+	Protocol string `json:"protocol,omitempty"` // udp or tcp
+	MaxHops  int    `json:"max_hops,omitempty"`
+	Queries  int    `json:"queries,omitempty"` // Probes per hop
+
+	// HoldStdin means the orchestrator keeps stdin open until it no longer
+	// needs the result; the worker aborts when it closes early
+	HoldStdin bool `json:"hold_stdin,omitempty"`
+}
+
+// WorkerEnvelope is what the worker prints on stdout: its result plus metadata
+// identifying the worker and the run
+type WorkerEnvelope struct {
+	ProtocolVersion int       `json:"protocol_version"`
+	WorkerVersion   string    `json:"worker_version"`
+	Hostname        string    `json:"hostname"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationMs      float64   `json:"duration_ms"`
+
+	Response WorkerResponse `json:"response"`
+}
+
+// ServerReady is the line a worker in server mode prints on stdout once it
+// accepts connections. Port is the bound port, which matters when 0 was requested.
+type ServerReady struct {
+	Ready           bool   `json:"ready"`
+	Port            int    `json:"port"`
+	ProtocolVersion int    `json:"protocol_version"`
+	WorkerVersion   string `json:"worker_version"`
+}
+
+// AgentPath is where agents open their control channel, relative to the server URL
+const AgentPath = "/api/agent/ws"
+
+// DefaultAgentHeartbeat is how often an agent sends a heartbeat
+const DefaultAgentHeartbeat = 15 * time.Second
+
+// Agent control channel message types
+const (
+	AgentHello     = "hello"     // agent: first message after connecting
+	AgentHeartbeat = "heartbeat" // agent: still alive
+	AgentRun       = "run"       // server: run the worker with Input and wait for it
+	AgentResult    = "result"    // agent: output of a run
+	AgentStart     = "start"     // server: start the worker in the background with Input
+	AgentOutput    = "output"    // agent: stdout/stderr of a started worker
+	AgentStop      = "stop"      // server: close a started worker's stdin, kill it after TimeoutMs
+	AgentExit      = "exit"      // agent: a started worker exited
+)
+
+// AgentMessage is one JSON frame on the WebSocket between an agent and the
+// server. Input is what the worker reads on stdin (a WorkerRequest); ID ties
+// the frames of one run or started worker together.
+type AgentMessage struct {
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	Input     string `json:"input,omitempty"`
+	Stdout    string `json:"stdout,omitempty"`
+	Stderr    string `json:"stderr,omitempty"`
+	Error     string `json:"error,omitempty"` // the worker couldn't be run or exited non-zero
+	TimeoutMs int    `json:"timeout_ms,omitempty"`
+
+	// Hello: the build the agent runs
+	ProtocolVersion int    `json:"protocol_version,omitempty"`
+	WorkerVersion   string `json:"worker_version,omitempty"`
+	WorkerSHA256    string `json:"worker_sha256,omitempty"`
+	WorkerPath      string `json:"worker_path,omitempty"`
+	Arch            string `json:"arch,omitempty"`
+	Hostname        string `json:"hostname,omitempty"`
 }
 
-// WorkerResponse is the JSON output from the worker
+// WorkerResponse is the result of a worker task
 type WorkerResponse struct {
 	Success bool   `json:"success"`
 	Error   string `json:"error,omitempty"`
@@ -27,4 +162,112 @@ type WorkerResponse struct {
 	JitterMs      float64 `json:"jitter_ms,omitempty"`
 	PacketLoss    float64 `json:"packet_loss,omitempty"`
 	BandwidthMbps float64 `json:"bandwidth_mbps,omitempty"`
+
+	// Target -> source throughput for reverse and bidirectional tests
+	ReverseBandwidthMbps float64 `json:"reverse_bandwidth_mbps,omitempty"`
+
+	// Both ends' view of a TCP test. BandwidthMbps is the receiver's figure when the
+	// server reported one, else the sender's; ReverseBandwidthMbps is always measured
+	// by the client as the receiver.
+	SenderBandwidthMbps        float64 `json:"sender_bandwidth_mbps,omitempty"`         // source write rate
+	ReceiverBandwidthMbps      float64 `json:"receiver_bandwidth_mbps,omitempty"`       // measured by the target
+	ReverseSenderBandwidthMbps float64 `json:"reverse_sender_bandwidth_mbps,omitempty"` // target write rate
+
+	// Parallel TCP streams; the bandwidth fields above are the aggregate
+	Parallel int            `json:"parallel,omitempty"`
+	Streams  []StreamResult `json:"streams,omitempty"`
+
+	// Throughput over time, aggregated across streams
+	Samples []IntervalSample `json:"samples,omitempty"`
+
+	// Kernel TCP statistics of the client's sockets, aggregated across streams (Linux only)
+	TCP *TCPStats `json:"tcp,omitempty"`
+
+	// Ping statistics (LatencyMs is the average)
+	LatencyMinMs    float64 `json:"latency_min_ms,omitempty"`
+	LatencyMaxMs    float64 `json:"latency_max_ms,omitempty"`
+	LatencyStdDevMs float64 `json:"latency_stddev_ms,omitempty"`
+	PacketsSent     int     `json:"packets_sent,omitempty"`
+	PacketsReceived int     `json:"packets_received,omitempty"`
+
+	// UDP throughput accounting (as seen by the receiving worker)
+	PacketsLost       int `json:"packets_lost,omitempty"`
+	PacketsDuplicated int `json:"packets_duplicated,omitempty"`
+	PacketsReordered  int `json:"packets_reordered,omitempty"`
+
+	// Latency under load: probe train averages before and during TCP saturation
+	IdleLatencyMs    float64 `json:"idle_latency_ms,omitempty"`
+	LoadedLatencyMs  float64 `json:"loaded_latency_ms,omitempty"`
+	BufferbloatMs    float64 `json:"bufferbloat_ms,omitempty"` // loaded - idle
+	BufferbloatGrade string  `json:"bufferbloat_grade,omitempty"`
+
+	// Traceroute hops in TTL order; LatencyMs is the RTT to the target
+	Hops []TraceHop `json:"hops,omitempty"`
+
+	// Largest IP packet that reaches the target unfragmented, in bytes
+	PathMTU int `json:"path_mtu,omitempty"`
+}
+
+// StreamResult is the per-connection breakdown of a parallel TCP test
+type StreamResult struct {
+	Stream               int       `json:"stream"`
+	BytesSent            int64     `json:"bytes_sent,omitempty"`
+	BytesReceived        int64     `json:"bytes_received,omitempty"`
+	BandwidthMbps        float64   `json:"bandwidth_mbps,omitempty"`
+	ReverseBandwidthMbps float64   `json:"reverse_bandwidth_mbps,omitempty"`
+	TCP                  *TCPStats `json:"tcp,omitempty"`
+
+	SenderBandwidthMbps        float64 `json:"sender_bandwidth_mbps,omitempty"`
+	ReceiverBandwidthMbps      float64 `json:"receiver_bandwidth_mbps,omitempty"`
+	ReverseSenderBandwidthMbps float64 `json:"reverse_sender_bandwidth_mbps,omitempty"`
+}
+
+// TCPStats are TCP_INFO figures sampled on the client's sockets during a test.
+// They describe the client's sending side; for reverse tests only RTT is meaningful.
+type TCPStats struct {
+	Retransmits int     `json:"retransmits"` // segments retransmitted
+	RttMs       float64 `json:"rtt_ms"`      // smoothed RTT, averaged over the test
+	RttVarMs    float64 `json:"rttvar_ms"`
+	Cwnd        int     `json:"cwnd"` // final congestion window in segments
+}
+
+// TraceHop is one TTL step of a traceroute. Address is empty when no probe was answered.
+type TraceHop struct {
+	TTL      int     `json:"ttl"`
+	Address  string  `json:"address,omitempty"`
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	RttMinMs float64 `json:"rtt_min_ms,omitempty"`
+	RttAvgMs float64 `json:"rtt_avg_ms,omitempty"`
+	RttMaxMs float64 `json:"rtt_max_ms,omitempty"`
+}
+
+// IntervalSample is the throughput of one sampling interval of a TCP test.
+// Offsets are relative to the start of the measured window (after any omit period).
+type IntervalSample struct {
+	Start                float64 `json:"start"` // seconds
+	End                  float64 `json:"end"`
+	BytesSent            int64   `json:"bytes_sent"`
+	BytesReceived        int64   `json:"bytes_received"`
+	BandwidthMbps        float64 `json:"bandwidth_mbps"`
+	ReverseBandwidthMbps float64 `json:"reverse_bandwidth_mbps"`
+}
+
+// BufferbloatGrade rates the latency added under load, using the same bands as
+// the common public bufferbloat tests
+func BufferbloatGrade(increaseMs float64) string {
+	switch {
+	case increaseMs < 5:
+		return "A+"
+	case increaseMs < 30:
+		return "A"
+	case increaseMs < 60:
+		return "B"
+	case increaseMs < 200:
+		return "C"
+	case increaseMs < 400:
+		return "D"
+	default:
+		return "F"
+	}
 }
@@ -1,6 +1,7 @@
 package orchestrator
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -13,6 +14,9 @@ type TaskType string
 const (
 	TaskPingAll  TaskType = "ping_all"
 	TaskSpeedAll TaskType = "speed_all"
+
+	TaskBufferbloatAll TaskType = "bufferbloat_all"
+	TaskTrace          TaskType = "trace" // traceroute + path MTU for one pair
 )
 
 // TaskPriority determines execution order (higher = executed first)
@@ -23,12 +27,35 @@ const (
 	PriorityHigh   TaskPriority = 1 // Manual tasks
 )
 
+// TaskSource records what triggered a task
+type TaskSource string
+
+const (
+	SourceSchedule TaskSource = "schedule"
+	SourceManual   TaskSource = "manual" // the web UI
+	SourceAPI      TaskSource = "api"    // other API clients
+)
+
 // Task represents a unit of work to be executed
 type Task struct {
 	ID        string       `json:"id"`
 	Type      TaskType     `json:"type"`
 	Priority  TaskPriority `json:"priority"`
+	Source    TaskSource   `json:"source,omitempty"`
 	CreatedAt time.Time    `json:"created_at"`
+
+	// Options overrides the schedule defaults for a speed test
+	Options *SpeedTestOptions `json:"options,omitempty"`
+
+	// Trace names the pair of a TaskTrace
+	Trace *TraceTask `json:"trace,omitempty"`
+}
+
+// TraceTask is an on-demand traceroute and path MTU discovery between two devices
+type TraceTask struct {
+	SourceID int `json:"source_id"`
+	TargetID int `json:"target_id"`
+	TraceOptions
 }
 
 // QueueStatus provides visibility into the queue state
@@ -36,6 +63,7 @@ type QueueStatus struct {
 	Running *Task  `json:"running"`
 	Queued  []Task `json:"queued"`
 	Length  int    `json:"length"`
+	Paused  bool   `json:"paused"`
 }
 
 // TaskQueue manages task execution with priority ordering
@@ -46,8 +74,19 @@ type TaskQueue struct {
 	running  *Task
 	stopChan chan struct{}
 	stopped  bool
+	paused   bool
+
+	ctx           context.Context // ended by Stop
+	stop          context.CancelCauseFunc
+	cancelRunning context.CancelCauseFunc
 
 	OnStatus func(string)
+	// OnChange is called after tasks were queued, started, finished,
+	// cancelled or reordered and when dispatch is paused or resumed
+	OnChange func(QueueStatus)
+	// OnDropped is called for queued tasks removed without running: cancelled
+	// ones, and those replaced by a task of the same type and higher priority
+	OnDropped func(t Task, replacedBy *Task)
 }
 
 // NewTaskQueue creates a new task queue
@@ -56,23 +95,44 @@ func NewTaskQueue() *TaskQueue {
 		tasks:    make([]Task, 0),
 		stopChan: make(chan struct{}),
 	}
+	q.ctx, q.stop = context.WithCancelCause(context.Background())
 	q.cond = sync.NewCond(&q.mu)
 	return q
 }
 
-// Enqueue adds a task to the queue
+// newTaskID returns an ID unique across the task history
+func newTaskID() string {
+	return uuid.NewString()
+}
+
+// Enqueue adds a task to the queue and reports whether it was queued; a task
+// of the same type already queued or running at the same or a higher
+// priority makes it redundant.
 // High priority tasks are inserted before normal priority tasks
-func (q *TaskQueue) Enqueue(t Task) {
+func (q *TaskQueue) Enqueue(t Task) bool {
 	q.mu.Lock()
-	defer q.mu.Unlock()
+	queued, replaced := q.enqueueLocked(t)
+	q.mu.Unlock()
+	if replaced != nil && q.OnDropped != nil {
+		q.OnDropped(*replaced, &queued)
+	}
+	if queued.ID == "" {
+		return false
+	}
+	q.changed()
+	return true
+}
 
+// enqueueLocked inserts t and returns it, or a zero Task if it wasn't
+// queued, and the task it replaced (must hold lock)
+func (q *TaskQueue) enqueueLocked(t Task) (Task, *Task) {
 	if q.stopped {
-		return
+		return Task{}, nil
 	}
 
 	// Generate ID if not set
 	if t.ID == "" {
-		t.ID = uuid.New().String()[:8]
+		t.ID = newTaskID()
 	}
 	if t.CreatedAt.IsZero() {
 		t.CreatedAt = time.Now()
@@ -82,57 +142,63 @@ func (q *TaskQueue) Enqueue(t Task) {
 	if q.running != nil && q.running.Type == t.Type {
 		// Same type already running, only enqueue if higher priority
 		if t.Priority <= q.running.Priority {
-			return
+			return Task{}, nil
 		}
 	}
 
 	// Check if same type already queued
+	var replaced *Task
 	for _, existing := range q.tasks {
 		if existing.Type == t.Type {
 			// Same type already queued, only keep if this one is higher priority
 			if t.Priority <= existing.Priority {
-				return
+				return Task{}, nil
 			}
 			// Remove the lower priority one
 			q.removeTaskLocked(existing.ID)
+			replaced = &existing
 			break
 		}
 	}
 
 	// Insert based on priority (high priority first)
-	inserted := false
+	q.insertLocked(t, false)
+	q.cond.Signal()
+	return t, replaced
+}
+
+// insertLocked inserts t behind the tasks of higher priority and, unless
+// ahead is set, behind those of equal priority too (must hold lock)
+func (q *TaskQueue) insertLocked(t Task, ahead bool) {
 	for i, existing := range q.tasks {
-		if t.Priority > existing.Priority {
+		if t.Priority > existing.Priority || (ahead && t.Priority == existing.Priority) {
 			// Insert before this task
 			q.tasks = append(q.tasks[:i], append([]Task{t}, q.tasks[i:]...)...)
-			inserted = true
-			break
+			return
 		}
 	}
-	if !inserted {
-		q.tasks = append(q.tasks, t)
-	}
-
-	q.cond.Signal()
+	q.tasks = append(q.tasks, t)
 }
 
-// removeTaskLocked removes a task by ID (must hold lock)
-func (q *TaskQueue) removeTaskLocked(id string) {
+// removeTaskLocked removes a task by ID and reports whether it was queued (must hold lock)
+func (q *TaskQueue) removeTaskLocked(id string) (Task, bool) {
 	for i, t := range q.tasks {
 		if t.ID == id {
 			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
-			return
+			return t, true
 		}
 	}
+	return Task{}, false
 }
 
-// Start begins processing tasks with the given executor function
-func (q *TaskQueue) Start(executor func(Task)) {
+// Start begins processing tasks with the given executor function. The
+// context it gets ends when the task is cancelled or the queue stopped.
+func (q *TaskQueue) Start(executor func(context.Context, Task)) {
 	go func() {
 		for {
 			q.mu.Lock()
-			// Wait for task or stop signal
-			for len(q.tasks) == 0 && !q.stopped {
+			// Wait for task or stop signal; a paused queue keeps its tasks
+			for (len(q.tasks) == 0 || q.paused) && !q.stopped {
 				q.cond.Wait()
 			}
 
@@ -145,27 +211,98 @@ func (q *TaskQueue) Start(executor func(Task)) {
 			task := q.tasks[0]
 			q.tasks = q.tasks[1:]
 			q.running = &task
+			ctx, cancel := context.WithCancelCause(q.ctx)
+			q.cancelRunning = cancel
 			q.mu.Unlock()
+			q.changed()
 
 			// Execute task
-			executor(task)
+			executor(ctx, task)
 
 			// Clear running state
 			q.mu.Lock()
 			q.running = nil
+			q.cancelRunning = nil
 			q.mu.Unlock()
+			cancel(nil)
+			q.changed()
 		}
 	}()
 }
 
-// Stop signals the queue to stop processing
+// Stop signals the queue to stop processing and cancels the running task
 func (q *TaskQueue) Stop() {
 	q.mu.Lock()
 	q.stopped = true
 	q.mu.Unlock()
+	q.stop(ErrCancelled)
 	q.cond.Signal()
 }
 
+// Cancel drops a queued task or aborts the running one, whose tests stop
+// their workers. It reports whether a task with that ID was found.
+func (q *TaskQueue) Cancel(id string) bool {
+	q.mu.Lock()
+	t, queued := q.removeTaskLocked(id)
+	found := queued
+	if !found && q.running != nil && q.running.ID == id {
+		q.cancelRunning(ErrCancelled)
+		found = true
+	}
+	q.mu.Unlock()
+	if queued && q.OnDropped != nil {
+		q.OnDropped(t, nil)
+	}
+	if found {
+		q.changed()
+	}
+	return found
+}
+
+// SetPriority moves a queued task ahead of every other task of priority p or
+// lower, e.g. to run it next. It reports whether the task was queued.
+func (q *TaskQueue) SetPriority(id string, p TaskPriority) bool {
+	q.mu.Lock()
+	t, found := q.removeTaskLocked(id)
+	if found {
+		t.Priority = p
+		q.insertLocked(t, true)
+	}
+	q.mu.Unlock()
+	if found {
+		q.changed()
+	}
+	return found
+}
+
+// Pause stops dispatching queued tasks; the running task carries on
+func (q *TaskQueue) Pause() {
+	q.setPaused(true)
+}
+
+// Resume dispatches queued tasks again
+func (q *TaskQueue) Resume() {
+	q.setPaused(false)
+}
+
+func (q *TaskQueue) setPaused(paused bool) {
+	q.mu.Lock()
+	changed := q.paused != paused
+	q.paused = paused
+	q.mu.Unlock()
+	if changed {
+		q.cond.Signal()
+		q.changed()
+	}
+}
+
+// changed reports the current status to OnChange (must not hold lock)
+func (q *TaskQueue) changed() {
+	if q.OnChange != nil {
+		q.OnChange(q.GetStatus())
+	}
+}
+
 // GetStatus returns current queue status
 func (q *TaskQueue) GetStatus() QueueStatus {
 	q.mu.Lock()
@@ -185,6 +322,7 @@ func (q *TaskQueue) GetStatus() QueueStatus {
 		Running: running,
 		Queued:  queued,
 		Length:  len(q.tasks),
+		Paused:  q.paused,
 	}
 }
 
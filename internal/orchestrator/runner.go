@@ -1,137 +1,439 @@
 package orchestrator
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"golang.org/x/crypto/ssh"
+
 	"github.com/user/homelab-speedtest/internal/db"
 )
 
+// DefaultServerStartTimeout is how long a worker server may take to start listening
+const DefaultServerStartTimeout = 15 * time.Second
+
+// ErrIncompatibleWorker means the deployed worker speaks a different protocol version
+var ErrIncompatibleWorker = errors.New("incompatible worker")
+
+// serverStopTimeout is how long a worker server gets to exit after its stdin is closed
+const serverStopTimeout = 5 * time.Second
+
 type Orchestrator struct {
 	WorkerBinaryPath string
-	WorkerPort       int
+
+	// PortRange is where worker servers listen unless the device has its own range
+	PortRange PortRange
+
+	// Defaults for speed tests
+	SpeedDirection string // forward, reverse, bidir
+	SpeedParallel  int    // parallel TCP streams
+
+	// Ping probe train settings
+	PingCount       int
+	PingInterval    time.Duration
+	PingPayloadSize int
+
+	// ServerStartTimeout bounds the wait for the remote worker server's ready line
+	ServerStartTimeout time.Duration
+
+	// HostKeys verifies device host keys; nil accepts any key
+	HostKeys *HostKeyStore
+
+	// Pool reuses SSH connections to devices across tests
+	Pool *SSHPool
+
+	// Agents are the workers in agent mode connected to the server
+	Agents *AgentHub
+
+	// LookupDevice resolves jump_device_id references
+	LookupDevice func(id int) (*db.Device, error)
+
+	// OnWorkerDeployed is called after the worker on a device was verified or redeployed
+	OnWorkerDeployed func(dev db.Device, info db.WorkerInfo)
+
+	// OnWorkerRemoved is called after the worker was removed from a device
+	OnWorkerRemoved func(dev db.Device)
+
+	// NewExecutor overrides how devices are reached, e.g. with fakes in tests;
+	// nil picks each device's transport
+	NewExecutor func(dev db.Device) (Executor, error)
+
+	localWorker   localWorker
+	localVerified sync.Map // device ID -> checksum of the worker last verified locally
 }
 
 func NewOrchestrator(workerPath string, workerPort int) *Orchestrator {
 	if workerPort <= 0 {
 		workerPort = 8090 // default port
 	}
-	return &Orchestrator{
+	o := &Orchestrator{
 		WorkerBinaryPath: workerPath,
-		WorkerPort:       workerPort,
+		PortRange:        PortRange{Min: workerPort, Max: workerPort},
+		SpeedDirection:   DirectionForward,
+		SpeedParallel:    1,
+		PingCount:        10,
+		PingInterval:     200 * time.Millisecond,
+		PingPayloadSize:  64,
+
+		ServerStartTimeout: DefaultServerStartTimeout,
 	}
+	o.Pool = NewSSHPool(o.connect, DefaultSSHIdleTTL)
+	o.Pool.Jumps = o.jumpDevices
+	o.Agents = NewAgentHub()
+	return o
 }
 
-func (o *Orchestrator) RunSpeedTest(source, target db.Device) (*WorkerResponse, error) {
-	log.Printf("[Orchestrator] Starting Speed Test: %s -> %s", source.Name, target.Name)
+// SpeedTestOptions tunes a single speed test; zero values mean "use the default".
+// OmitSeconds is a pointer since 0 is a meaningful override: no warm-up.
+type SpeedTestOptions struct {
+	Direction       string `json:"direction,omitempty"`        // forward (default), reverse or bidir
+	Parallel        int    `json:"parallel,omitempty"`         // TCP streams, default 1
+	DurationSeconds int    `json:"duration_seconds,omitempty"` // measured test length
+	BufferSize      int    `json:"buffer_size,omitempty"`      // write buffer in bytes
+	OmitSeconds     *int   `json:"omit_seconds,omitempty"`     // warm-up excluded from the result
 
-	sourceClient, err := ConnectSSH(source.SSHUser, source.Hostname, source.SSHPort, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to source %s: %w", source.Name, err)
+	SampleIntervalMs int `json:"sample_interval_ms,omitempty"` // throughput time series resolution
+}
+
+// Merge returns opts with every unset field taken from fallback
+func (opts SpeedTestOptions) Merge(fallback SpeedTestOptions) SpeedTestOptions {
+	if opts.Direction == "" {
+		opts.Direction = fallback.Direction
+	}
+	if opts.Parallel <= 0 {
+		opts.Parallel = fallback.Parallel
 	}
-	defer func() { _ = sourceClient.Close() }()
+	if opts.DurationSeconds <= 0 {
+		opts.DurationSeconds = fallback.DurationSeconds
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = fallback.BufferSize
+	}
+	if opts.OmitSeconds == nil {
+		opts.OmitSeconds = fallback.OmitSeconds
+	}
+	if opts.SampleIntervalMs <= 0 {
+		opts.SampleIntervalMs = fallback.SampleIntervalMs
+	}
+	return opts
+}
 
-	targetClient, err := ConnectSSH(target.SSHUser, target.Hostname, target.SSHPort, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to target %s: %w", target.Name, err)
+// Omit returns the warm-up to exclude in seconds, none unless set
+func (opts SpeedTestOptions) Omit() int {
+	if opts.OmitSeconds == nil {
+		return 0
 	}
-	defer func() { _ = targetClient.Close() }()
+	return *opts.OmitSeconds
+}
 
-	if err = o.deployWorker(sourceClient); err != nil {
-		return nil, fmt.Errorf("failed to deploy worker to source: %w", err)
+// WithDefaults fills in the worker defaults so the effective settings can be recorded
+func (opts SpeedTestOptions) WithDefaults() SpeedTestOptions {
+	return opts.Merge(SpeedTestOptions{
+		Direction:       DirectionForward,
+		Parallel:        1,
+		DurationSeconds: DefaultDurationSeconds,
+		BufferSize:      DefaultBufferSize,
+
+		SampleIntervalMs: DefaultSampleInterval,
+	})
+}
+
+// Validate rejects option values the worker can't honor
+func (opts SpeedTestOptions) Validate() error {
+	switch opts.Direction {
+	case "", DirectionForward, DirectionReverse, DirectionBidir:
+	default:
+		return fmt.Errorf("invalid direction %q", opts.Direction)
 	}
-	if err = o.deployWorker(targetClient); err != nil {
-		return nil, fmt.Errorf("failed to deploy worker to target: %w", err)
+	if opts.Parallel < 0 || opts.Parallel > 128 {
+		return fmt.Errorf("parallel must be between 1 and 128")
+	}
+	if opts.DurationSeconds < 0 || opts.DurationSeconds > 300 {
+		return fmt.Errorf("duration_seconds must be between 1 and 300")
 	}
+	if opts.BufferSize < 0 || (opts.BufferSize > 0 && opts.BufferSize < 1024) || opts.BufferSize > 16*1024*1024 {
+		return fmt.Errorf("buffer_size must be between 1024 and 16777216 bytes")
+	}
+	if o := opts.OmitSeconds; o != nil && (*o < 0 || *o > 60) {
+		return fmt.Errorf("omit_seconds must be between 0 and 60")
+	}
+	if opts.SampleIntervalMs < 0 || (opts.SampleIntervalMs > 0 && opts.SampleIntervalMs < 100) || opts.SampleIntervalMs > 60000 {
+		return fmt.Errorf("sample_interval_ms must be between 100 and 60000")
+	}
+	return nil
+}
 
-	_, _, _ = targetClient.RunCommand(fmt.Sprintf("fuser -k %d/tcp || pkill -f 'mode server -port %d'", o.WorkerPort, o.WorkerPort))
-	time.Sleep(1 * time.Second)
+func (o *Orchestrator) RunSpeedTest(ctx context.Context, source, target db.Device, opts SpeedTestOptions) (*WorkerResponse, error) {
+	opts = opts.WithDefaults()
+	log.Printf("[Orchestrator] Starting Speed Test: %s -> %s (%s, %d streams, %ds + %ds omit, %dB buffer)",
+		source.Name, target.Name, opts.Direction, opts.Parallel, opts.DurationSeconds, opts.Omit(), opts.BufferSize)
+
+	return o.runAgainstServer(ctx, source, target, WorkerRequest{
+		Mode:             ModeClient,
+		Direction:        opts.Direction,
+		Parallel:         opts.Parallel,
+		DurationSeconds:  opts.DurationSeconds,
+		BufferSize:       opts.BufferSize,
+		OmitSeconds:      opts.Omit(),
+		SampleIntervalMs: opts.SampleIntervalMs,
+	})
+}
 
-	serverCmd := fmt.Sprintf("/tmp/hl-speedtest-worker -mode server -port %d", o.WorkerPort)
-	go func() {
-		_, _, _ = targetClient.RunCommand(serverCmd)
-	}()
-	time.Sleep(3 * time.Second)
+func (o *Orchestrator) RunPing(ctx context.Context, source, target db.Device) (*WorkerResponse, error) {
+	log.Printf("[Orchestrator] Starting Ping Test: %s -> %s", source.Name, target.Name)
 
-	targetAddr := target.Hostname
-	if target.IP != "" {
-		targetAddr = target.IP
-	}
+	return o.runAgainstServer(ctx, source, target, o.probeRequest(ModePing))
+}
 
-	clientCmd := fmt.Sprintf("/tmp/hl-speedtest-worker -mode client -target %s:%d", targetAddr, o.WorkerPort)
-	stdout, stderr, errClient := sourceClient.RunCommand(clientCmd)
+// RunBufferbloat measures idle latency and latency while the speed test load runs
+func (o *Orchestrator) RunBufferbloat(ctx context.Context, source, target db.Device, opts SpeedTestOptions) (*WorkerResponse, error) {
+	opts = opts.WithDefaults()
+	log.Printf("[Orchestrator] Starting Bufferbloat Test: %s -> %s (%s, %d streams, %ds)",
+		source.Name, target.Name, opts.Direction, opts.Parallel, opts.DurationSeconds)
+
+	req := o.probeRequest(ModeBufferbloat)
+	req.Direction = opts.Direction
+	req.Parallel = opts.Parallel
+	req.DurationSeconds = opts.DurationSeconds
+	req.BufferSize = opts.BufferSize
+	req.OmitSeconds = opts.Omit()
+	return o.runAgainstServer(ctx, source, target, req)
+}
 
-	// Cleanup
-	_, _, _ = targetClient.RunCommand(fmt.Sprintf("fuser -k %d/tcp || pkill -f 'mode server -port %d'", o.WorkerPort, o.WorkerPort))
+// TraceOptions tunes an on-demand traceroute; zero values mean "use the default"
+type TraceOptions struct {
+	Protocol string `json:"protocol,omitempty"` // udp (default) or tcp
+	MaxHops  int    `json:"max_hops,omitempty"` // default 30
+}
 
-	if errClient != nil {
-		return nil, fmt.Errorf("client failed: %w, stdout: %s, stderr: %s", errClient, stdout, stderr)
+// Validate rejects option values the worker can't honor
+func (opts TraceOptions) Validate() error {
+	switch opts.Protocol {
+	case "", TraceUDP, TraceTCP:
+	default:
+		return fmt.Errorf("invalid protocol %q", opts.Protocol)
+	}
+	if opts.MaxHops < 0 || opts.MaxHops > MaxTraceHops {
+		return fmt.Errorf("max_hops must be between 1 and %d", MaxTraceHops)
+	}
+	return nil
+}
+
+// RunTrace traces the route from source to the worker server on target
+func (o *Orchestrator) RunTrace(ctx context.Context, source, target db.Device, opts TraceOptions) (*WorkerResponse, error) {
+	if opts.Protocol == "" {
+		opts.Protocol = TraceUDP
 	}
+	log.Printf("[Orchestrator] Starting Trace: %s -> %s (%s)", source.Name, target.Name, opts.Protocol)
 
-	return o.parseWorkerOutput(stdout, stderr)
+	return o.runAgainstServer(ctx, source, target, WorkerRequest{
+		Mode:     ModeTrace,
+		Protocol: opts.Protocol,
+		MaxHops:  opts.MaxHops,
+	})
 }
 
-func (o *Orchestrator) RunPing(source, target db.Device) (*WorkerResponse, error) {
-	log.Printf("[Orchestrator] Starting Ping Test: %s -> %s", source.Name, target.Name)
+// RunPMTU discovers the path MTU from source to target
+func (o *Orchestrator) RunPMTU(ctx context.Context, source, target db.Device) (*WorkerResponse, error) {
+	log.Printf("[Orchestrator] Starting Path MTU Discovery: %s -> %s", source.Name, target.Name)
+
+	return o.runAgainstServer(ctx, source, target, WorkerRequest{Mode: ModePMTU})
+}
 
-	sourceClient, err := ConnectSSH(source.SSHUser, source.Hostname, source.SSHPort, nil)
+// probeRequest returns a request for mode with the configured probe train
+func (o *Orchestrator) probeRequest(mode string) WorkerRequest {
+	return WorkerRequest{
+		Mode:        mode,
+		Count:       o.PingCount,
+		IntervalMs:  int(o.PingInterval.Milliseconds()),
+		PayloadSize: o.PingPayloadSize,
+	}
+}
+
+// runAgainstServer starts a worker server on target, sends req (with Target
+// filled in) to the worker on source and parses its result. When ctx ends
+// first, both workers are stopped and the error wraps context.Cause(ctx).
+func (o *Orchestrator) runAgainstServer(ctx context.Context, source, target db.Device, req WorkerRequest) (*WorkerResponse, error) {
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+	sourceExec, err := o.executor(source)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to source %s: %w", source.Name, err)
 	}
-	defer func() { _ = sourceClient.Close() }()
+	defer func() { _ = sourceExec.Close() }()
 
-	targetClient, err := ConnectSSH(target.SSHUser, target.Hostname, target.SSHPort, nil)
+	targetExec, err := o.executor(target)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to target %s: %w", target.Name, err)
 	}
-	defer func() { _ = targetClient.Close() }()
+	defer func() { _ = targetExec.Close() }()
 
-	if err = o.deployWorker(sourceClient); err != nil {
+	if err = sourceExec.Deploy(ctx); err != nil {
 		return nil, fmt.Errorf("failed to deploy worker to source: %w", err)
 	}
-	if err = o.deployWorker(targetClient); err != nil {
+	if err = targetExec.Deploy(ctx); err != nil {
 		return nil, fmt.Errorf("failed to deploy worker to target: %w", err)
 	}
 
-	_, _, _ = targetClient.RunCommand(fmt.Sprintf("fuser -k %d/tcp || pkill -f 'mode server -port %d'", o.WorkerPort, o.WorkerPort))
-	time.Sleep(1 * time.Second)
-
-	serverCmd := fmt.Sprintf("/tmp/hl-speedtest-worker -mode server -port %d", o.WorkerPort)
-	go func() {
-		_, _, _ = targetClient.RunCommand(serverCmd)
-	}()
-	time.Sleep(3 * time.Second)
+	ports := o.portRange(target)
+	server, ready, err := o.startServer(ctx, targetExec, ports)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start worker server on %s: %w", target.Name, err)
+	}
+	defer server.Stop(serverStopTimeout)
 
 	targetAddr := target.Hostname
 	if target.IP != "" {
 		targetAddr = target.IP
 	}
 
-	cmd := fmt.Sprintf("/tmp/hl-speedtest-worker -mode ping -target %s:%d", targetAddr, o.WorkerPort)
-	stdout, stderr, errPing := sourceClient.RunCommand(cmd)
+	req.ProtocolVersion = ProtocolVersion
+	req.HoldStdin = true
+	req.Target = net.JoinHostPort(targetAddr, strconv.Itoa(ready.Port))
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("encoding worker request: %w", err)
+	}
+	stdout, stderr, errClient := sourceExec.Run(ctx, append(payload, '\n'))
 
-	// Cleanup
-	_, _, _ = targetClient.RunCommand(fmt.Sprintf("fuser -k %d/tcp || pkill -f 'mode server -port %d'", o.WorkerPort, o.WorkerPort))
+	if errClient != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s on %s: %w", req.Mode, source.Name, context.Cause(ctx))
+		}
+		if strings.Contains(stderr, "flag provided but not defined") {
+			return nil, fmt.Errorf("%w: the worker on %s predates protocol version %d; rebuild the server's worker binary %s",
+				ErrIncompatibleWorker, source.Name, ProtocolVersion, o.WorkerBinaryPath)
+		}
+		return nil, fmt.Errorf("%s failed: %w, stdout: %s, stderr: %s", req.Mode, errClient, stdout, stderr)
+	}
+
+	return parseWorkerOutput(stdout, stderr, ports)
+}
+
+// connect opens an SSH connection to dev with its credential, through its
+// jump hosts if it has any, verifying its host key if a store is configured
+func (o *Orchestrator) connect(dev db.Device) (*SSHClient, error) {
+	auth, release, err := AuthMethods(dev.Credential)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var hostKeyCallback ssh.HostKeyCallback
+	if o.HostKeys != nil {
+		hostKeyCallback = o.HostKeys.Callback(dev)
+	}
+	jump, closeJump, err := o.dialJump(dev)
+	if err != nil {
+		return nil, err
+	}
+	client, err := ConnectSSH(dev.SSHUser, dev.Hostname, dev.SSHPort, auth, hostKeyCallback, jump)
+	if err != nil {
+		closeJump()
+		return nil, err
+	}
+	client.closeJump = closeJump
+	return client, nil
+}
 
-	if errPing != nil {
-		return nil, fmt.Errorf("ping failed: %w, stdout: %s, stderr: %s", errPing, stdout, stderr)
+// startServer starts the worker in server mode on a port from ports and
+// waits until it reports which one it is listening on. The server runs until
+// its stdin is closed, so stopping the returned process (or losing the SSH
+// connection) shuts it down.
+func (o *Orchestrator) startServer(ctx context.Context, target Executor, ports PortRange) (Process, ServerReady, error) {
+	payload, err := json.Marshal(WorkerRequest{
+		ProtocolVersion: ProtocolVersion,
+		Mode:            ModeServer,
+		Port:            ports.Min,
+		PortMax:         ports.Max,
+	})
+	if err != nil {
+		return nil, ServerReady{}, fmt.Errorf("encoding worker request: %w", err)
 	}
 
-	return o.parseWorkerOutput(stdout, stderr)
+	stderr := &lockedBuffer{}
+	proc, err := target.Start(append(payload, '\n'), stderr)
+	if err != nil {
+		return nil, ServerReady{}, err
+	}
+	ready, err := waitForReady(ctx, proc.Output(), o.ServerStartTimeout)
+	if err != nil {
+		proc.Stop(0)
+		if ctx.Err() != nil {
+			return nil, ServerReady{}, err
+		}
+		return nil, ServerReady{}, fmt.Errorf("%w (ports: %s, stderr: %s)", err, ports, strings.TrimSpace(stderr.String()))
+	}
+	return proc, ready, nil
 }
 
-func (o *Orchestrator) deployWorker(client *SSHClient) error {
-	remotePath := "/tmp/hl-speedtest-worker"
-	if client.FileExists(remotePath) {
-		return nil
+// waitForReady reads the server's stdout until its ready line arrives or ctx
+// ends. The rest of the output is drained in the background so the server
+// never blocks.
+func waitForReady(ctx context.Context, stdout io.Reader, timeout time.Duration) (ServerReady, error) {
+	if timeout <= 0 {
+		timeout = DefaultServerStartTimeout
 	}
-	return client.CopyFile(o.WorkerBinaryPath, remotePath, 0755)
+	found := make(chan ServerReady, 1)
+	go func() {
+		signalled := false
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			var ready ServerReady
+			if !signalled && json.Unmarshal(scanner.Bytes(), &ready) == nil && ready.Ready {
+				found <- ready
+				signalled = true
+			}
+		}
+		if !signalled {
+			close(found)
+		}
+	}()
+
+	select {
+	case ready, ok := <-found:
+		if !ok {
+			return ServerReady{}, errors.New("worker server exited before it was ready")
+		}
+		return ready, nil
+	case <-time.After(timeout):
+		return ServerReady{}, fmt.Errorf("worker server not ready after %v (an outdated worker binary doesn't announce readiness)", timeout)
+	case <-ctx.Done():
+		return ServerReady{}, context.Cause(ctx)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for a writer and a reader in different goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
 }
 
-func (o *Orchestrator) parseWorkerOutput(stdout, stderr string) (*WorkerResponse, error) {
+// parseWorkerOutput decodes the worker's reply; ports is the target's port range for error hints
+func parseWorkerOutput(stdout, stderr string, ports PortRange) (*WorkerResponse, error) {
 	var resp WorkerResponse
 
 	// We expect JSON on stdout. If it's empty but stderr has content, use that for error.
@@ -139,55 +441,66 @@ func (o *Orchestrator) parseWorkerOutput(stdout, stderr string) (*WorkerResponse
 		return nil, fmt.Errorf("no output on stdout. stderr: %s", stderr)
 	}
 
-	jsonStart := -1
-	for i := 0; i < len(stdout); i++ {
-		if stdout[i] == '{' {
-			jsonStart = i
-			break
-		}
-	}
-
-	if jsonStart == -1 {
+	// The envelope is the last line the worker prints
+	line := stdout[strings.LastIndexByte(stdout, '\n')+1:]
+	if !strings.HasPrefix(line, "{") {
 		return nil, fmt.Errorf("no JSON found in stdout: %s (stderr: %s)", stdout, stderr)
 	}
 
-	if err := json.Unmarshal([]byte(stdout[jsonStart:]), &resp); err != nil {
+	var env WorkerEnvelope
+	if err := json.Unmarshal([]byte(line), &env); err != nil {
 		return nil, fmt.Errorf("json parse failed: %w, raw: %s (stderr: %s)", err, stdout, stderr)
 	}
 
+	switch env.ProtocolVersion {
+	case ProtocolVersion:
+	case 0:
+		return nil, fmt.Errorf("%w: worker output has no protocol version, the worker binary is outdated", ErrIncompatibleWorker)
+	default:
+		return nil, fmt.Errorf("%w: worker %s on %s speaks protocol version %d, expected %d",
+			ErrIncompatibleWorker, env.WorkerVersion, env.Hostname, env.ProtocolVersion, ProtocolVersion)
+	}
+	resp = env.Response
+
 	if !resp.Success {
-		errMsg := o.enhanceErrorMessage(resp.Error, stderr)
+		errMsg := enhanceErrorMessage(resp.Error, stderr, ports)
 		return &resp, fmt.Errorf("worker reported failure: %s", errMsg)
 	}
 
 	return &resp, nil
 }
 
-// enhanceErrorMessage adds helpful hints for common connection errors
-func (o *Orchestrator) enhanceErrorMessage(errMsg, stderr string) string {
+// enhanceErrorMessage adds helpful hints for common connection errors.
+// ports is the range the target's worker server listens in.
+func enhanceErrorMessage(errMsg, stderr string, ports PortRange) string {
 	combined := errMsg + " " + stderr
 
 	// Check for common connection errors and add hints
 	if strings.Contains(combined, "no route to host") {
-		return fmt.Sprintf("%s (stderr: %s) [Hint: Check if the target device's firewall allows incoming connections on port %d. "+
-			"For iptables: 'sudo iptables -A INPUT -p tcp --dport %d -j ACCEPT'. "+
-			"For firewalld: 'sudo firewall-cmd --add-port=%d/tcp --permanent && sudo firewall-cmd --reload'. "+
-			"For ufw: 'sudo ufw allow %d/tcp']",
-			errMsg, stderr, o.WorkerPort, o.WorkerPort, o.WorkerPort, o.WorkerPort)
+		if ports.Ephemeral() {
+			return fmt.Sprintf("%s (stderr: %s) [Hint: The worker server listens on an ephemeral port, which the target device's firewall likely blocks. "+
+				"Set WORKER_PORT_RANGE or a worker port range on the device and allow that range (tcp for speed tests, udp for ping)]",
+				errMsg, stderr)
+		}
+		return fmt.Sprintf("%s (stderr: %s) [Hint: Check if the target device's firewall allows incoming connections on %s (tcp for speed tests, udp for ping). "+
+			"For iptables: 'sudo iptables -A INPUT -p tcp --dport %s -j ACCEPT' (and '-p udp'). "+
+			"For firewalld: 'sudo firewall-cmd --add-port=%s/tcp --add-port=%s/udp --permanent && sudo firewall-cmd --reload'. "+
+			"For ufw: 'sudo ufw allow %s/tcp && sudo ufw allow %s/udp']",
+			errMsg, stderr, ports.describe(), ports.format(":"), ports, ports, ports.format(":"), ports.format(":"))
 	}
 
 	if strings.Contains(combined, "connection refused") {
-		return fmt.Sprintf("%s (stderr: %s) [Hint: The worker server may not be running on port %d. "+
+		return fmt.Sprintf("%s (stderr: %s) [Hint: The worker server may not be running on %s. "+
 			"This could indicate: 1) The worker failed to start on the target device, "+
 			"2) The target IP/hostname is incorrect, or "+
 			"3) A firewall is blocking the connection]",
-			errMsg, stderr, o.WorkerPort)
+			errMsg, stderr, ports.describe())
 	}
 
 	if strings.Contains(combined, "connection timed out") || strings.Contains(combined, "i/o timeout") {
-		return fmt.Sprintf("%s (stderr: %s) [Hint: Connection timed out to port %d. "+
-			"Check network connectivity between devices and ensure firewall rules allow traffic on this port]",
-			errMsg, stderr, o.WorkerPort)
+		return fmt.Sprintf("%s (stderr: %s) [Hint: Connection timed out to %s. "+
+			"Check network connectivity between devices and ensure firewall rules allow traffic on these ports]",
+			errMsg, stderr, ports.describe())
 	}
 
 	// Default: just return with stderr
@@ -1,6 +1,10 @@
 package orchestrator
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"time"
 
@@ -25,6 +29,12 @@ type Scheduler struct {
 	OnScheduleInfo func([]ScheduleInfo)
 	OnQueueStatus  func(QueueStatus)
 
+	// TestTimeout bounds each test on top of its own duration, unless the
+	// pair has a timeout of its own; 0 means no limit
+	TestTimeout time.Duration
+	// TaskTimeout bounds a whole task, e.g. all speed tests; 0 means no limit
+	TaskTimeout time.Duration
+
 	// Schedule tracking
 	pingInterval  time.Duration
 	speedInterval time.Duration
@@ -32,6 +42,10 @@ type Scheduler struct {
 	speedEnabled  bool
 	nextPingRun   time.Time
 	nextSpeedRun  time.Time
+
+	bufferbloatInterval time.Duration
+	bufferbloatEnabled  bool
+	nextBufferbloatRun  time.Time
 }
 
 func NewScheduler(d *db.DB, orch *Orchestrator) *Scheduler {
@@ -43,6 +57,10 @@ func NewScheduler(d *db.DB, orch *Orchestrator) *Scheduler {
 		speedInterval: 15 * time.Minute,
 		pingEnabled:   true,
 		speedEnabled:  true,
+
+		bufferbloatInterval: 1 * time.Hour,
+
+		TestTimeout: DefaultTestTimeout,
 	}
 
 	// Initialize task queue
@@ -52,6 +70,18 @@ func NewScheduler(d *db.DB, orch *Orchestrator) *Scheduler {
 			s.OnStatus(msg)
 		}
 	}
+	s.queue.OnChange = func(status QueueStatus) {
+		if s.OnQueueStatus != nil {
+			s.OnQueueStatus(status)
+		}
+	}
+	s.queue.OnDropped = func(t Task, replacedBy *Task) {
+		rec := db.Task{ID: t.ID, Status: db.TaskCancelled}
+		if replacedBy != nil {
+			rec.Error = "replaced by task " + replacedBy.ID
+		}
+		s.finishTask(rec)
+	}
 
 	return s
 }
@@ -77,6 +107,15 @@ func (s *Scheduler) GetScheduleInfo() []ScheduleInfo {
 		}
 	}
 
+	bufferbloatNext := ""
+	if s.bufferbloatEnabled && !s.nextBufferbloatRun.IsZero() {
+		if s.nextBufferbloatRun.After(now) {
+			bufferbloatNext = s.nextBufferbloatRun.Format(time.RFC3339)
+		} else {
+			bufferbloatNext = now.Add(s.bufferbloatInterval).Format(time.RFC3339)
+		}
+	}
+
 	return []ScheduleInfo{
 		{
 			Type:     "ping",
@@ -90,6 +129,12 @@ func (s *Scheduler) GetScheduleInfo() []ScheduleInfo {
 			Enabled:  s.speedEnabled,
 			NextRun:  speedNext,
 		},
+		{
+			Type:     "bufferbloat",
+			Interval: s.bufferbloatInterval.String(),
+			Enabled:  s.bufferbloatEnabled,
+			NextRun:  bufferbloatNext,
+		},
 	}
 }
 
@@ -97,7 +142,41 @@ func (s *Scheduler) GetQueueStatus() QueueStatus {
 	return s.queue.GetStatus()
 }
 
+// CancelTask drops a queued task or aborts the running one
+func (s *Scheduler) CancelTask(id string) bool {
+	if !s.queue.Cancel(id) {
+		return false
+	}
+	log.Printf("Task %s cancelled", id)
+	return true
+}
+
+// SetTaskPriority moves a queued task ahead of the tasks of priority p or lower
+func (s *Scheduler) SetTaskPriority(id string, p TaskPriority) bool {
+	if !s.queue.SetPriority(id, p) {
+		return false
+	}
+	if err := s.db.SetTaskPriority(id, int(p)); err != nil {
+		log.Printf("Failed to record the priority of task %s: %v", id, err)
+	}
+	return true
+}
+
+// PauseQueue holds queued tasks until ResumeQueue, e.g. during maintenance
+func (s *Scheduler) PauseQueue() {
+	s.queue.Pause()
+	log.Println("Task queue paused")
+}
+
+func (s *Scheduler) ResumeQueue() {
+	s.queue.Resume()
+	log.Println("Task queue resumed")
+}
+
+// Start requeues the tasks a previous run left queued and starts running
+// them right away, so the On* callbacks must be set before calling it
 func (s *Scheduler) Start() {
+	s.restoreTasks()
 	// Start the queue worker
 	s.queue.Start(s.executeTask)
 	go s.runLoop()
@@ -114,24 +193,159 @@ func (s *Scheduler) Reload() {
 	log.Println("Scheduler reloaded")
 }
 
-func (s *Scheduler) executeTask(task Task) {
+func (s *Scheduler) executeTask(ctx context.Context, task Task) {
 	log.Printf("Executing task: %s (id=%s, priority=%d)", task.Type, task.ID, task.Priority)
-
-	// Broadcast queue status update
-	if s.OnQueueStatus != nil {
-		s.OnQueueStatus(s.queue.GetStatus())
+	if err := s.db.StartTask(task.ID); err != nil {
+		log.Printf("Failed to record the start of task %s: %v", task.ID, err)
 	}
+	ctx, cancel := withTimeout(ctx, "task", s.TaskTimeout)
+	defer cancel()
 
+	var pairs pairOutcomes
+	var err error
 	switch task.Type {
 	case TaskPingAll:
-		s.runAllPingsInternal()
+		err = s.runAllPingsInternal(ctx, &pairs)
 	case TaskSpeedAll:
-		s.runAllSpeedsInternal()
+		err = s.runAllSpeedsInternal(ctx, task.Options, &pairs)
+	case TaskBufferbloatAll:
+		err = s.runAllBufferbloatInternal(ctx, task.Options, &pairs)
+	case TaskTrace:
+		if task.Trace == nil {
+			err = errors.New("trace task without a device pair")
+			break
+		}
+		err = s.runTraceInternal(ctx, *task.Trace, &pairs)
+	default:
+		err = fmt.Errorf("unknown task type %q", task.Type)
 	}
+	s.finishTask(pairs.record(ctx, task.ID, err))
+}
+
+// pairOutcomes tallies how the device pairs of a task fared
+type pairOutcomes struct {
+	total, succeeded, failed, timedOut, cancelled int
+}
+
+func (p *pairOutcomes) add(err error) {
+	switch ErrorClass(err) {
+	case "":
+		p.succeeded++
+	case db.ErrorClassTimeout:
+		p.timedOut++
+	case db.ErrorClassCancelled:
+		p.cancelled++
+	default:
+		p.failed++
+	}
+}
+
+// record returns how a task ended. It failed when it couldn't run all its
+// pairs or when any of them failed or timed out.
+func (p pairOutcomes) record(ctx context.Context, id string, err error) db.Task {
+	rec := db.Task{
+		ID:             id,
+		Status:         db.TaskDone,
+		PairsTotal:     p.total,
+		PairsSucceeded: p.succeeded,
+		PairsFailed:    p.failed,
+		PairsTimedOut:  p.timedOut,
+		PairsCancelled: p.cancelled,
+	}
+	cause := context.Cause(ctx)
+	switch {
+	case errors.Is(cause, ErrCancelled):
+		rec.Status = db.TaskCancelled
+	case err != nil:
+		rec.Status, rec.Error = db.TaskFailed, err.Error()
+	case cause != nil:
+		rec.Status, rec.Error = db.TaskFailed, cause.Error()
+	case p.failed+p.timedOut > 0:
+		rec.Status = db.TaskFailed
+	}
+	return rec
+}
+
+func (s *Scheduler) finishTask(rec db.Task) {
+	if err := s.db.FinishTask(rec); err != nil {
+		log.Printf("Failed to record the end of task %s: %v", rec.ID, err)
+	}
+}
 
-	// Broadcast queue status after completion
-	if s.OnQueueStatus != nil {
-		s.OnQueueStatus(s.queue.GetStatus())
+// taskPayload is what a task record keeps of a task's options
+type taskPayload struct {
+	Options *SpeedTestOptions `json:"options,omitempty"`
+	Trace   *TraceTask        `json:"trace,omitempty"`
+}
+
+// enqueue records a new task and queues it, unless the queue already has an
+// equivalent one
+func (s *Scheduler) enqueue(t Task) bool {
+	t.ID = newTaskID()
+	t.CreatedAt = time.Now()
+	rec := db.Task{
+		ID:        t.ID,
+		Type:      string(t.Type),
+		Priority:  int(t.Priority),
+		Source:    string(t.Source),
+		CreatedAt: t.CreatedAt.UTC().Format(time.DateTime),
+	}
+	if t.Options != nil || t.Trace != nil {
+		rec.Payload, _ = json.Marshal(taskPayload{Options: t.Options, Trace: t.Trace})
+	}
+	// Recorded first, so the queue can't start the task before it exists
+	if err := s.db.AddTask(rec); err != nil {
+		log.Printf("Failed to record task %s: %v", t.ID, err)
+	}
+	if s.queue.Enqueue(t) {
+		return true
+	}
+	if err := s.db.DeleteTask(t.ID); err != nil {
+		log.Printf("Failed to forget redundant task %s: %v", t.ID, err)
+	}
+	return false
+}
+
+// restoreTasks queues the tasks left queued by the previous server process.
+// Tasks it left running are failed rather than retried, in case they are
+// what stopped it.
+func (s *Scheduler) restoreTasks() {
+	if n, err := s.db.FailRunningTasks("interrupted by a server restart"); err != nil {
+		log.Printf("Failed to close interrupted tasks: %v", err)
+	} else if n > 0 {
+		log.Printf("Marked %d interrupted task(s) as failed", n)
+	}
+
+	records, err := s.db.GetQueuedTasks()
+	if err != nil {
+		log.Printf("Failed to load queued tasks: %v", err)
+		return
+	}
+	for _, rec := range records {
+		t := Task{
+			ID:       rec.ID,
+			Type:     TaskType(rec.Type),
+			Priority: TaskPriority(rec.Priority),
+			Source:   TaskSource(rec.Source),
+		}
+		if created, err := time.ParseInLocation(time.DateTime, rec.CreatedAt, time.UTC); err != nil {
+			log.Printf("Task %s has an unreadable creation time, requeueing it as new: %v", rec.ID, err)
+		} else {
+			t.CreatedAt = created
+		}
+		if len(rec.Payload) > 0 {
+			var payload taskPayload
+			if err := json.Unmarshal(rec.Payload, &payload); err != nil {
+				s.finishTask(db.Task{ID: rec.ID, Status: db.TaskFailed, Error: "unreadable task options: " + err.Error()})
+				continue
+			}
+			t.Options, t.Trace = payload.Options, payload.Trace
+		}
+		if !s.queue.Enqueue(t) {
+			s.finishTask(db.Task{ID: rec.ID, Status: db.TaskCancelled, Error: "an equivalent task is already queued"})
+			continue
+		}
+		log.Printf("Requeued %s task %s from before the restart", t.Type, t.ID)
 	}
 }
 
@@ -141,6 +355,9 @@ func (s *Scheduler) runLoop() {
 	speedDuration := 15 * time.Minute
 	pingEnabled := true
 	speedEnabled := true
+	// Saturating every link is disruptive, so bufferbloat runs only when scheduled explicitly
+	bufferbloatDuration := 1 * time.Hour
+	bufferbloatEnabled := false
 
 	schedules, err := s.db.GetSchedules()
 	if err == nil {
@@ -157,6 +374,9 @@ func (s *Scheduler) runLoop() {
 			case "speed":
 				speedDuration = d
 				speedEnabled = sch.Enabled
+			case "bufferbloat":
+				bufferbloatDuration = d
+				bufferbloatEnabled = sch.Enabled
 			}
 		}
 	}
@@ -166,6 +386,8 @@ func (s *Scheduler) runLoop() {
 	s.speedInterval = speedDuration
 	s.pingEnabled = pingEnabled
 	s.speedEnabled = speedEnabled
+	s.bufferbloatInterval = bufferbloatDuration
+	s.bufferbloatEnabled = bufferbloatEnabled
 	now := time.Now()
 	if pingEnabled {
 		s.nextPingRun = now.Add(pingDuration)
@@ -173,6 +395,9 @@ func (s *Scheduler) runLoop() {
 	if speedEnabled {
 		s.nextSpeedRun = now.Add(speedDuration)
 	}
+	if bufferbloatEnabled {
+		s.nextBufferbloatRun = now.Add(bufferbloatDuration)
+	}
 
 	// Broadcast schedule info
 	if s.OnScheduleInfo != nil {
@@ -181,10 +406,13 @@ func (s *Scheduler) runLoop() {
 
 	pingTicker := time.NewTicker(pingDuration)
 	speedTicker := time.NewTicker(speedDuration)
+	bufferbloatTicker := time.NewTicker(bufferbloatDuration)
 	defer pingTicker.Stop()
 	defer speedTicker.Stop()
+	defer bufferbloatTicker.Stop()
 
-	log.Printf("Scheduler running with: Ping=%v (enabled=%v), Speed=%v (enabled=%v)", pingDuration, pingEnabled, speedDuration, speedEnabled)
+	log.Printf("Scheduler running with: Ping=%v (enabled=%v), Speed=%v (enabled=%v), Bufferbloat=%v (enabled=%v)",
+		pingDuration, pingEnabled, speedDuration, speedEnabled, bufferbloatDuration, bufferbloatEnabled)
 
 	for {
 		select {
@@ -199,9 +427,10 @@ func (s *Scheduler) runLoop() {
 					s.OnScheduleInfo(s.GetScheduleInfo())
 				}
 				// Enqueue with normal priority (scheduled)
-				s.queue.Enqueue(Task{
+				s.enqueue(Task{
 					Type:     TaskPingAll,
 					Priority: PriorityNormal,
+					Source:   SourceSchedule,
 				})
 			}
 		case <-speedTicker.C:
@@ -212,9 +441,24 @@ func (s *Scheduler) runLoop() {
 					s.OnScheduleInfo(s.GetScheduleInfo())
 				}
 				// Enqueue with normal priority (scheduled)
-				s.queue.Enqueue(Task{
+				s.enqueue(Task{
 					Type:     TaskSpeedAll,
 					Priority: PriorityNormal,
+					Source:   SourceSchedule,
+				})
+			}
+		case <-bufferbloatTicker.C:
+			if bufferbloatEnabled {
+				// Update next run time
+				s.nextBufferbloatRun = time.Now().Add(bufferbloatDuration)
+				if s.OnScheduleInfo != nil {
+					s.OnScheduleInfo(s.GetScheduleInfo())
+				}
+				// Enqueue with normal priority (scheduled)
+				s.enqueue(Task{
+					Type:     TaskBufferbloatAll,
+					Priority: PriorityNormal,
+					Source:   SourceSchedule,
 				})
 			}
 		}
@@ -222,72 +466,111 @@ func (s *Scheduler) runLoop() {
 }
 
 // RunAllPings enqueues a ping test with high priority (manual trigger)
-func (s *Scheduler) RunAllPings() {
-	s.queue.Enqueue(Task{
+func (s *Scheduler) RunAllPings(source TaskSource) {
+	if s.enqueue(Task{
 		Type:     TaskPingAll,
 		Priority: PriorityHigh,
-	})
-	log.Println("Manual ping test enqueued (high priority)")
+		Source:   source,
+	}) {
+		log.Printf("Manual ping test enqueued (high priority, %s)", source)
+	}
 }
 
-// RunAllSpeeds enqueues a speed test with high priority (manual trigger)
-func (s *Scheduler) RunAllSpeeds() {
-	s.queue.Enqueue(Task{
+// RunAllSpeeds enqueues a speed test with high priority (manual trigger).
+// Non-nil opts take precedence over the speed schedule's options.
+func (s *Scheduler) RunAllSpeeds(source TaskSource, opts *SpeedTestOptions) {
+	if s.enqueue(Task{
 		Type:     TaskSpeedAll,
 		Priority: PriorityHigh,
-	})
-	log.Println("Manual speed test enqueued (high priority)")
+		Source:   source,
+		Options:  opts,
+	}) {
+		log.Printf("Manual speed test enqueued (high priority, %s)", source)
+	}
+}
+
+// RunAllBufferbloat enqueues a latency-under-load test with high priority (manual trigger)
+func (s *Scheduler) RunAllBufferbloat(source TaskSource, opts *SpeedTestOptions) {
+	if s.enqueue(Task{
+		Type:     TaskBufferbloatAll,
+		Priority: PriorityHigh,
+		Source:   source,
+		Options:  opts,
+	}) {
+		log.Printf("Manual bufferbloat test enqueued (high priority, %s)", source)
+	}
+}
+
+// RunTrace enqueues a traceroute and path MTU discovery for one pair with high priority
+func (s *Scheduler) RunTrace(source TaskSource, t TraceTask) {
+	if s.enqueue(Task{
+		Type:     TaskTrace,
+		Priority: PriorityHigh,
+		Source:   source,
+		Trace:    &t,
+	}) {
+		log.Printf("Manual trace %d->%d enqueued (high priority, %s)", t.SourceID, t.TargetID, source)
+	}
 }
 
 // runAllPingsInternal executes all ping tests (called by queue worker)
-func (s *Scheduler) runAllPingsInternal() {
+func (s *Scheduler) runAllPingsInternal(ctx context.Context, pairs *pairOutcomes) error {
 	log.Println("Running Ping tests...")
 	devices, err := s.db.GetDevices()
 	if err != nil {
 		log.Printf("Failed to get devices: %v", err)
-		return
+		return err
 	}
+	pairs.total = len(devices) * (len(devices) - 1)
+	timeouts := s.pairTimeouts()
+	probes := time.Duration(s.orch.PingCount) * s.orch.PingInterval
 
+pairs:
 	for _, source := range devices {
 		for _, target := range devices {
 			if source.ID == target.ID {
 				continue
 			}
+			if aborted(ctx, "Ping tests") {
+				break pairs
+			}
 			// Run sequentially
 			func(src, dst db.Device) {
 				if s.OnStatus != nil {
 					s.OnStatus("Pinging " + src.Name + " -> " + dst.Name)
 				}
-				resp, err := s.orch.RunPing(src, dst)
-				var errStr string
-				var lat, jit, loss float64
+				testCtx, cancel := s.testContext(ctx, timeouts, src, dst, probes)
+				defer cancel()
+				resp, err := s.orch.RunPing(testCtx, src, dst)
+				pairs.add(err)
 
+				result := db.Result{SourceID: src.ID, TargetID: dst.ID, Type: "ping"}
 				if err != nil {
 					log.Printf("Ping %s->%s failed: %v", src.Name, dst.Name, err)
-					errStr = err.Error()
+					result.Error = err.Error()
+					result.ErrorClass = ErrorClass(err)
+					// A failed probe train still tells us how much was lost
+					if resp != nil {
+						result.PacketLoss = resp.PacketLoss
+					}
 				} else {
-					lat = resp.LatencyMs
-					jit = resp.JitterMs
-					loss = resp.PacketLoss
-					log.Printf("Ping %s->%s success: %.2fms", src.Name, dst.Name, lat)
+					result.LatencyMs = resp.LatencyMs
+					result.JitterMs = resp.JitterMs
+					result.PacketLoss = resp.PacketLoss
+					log.Printf("Ping %s->%s success: %.2fms (jitter %.2fms, loss %.1f%%)", src.Name, dst.Name,
+						result.LatencyMs, result.JitterMs, result.PacketLoss)
 				}
 
 				// Save result
-				if err := s.db.AddResult(src.ID, dst.ID, "ping", lat, jit, loss, 0, errStr); err != nil {
+				if id, err := s.db.SaveResult(result); err != nil {
 					log.Printf("Failed to save result: %v", err)
+				} else {
+					result.ID = id
 				}
 
 				if s.OnResult != nil {
-					s.OnResult(db.Result{
-						SourceID:   src.ID,
-						TargetID:   dst.ID,
-						Type:       "ping",
-						LatencyMs:  lat,
-						JitterMs:   jit,
-						PacketLoss: loss,
-						Timestamp:  time.Now().UTC().Format("2006-01-02 15:04:05"),
-						Error:      errStr,
-					})
+					result.Timestamp = time.Now().UTC().Format("2006-01-02 15:04:05")
+					s.OnResult(result)
 				}
 			}(source, target)
 		}
@@ -295,53 +578,202 @@ func (s *Scheduler) runAllPingsInternal() {
 	if s.OnStatus != nil {
 		s.OnStatus("Idle")
 	}
+	return nil
+}
+
+// scheduleOptions returns the test options configured on a schedule
+func (s *Scheduler) scheduleOptions(scheduleType string) SpeedTestOptions {
+	var opts SpeedTestOptions
+	schedules, err := s.db.GetSchedules()
+	if err != nil {
+		log.Printf("Failed to get schedules: %v", err)
+		return opts
+	}
+	for _, sch := range schedules {
+		if sch.Type == scheduleType {
+			opts.DurationSeconds = sch.DurationSeconds
+			opts.BufferSize = sch.BufferSize
+			// Stored as NULL when 0, so 0 means unset here
+			if sch.OmitSeconds > 0 {
+				omit := sch.OmitSeconds
+				opts.OmitSeconds = &omit
+			}
+		}
+	}
+	return opts
+}
+
+// loadTestOptions returns a resolver for the effective options of a TCP load test
+// between two devices. Options resolve as: task override, per-pair setting,
+// schedule, global default.
+func (s *Scheduler) loadTestOptions(scheduleType string, override *SpeedTestOptions) func(src, dst db.Device) SpeedTestOptions {
+	var taskOpts SpeedTestOptions
+	if override != nil {
+		taskOpts = *override
+	}
+	defaults := s.scheduleOptions(scheduleType).Merge(SpeedTestOptions{
+		Direction: s.orch.SpeedDirection,
+		Parallel:  s.orch.SpeedParallel,
+	})
+
+	// Per pair stream counts override the global default
+	streams := make(map[[2]int]int)
+	if pairSettings, err := s.db.GetPairSettings(); err != nil {
+		log.Printf("Failed to get pair settings: %v", err)
+	} else {
+		for _, ps := range pairSettings {
+			if ps.ParallelStreams != nil && *ps.ParallelStreams > 0 {
+				streams[[2]int{ps.SourceID, ps.TargetID}] = *ps.ParallelStreams
+			}
+		}
+	}
+
+	return func(src, dst db.Device) SpeedTestOptions {
+		var pairOpts SpeedTestOptions
+		if n, ok := streams[[2]int{src.ID, dst.ID}]; ok {
+			pairOpts.Parallel = n
+		}
+		return taskOpts.Merge(pairOpts).Merge(defaults).WithDefaults()
+	}
+}
+
+// pairTimeouts returns the per pair test timeouts, keyed by source and target ID
+func (s *Scheduler) pairTimeouts() map[[2]int]time.Duration {
+	timeouts := make(map[[2]int]time.Duration)
+	pairSettings, err := s.db.GetPairSettings()
+	if err != nil {
+		log.Printf("Failed to get pair settings: %v", err)
+		return timeouts
+	}
+	for _, ps := range pairSettings {
+		if ps.TimeoutSeconds != nil && *ps.TimeoutSeconds > 0 {
+			timeouts[[2]int{ps.SourceID, ps.TargetID}] = time.Duration(*ps.TimeoutSeconds) * time.Second
+		}
+	}
+	return timeouts
+}
+
+// testContext bounds one test between src and dst: the pair's timeout (or
+// TestTimeout) on top of runs, how long the test itself is meant to take
+func (s *Scheduler) testContext(ctx context.Context, timeouts map[[2]int]time.Duration, src, dst db.Device, runs time.Duration) (context.Context, context.CancelFunc) {
+	limit, ok := timeouts[[2]int{src.ID, dst.ID}]
+	if !ok {
+		limit = s.TestTimeout
+	}
+	if limit <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return withTimeout(ctx, "test", limit+runs)
+}
+
+// aborted reports whether a task's context ended, logging why the rest of
+// its tests are skipped
+func aborted(ctx context.Context, what string) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	log.Printf("%s stopped: %v", what, context.Cause(ctx))
+	return true
+}
+
+// traceDuration is the longest a traceroute may take: every probe of every
+// hop going unanswered
+func traceDuration(opts TraceOptions) time.Duration {
+	hops := opts.MaxHops
+	if hops <= 0 {
+		hops = DefaultTraceMaxHops
+	}
+	return time.Duration(hops*DefaultTraceQueries) * TraceProbeTimeout
+}
+
+// pmtuDuration is the longest path MTU discovery may take: a probe at the
+// minimum size plus a binary search over up to 64 KiB, every attempt at every
+// size going unanswered
+func pmtuDuration() time.Duration {
+	return (1 + 16) * PMTUAttempts * PMTUProbeTimeout
+}
+
+// loadTestDuration is how long a TCP load test runs, warm-up included
+func loadTestDuration(opts SpeedTestOptions) time.Duration {
+	return time.Duration(opts.DurationSeconds+opts.Omit()) * time.Second
 }
 
 // runAllSpeedsInternal executes all speed tests (called by queue worker)
-func (s *Scheduler) runAllSpeedsInternal() {
+func (s *Scheduler) runAllSpeedsInternal(ctx context.Context, override *SpeedTestOptions, pairs *pairOutcomes) error {
 	log.Println("Running Speed tests...")
 	devices, err := s.db.GetDevices()
 	if err != nil {
 		log.Printf("Failed to get devices: %v", err)
-		return
+		return err
 	}
+	pairs.total = len(devices) * (len(devices) - 1)
+	resolveOptions := s.loadTestOptions("speed", override)
+	timeouts := s.pairTimeouts()
 
+pairs:
 	for _, source := range devices {
 		for _, target := range devices {
 			if source.ID == target.ID {
 				continue
 			}
+			if aborted(ctx, "Speed tests") {
+				break pairs
+			}
 			// Run sequentially
 			func(src, dst db.Device) {
 				if s.OnStatus != nil {
 					s.OnStatus("Speed Test " + src.Name + " -> " + dst.Name)
 				}
-				resp, err := s.orch.RunSpeedTest(src, dst)
-				var errStr string
-				var bw float64
+				opts := resolveOptions(src, dst)
+				testCtx, cancel := s.testContext(ctx, timeouts, src, dst, loadTestDuration(opts))
+				defer cancel()
+				resp, err := s.orch.RunSpeedTest(testCtx, src, dst, opts)
+				pairs.add(err)
+
+				result := db.Result{
+					SourceID:  src.ID,
+					TargetID:  dst.ID,
+					Type:      "speed",
+					Direction: opts.Direction,
+					Streams:   opts.Parallel,
+					TestOptions: db.TestOptions{
+						DurationSeconds: opts.DurationSeconds,
+						BufferSize:      opts.BufferSize,
+						OmitSeconds:     opts.Omit(),
+					},
+				}
 
 				if err != nil {
 					log.Printf("Speed %s->%s failed: %v", src.Name, dst.Name, err)
-					errStr = err.Error()
+					result.Error = err.Error()
+					result.ErrorClass = ErrorClass(err)
 				} else {
-					bw = resp.BandwidthMbps
-					log.Printf("Speed %s->%s success: %.2fMbps", src.Name, dst.Name, bw)
+					result.BandwidthMbps = resp.BandwidthMbps
+					result.ReverseBandwidthMbps = resp.ReverseBandwidthMbps
+					result.TCP = toDBTCPStats(resp.TCP)
+					result.SenderBandwidthMbps = resp.SenderBandwidthMbps
+					result.ReceiverBandwidthMbps = resp.ReceiverBandwidthMbps
+					result.ReverseSenderBandwidthMbps = resp.ReverseSenderBandwidthMbps
+					log.Printf("Speed %s->%s success: %.2fMbps (reverse %.2fMbps)", src.Name, dst.Name,
+						result.BandwidthMbps, result.ReverseBandwidthMbps)
 				}
 
 				// Save result
-				if err := s.db.AddResult(src.ID, dst.ID, "speed", 0, 0, 0, bw, errStr); err != nil {
+				id, err := s.db.SaveResult(result)
+				if err != nil {
 					log.Printf("Failed to save result: %v", err)
+				} else {
+					result.ID = id
+					if resp != nil && len(resp.Samples) > 0 {
+						if err := s.db.SaveSamples(id, toDBSamples(resp.Samples)); err != nil {
+							log.Printf("Failed to save samples: %v", err)
+						}
+					}
 				}
 
 				if s.OnResult != nil {
-					s.OnResult(db.Result{
-						SourceID:      src.ID,
-						TargetID:      dst.ID,
-						Type:          "speed",
-						BandwidthMbps: bw,
-						Timestamp:     time.Now().UTC().Format("2006-01-02 15:04:05"),
-						Error:         errStr,
-					})
+					result.Timestamp = time.Now().UTC().Format("2006-01-02 15:04:05")
+					s.OnResult(result)
 				}
 			}(source, target)
 		}
@@ -349,4 +781,252 @@ func (s *Scheduler) runAllSpeedsInternal() {
 	if s.OnStatus != nil {
 		s.OnStatus("Idle")
 	}
+	return nil
+}
+
+// runAllBufferbloatInternal executes all latency-under-load tests (called by queue worker)
+func (s *Scheduler) runAllBufferbloatInternal(ctx context.Context, override *SpeedTestOptions, pairs *pairOutcomes) error {
+	log.Println("Running Bufferbloat tests...")
+	devices, err := s.db.GetDevices()
+	if err != nil {
+		log.Printf("Failed to get devices: %v", err)
+		return err
+	}
+	pairs.total = len(devices) * (len(devices) - 1)
+	resolveOptions := s.loadTestOptions("bufferbloat", override)
+	timeouts := s.pairTimeouts()
+	// The idle probe train runs before the load
+	probes := time.Duration(s.orch.PingCount) * s.orch.PingInterval
+
+pairs:
+	for _, source := range devices {
+		for _, target := range devices {
+			if source.ID == target.ID {
+				continue
+			}
+			if aborted(ctx, "Bufferbloat tests") {
+				break pairs
+			}
+			// Run sequentially
+			func(src, dst db.Device) {
+				if s.OnStatus != nil {
+					s.OnStatus("Bufferbloat Test " + src.Name + " -> " + dst.Name)
+				}
+				opts := resolveOptions(src, dst)
+				testCtx, cancel := s.testContext(ctx, timeouts, src, dst, probes+loadTestDuration(opts))
+				defer cancel()
+				resp, err := s.orch.RunBufferbloat(testCtx, src, dst, opts)
+				pairs.add(err)
+
+				result := db.Result{
+					SourceID:  src.ID,
+					TargetID:  dst.ID,
+					Type:      "bufferbloat",
+					Direction: opts.Direction,
+					Streams:   opts.Parallel,
+					TestOptions: db.TestOptions{
+						DurationSeconds: opts.DurationSeconds,
+						BufferSize:      opts.BufferSize,
+						OmitSeconds:     opts.Omit(),
+					},
+				}
+				if resp != nil {
+					// Partial results (e.g. idle latency) are kept even when the test failed
+					result.LatencyMs = resp.IdleLatencyMs
+					result.LoadedLatencyMs = resp.LoadedLatencyMs
+					result.BufferbloatMs = resp.BufferbloatMs
+					result.BufferbloatGrade = resp.BufferbloatGrade
+					result.JitterMs = resp.JitterMs
+					result.PacketLoss = resp.PacketLoss
+					result.BandwidthMbps = resp.BandwidthMbps
+					result.ReverseBandwidthMbps = resp.ReverseBandwidthMbps
+					result.TCP = toDBTCPStats(resp.TCP)
+					result.SenderBandwidthMbps = resp.SenderBandwidthMbps
+					result.ReceiverBandwidthMbps = resp.ReceiverBandwidthMbps
+					result.ReverseSenderBandwidthMbps = resp.ReverseSenderBandwidthMbps
+				}
+				if err != nil {
+					log.Printf("Bufferbloat %s->%s failed: %v", src.Name, dst.Name, err)
+					result.Error = err.Error()
+					result.ErrorClass = ErrorClass(err)
+				} else {
+					log.Printf("Bufferbloat %s->%s success: idle %.2fms, loaded %.2fms (grade %s)", src.Name, dst.Name,
+						result.LatencyMs, result.LoadedLatencyMs, result.BufferbloatGrade)
+				}
+
+				// Save result
+				id, err := s.db.SaveResult(result)
+				if err != nil {
+					log.Printf("Failed to save result: %v", err)
+				} else {
+					result.ID = id
+				}
+
+				if s.OnResult != nil {
+					result.Timestamp = time.Now().UTC().Format("2006-01-02 15:04:05")
+					s.OnResult(result)
+				}
+			}(source, target)
+		}
+	}
+	if s.OnStatus != nil {
+		s.OnStatus("Idle")
+	}
+	return nil
+}
+
+// runTraceInternal traces one pair and discovers its path MTU (called by queue worker)
+func (s *Scheduler) runTraceInternal(ctx context.Context, t TraceTask, pairs *pairOutcomes) error {
+	devices, err := s.db.GetDevices()
+	if err != nil {
+		log.Printf("Failed to get devices: %v", err)
+		return err
+	}
+	var src, dst *db.Device
+	for i := range devices {
+		switch devices[i].ID {
+		case t.SourceID:
+			src = &devices[i]
+		case t.TargetID:
+			dst = &devices[i]
+		}
+	}
+	if src == nil || dst == nil {
+		log.Printf("Trace %d->%d skipped: device no longer exists", t.SourceID, t.TargetID)
+		return fmt.Errorf("device %d or %d no longer exists", t.SourceID, t.TargetID)
+	}
+	// Both tests count as one pair, failed if either failed
+	pairs.total = 1
+	protocol := t.Protocol
+	if protocol == "" {
+		protocol = TraceUDP
+	}
+
+	timeouts := s.pairTimeouts()
+
+	if s.OnStatus != nil {
+		s.OnStatus("Trace " + src.Name + " -> " + dst.Name)
+	}
+	testCtx, cancel := s.testContext(ctx, timeouts, *src, *dst, traceDuration(t.TraceOptions))
+	resp, err := s.orch.RunTrace(testCtx, *src, *dst, t.TraceOptions)
+	cancel()
+	trace := db.Result{SourceID: src.ID, TargetID: dst.ID, Type: "trace", Protocol: protocol}
+	var hops []db.TraceHop
+	if resp != nil {
+		// Hops up to where the trace stopped are kept even when it failed
+		trace.LatencyMs = resp.LatencyMs
+		trace.HopCount = len(resp.Hops)
+		hops = toDBTraceHops(resp.Hops)
+	}
+	if err != nil {
+		log.Printf("Trace %s->%s failed: %v", src.Name, dst.Name, err)
+		trace.Error = err.Error()
+		trace.ErrorClass = ErrorClass(err)
+	} else {
+		log.Printf("Trace %s->%s success: %d hops, %.2fms", src.Name, dst.Name, trace.HopCount, trace.LatencyMs)
+	}
+	id, err := s.db.SaveResult(trace)
+	if err != nil {
+		log.Printf("Failed to save result: %v", err)
+	} else {
+		trace.ID = id
+		if len(hops) > 0 {
+			if err := s.db.SaveTraceHops(id, hops); err != nil {
+				log.Printf("Failed to save trace hops: %v", err)
+			}
+		}
+	}
+	if s.OnResult != nil {
+		trace.Timestamp = time.Now().UTC().Format("2006-01-02 15:04:05")
+		s.OnResult(trace)
+	}
+
+	if aborted(ctx, "Trace") {
+		pairs.add(context.Cause(ctx))
+		if s.OnStatus != nil {
+			s.OnStatus("Idle")
+		}
+		return nil
+	}
+	traceErr := err
+	if s.OnStatus != nil {
+		s.OnStatus("Path MTU " + src.Name + " -> " + dst.Name)
+	}
+	testCtx, cancel = s.testContext(ctx, timeouts, *src, *dst, pmtuDuration())
+	resp, err = s.orch.RunPMTU(testCtx, *src, *dst)
+	cancel()
+	if traceErr != nil {
+		pairs.add(traceErr)
+	} else {
+		pairs.add(err)
+	}
+	pmtu := db.Result{SourceID: src.ID, TargetID: dst.ID, Type: "pmtu"}
+	if err != nil {
+		log.Printf("Path MTU %s->%s failed: %v", src.Name, dst.Name, err)
+		pmtu.Error = err.Error()
+		pmtu.ErrorClass = ErrorClass(err)
+	} else {
+		pmtu.PathMTU = resp.PathMTU
+		log.Printf("Path MTU %s->%s success: %d bytes", src.Name, dst.Name, pmtu.PathMTU)
+	}
+	if id, err := s.db.SaveResult(pmtu); err != nil {
+		log.Printf("Failed to save result: %v", err)
+	} else {
+		pmtu.ID = id
+	}
+	if s.OnResult != nil {
+		pmtu.Timestamp = time.Now().UTC().Format("2006-01-02 15:04:05")
+		s.OnResult(pmtu)
+	}
+
+	if s.OnStatus != nil {
+		s.OnStatus("Idle")
+	}
+	return nil
+}
+
+// toDBTraceHops converts the worker's traceroute hops for storage
+func toDBTraceHops(hops []TraceHop) []db.TraceHop {
+	out := make([]db.TraceHop, len(hops))
+	for i, h := range hops {
+		out[i] = db.TraceHop{
+			TTL:      h.TTL,
+			Address:  h.Address,
+			Sent:     h.Sent,
+			Received: h.Received,
+			RttMinMs: h.RttMinMs,
+			RttAvgMs: h.RttAvgMs,
+			RttMaxMs: h.RttMaxMs,
+		}
+	}
+	return out
+}
+
+// toDBSamples converts the worker's throughput samples for storage
+func toDBSamples(samples []IntervalSample) []db.Sample {
+	out := make([]db.Sample, len(samples))
+	for i, sm := range samples {
+		out[i] = db.Sample{
+			StartSeconds:         sm.Start,
+			EndSeconds:           sm.End,
+			BytesSent:            sm.BytesSent,
+			BytesReceived:        sm.BytesReceived,
+			BandwidthMbps:        sm.BandwidthMbps,
+			ReverseBandwidthMbps: sm.ReverseBandwidthMbps,
+		}
+	}
+	return out
+}
+
+// toDBTCPStats converts the worker's TCP statistics for storage
+func toDBTCPStats(stats *TCPStats) *db.TCPStats {
+	if stats == nil {
+		return nil
+	}
+	return &db.TCPStats{
+		Retransmits: stats.Retransmits,
+		RttMs:       stats.RttMs,
+		RttVarMs:    stats.RttVarMs,
+		Cwnd:        stats.Cwnd,
+	}
 }
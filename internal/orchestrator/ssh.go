@@ -3,7 +3,12 @@ package orchestrator
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -11,9 +16,22 @@ import (
 
 type SSHClient struct {
 	client *ssh.Client
+
+	// closeJump releases the jump host connection this one is tunnelled through
+	closeJump func()
+
+	// The worker verified on this connection, so reused connections skip the
+	// deploy check, and how many tests are using it
+	mu           sync.Mutex
+	arch         string
+	workerPath   string
+	workerSHA256 string
+	workerUsers  int
 }
 
-func ConnectSSH(user, host string, port int, authMethods []ssh.AuthMethod) (*SSHClient, error) {
+// ConnectSSH dials host, tunnelling through jump if it isn't nil. A nil
+// hostKeyCallback accepts any host key.
+func ConnectSSH(user, host string, port int, authMethods []ssh.AuthMethod, hostKeyCallback ssh.HostKeyCallback, jump *SSHClient) (*SSHClient, error) {
 	if len(authMethods) == 0 {
 		key, err := os.ReadFile("/root/.ssh/id_rsa")
 		if err != nil {
@@ -28,29 +46,70 @@ func ConnectSSH(user, host string, port int, authMethods []ssh.AuthMethod) (*SSH
 		}
 	}
 
+	if hostKeyCallback == nil {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+
 	config := &ssh.ClientConfig{
 		User:            user,
 		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback,
 		Timeout:         10 * time.Second,
 	}
 
-	addr := fmt.Sprintf("%s:%d", host, port)
-	client, err := ssh.Dial("tcp", addr, config)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if jump == nil {
+		client, err := ssh.Dial("tcp", addr, config)
+		if err != nil {
+			return nil, err
+		}
+		return &SSHClient{client: client}, nil
+	}
+
+	// Only this SSH connection goes through the jump host; test traffic doesn't
+	conn, err := jump.client.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("jump host can't reach %s: %w", addr, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
-
-	return &SSHClient{client: client}, nil
+	return &SSHClient{client: ssh.NewClient(c, chans, reqs)}, nil
 }
 
 func (s *SSHClient) Close() error {
+	var err error
 	if s.client != nil {
-		return s.client.Close()
+		err = s.client.Close()
 	}
-	return nil
+	if s.closeJump != nil {
+		s.closeJump()
+	}
+	return err
 }
 
+// Alive reports whether the server answers a keepalive within timeout
+func (s *SSHClient) Alive(timeout time.Duration) bool {
+	if s.client == nil {
+		return false
+	}
+	answered := make(chan error, 1)
+	go func() {
+		_, _, err := s.client.SendRequest("keepalive@openssh.com", true, nil)
+		answered <- err
+	}()
+	select {
+	case err := <-answered:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// CopyFile uploads localPath next to remotePath and renames it into place, so
+// a running copy of the old file is never replaced halfway
 func (s *SSHClient) CopyFile(localPath, remotePath string, mode os.FileMode) error {
 	f, err := os.Open(localPath)
 	if err != nil {
@@ -65,7 +124,9 @@ func (s *SSHClient) CopyFile(localPath, remotePath string, mode os.FileMode) err
 	defer func() { _ = session.Close() }()
 
 	session.Stdin = f
-	cmd := fmt.Sprintf("rm -f %s && cat > %s && chmod %o %s", remotePath, remotePath, mode, remotePath)
+	tmp := shellQuote(remotePath + ".partial")
+	cmd := fmt.Sprintf("cat > %[1]s && chmod %[2]o %[1]s && mv -f %[1]s %[3]s || { rm -f %[1]s; exit 1; }",
+		tmp, mode, shellQuote(remotePath))
 	if err = session.Run(cmd); err != nil {
 		return fmt.Errorf("failed to copy file: %w", err)
 	}
@@ -79,18 +140,37 @@ func (s *SSHClient) FileExists(path string) bool {
 		return false
 	}
 	defer func() { _ = session.Close() }()
-	err = session.Run(fmt.Sprintf("test -f %s", path))
+	err = session.Run(fmt.Sprintf("test -f %s", shellQuote(path)))
 	return err == nil
 }
 
+// FileSHA256 returns the hex SHA-256 of a remote file, or "" if it doesn't exist
+func (s *SSHClient) FileSHA256(path string) (string, error) {
+	q := shellQuote(path)
+	stdout, stderr, err := s.RunCommand(fmt.Sprintf("if [ -f %[1]s ]; then sha256sum %[1]s || shasum -a 256 %[1]s; fi", q))
+	if err != nil {
+		return "", fmt.Errorf("checksum failed: %w (stderr: %s)", err, stderr)
+	}
+	sum, _, _ := strings.Cut(stdout, " ")
+	return sum, nil
+}
+
 // RunCommand executes a command and returns stdout and stderr separately.
 func (s *SSHClient) RunCommand(cmd string) (string, string, error) {
+	return s.RunCommandWithInput(cmd, nil)
+}
+
+// RunCommandWithInput is RunCommand with input fed to the command's stdin
+func (s *SSHClient) RunCommandWithInput(cmd string, input []byte) (string, string, error) {
 	session, err := s.client.NewSession()
 	if err != nil {
 		return "", "", err
 	}
 	defer func() { _ = session.Close() }()
 
+	if input != nil {
+		session.Stdin = bytes.NewReader(input)
+	}
 	var stdout, stderr bytes.Buffer
 	session.Stdout = &stdout
 	session.Stderr = &stderr
@@ -102,3 +182,73 @@ func (s *SSHClient) RunCommand(cmd string) (string, string, error) {
 
 	return string(bytes.TrimSpace(cleanOut)), string(bytes.TrimSpace(cleanErr)), err
 }
+
+// RemoteProcess is a command started with StartCommand
+type RemoteProcess struct {
+	session *ssh.Session
+	Stdin   io.WriteCloser
+	Stdout  io.Reader
+
+	done chan struct{} // closed when the command exited
+	err  error         // its exit status, once done
+}
+
+// StartCommand starts cmd in a new session without waiting for it to exit.
+// Stderr is copied to stderr if non-nil. The caller must keep reading Stdout
+// and Stop the process when done.
+func (s *SSHClient) StartCommand(cmd string, stderr io.Writer) (*RemoteProcess, error) {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	session.Stderr = stderr
+	if err := session.Start(cmd); err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	proc := &RemoteProcess{session: session, Stdin: stdin, Stdout: stdout, done: make(chan struct{})}
+	go func() {
+		proc.err = session.Wait()
+		close(proc.done)
+	}()
+	return proc, nil
+}
+
+// Output returns the process's stdout
+func (p *RemoteProcess) Output() io.Reader {
+	return p.Stdout
+}
+
+// Wait waits for the process to exit and returns its exit status
+func (p *RemoteProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+// Stop closes the process's stdin and waits up to timeout for it to exit,
+// then kills it. Not every sshd delivers the signal, so the worker also exits
+// when its stdin closes.
+func (p *RemoteProcess) Stop(timeout time.Duration) {
+	_ = p.Stdin.Close()
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		_ = p.session.Signal(ssh.SIGKILL)
+	}
+	_ = p.session.Close()
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
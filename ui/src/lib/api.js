@@ -6,17 +6,80 @@
  * @property {string} ip
  * @property {string} ssh_user
  * @property {number} ssh_port
+ * @property {''|'ssh'|'local'|'agent'} [transport] - local runs the worker on the server host itself, agent through a worker that dials in
+ * @property {number} [worker_port_min] - worker server port range; unset uses WORKER_PORT_RANGE
+ * @property {number} [worker_port_max]
+ * @property {string} [arch] - worker build, e.g. linux/arm64; detected with uname when empty
+ * @property {string} [install_dir] - where the worker is installed; empty picks /tmp or a fallback
+ * @property {''|'keep'|'after_run'|'on_delete'} [worker_cleanup] - when the worker is removed again
+ * @property {Credential} [credential] - omitted or empty type uses the server's default key
+ * @property {number} [jump_device_id] - SSH through this device
+ * @property {string} [jump_host] - or through [user@]host[:port] jump hosts, comma separated
+ * @property {string} [worker_path] - worker build last verified on the device (read-only)
+ * @property {string} [worker_version]
+ * @property {string} [worker_sha256]
+ * @property {string} [worker_deployed_at] - when a different build was last installed
+ * @property {string} [agent_last_seen] - last heartbeat of the device's agent (read-only)
+ * @property {boolean} [agent_online] - whether the agent is connected right now (read-only)
+ */
+
+/**
+ * @typedef {Object} Credential
+ * @property {''|'key_file'|'private_key'|'agent'|'password'} type
+ * @property {string} [key_path]
+ * @property {string} [private_key] - masked as "********" when read; send it back unchanged to keep it
+ * @property {string} [passphrase] - masked like private_key
+ * @property {string} [agent_socket] - default $SSH_AUTH_SOCK
+ * @property {string} [password] - masked like private_key
  */
 
 /**
  * @typedef {Object} Result
+ * @property {number} id
  * @property {number} source_id
  * @property {number} target_id
- * @property {string} type
+ * @property {string} type - ping, speed, bufferbloat, trace or pmtu
  * @property {number} latency_ms
+ * @property {number} jitter_ms
+ * @property {number} packet_loss
  * @property {number} bandwidth_mbps
+ * @property {string} [direction]
+ * @property {number} reverse_bandwidth_mbps
+ * @property {number} [sender_bandwidth_mbps] - Source write rate; bandwidth_mbps is receiver-measured when available
+ * @property {number} [receiver_bandwidth_mbps]
+ * @property {number} [reverse_sender_bandwidth_mbps]
+ * @property {number} [streams]
+ * @property {number} [loaded_latency_ms] - Bufferbloat tests; latency_ms is the idle latency
+ * @property {number} [bufferbloat_ms]
+ * @property {string} [bufferbloat_grade]
+ * @property {{retransmits: number, rtt_ms: number, rttvar_ms: number, cwnd: number}} [tcp] - Linux TCP_INFO from the client
+ * @property {string} [protocol] - Trace probe protocol (udp or tcp)
+ * @property {number} [hop_count] - Trace results; latency_ms is the RTT to the target
+ * @property {number} [path_mtu] - Path MTU results, in bytes
  * @property {string} timestamp
  * @property {string} error
+ * @property {'error'|'timeout'|'cancelled'} [error_class] - Set on failed results
+ */
+
+/**
+ * @typedef {Object} TraceHop
+ * @property {number} ttl
+ * @property {string} address - Empty when no probe was answered
+ * @property {number} sent
+ * @property {number} received
+ * @property {number} rtt_min_ms
+ * @property {number} rtt_avg_ms
+ * @property {number} rtt_max_ms
+ */
+
+/**
+ * @typedef {Object} Sample
+ * @property {number} start_seconds - Offset from the start of the measured window
+ * @property {number} end_seconds
+ * @property {number} bytes_sent
+ * @property {number} bytes_received
+ * @property {number} bandwidth_mbps
+ * @property {number} reverse_bandwidth_mbps
  */
 
 const API_BASE = '/api';
@@ -78,12 +141,88 @@ export async function deleteDevice(id) {
     if (!res.ok) throw new Error('Failed to delete device');
 }
 
+/**
+ * @typedef {Object} HostKey
+ * @property {number} device_id
+ * @property {string} key_type
+ * @property {string} public_key - base64, as in known_hosts
+ * @property {string} fingerprint - SHA256:...
+ * @property {string} first_seen
+ */
+
+/**
+ * Fetch the SSH host key pinned for a device
+ * @param {number} id
+ * @returns {Promise<HostKey|null>} null if no key is pinned yet
+ */
+export async function getDeviceHostKey(id) {
+    const res = await fetch(`${API_BASE}/devices/${id}/hostkey`);
+    if (res.status === 404) return null;
+    if (!res.ok) throw new Error('Failed to fetch host key');
+    return res.json();
+}
+
+/**
+ * Forget a device's pinned host key so the next connection pins a new one
+ * @param {number} id
+ */
+export async function resetDeviceHostKey(id) {
+    const res = await fetch(`${API_BASE}/devices/${id}/hostkey`, {
+        method: 'DELETE',
+    });
+    if (!res.ok) throw new Error('Failed to reset host key');
+}
+
+/**
+ * Remove the worker binary from a device
+ * @param {number} id
+ */
+export async function uninstallDeviceWorker(id) {
+    const res = await fetch(`${API_BASE}/devices/${id}/worker`, {
+        method: 'DELETE',
+    });
+    if (!res.ok) {
+        const text = await res.text();
+        throw new Error(text || 'Failed to uninstall worker');
+    }
+}
+
+/**
+ * Issue a new enrollment token for a device's agent; the previous one stops working
+ * @param {number} id
+ * @returns {Promise<string>}
+ */
+export async function issueAgentToken(id) {
+    const res = await fetch(`${API_BASE}/devices/${id}/agent-token`, {
+        method: 'POST',
+    });
+    if (!res.ok) {
+        const text = await res.text();
+        throw new Error(text || 'Failed to issue agent token');
+    }
+    const data = await res.json();
+    return data.token;
+}
+
 /**
  * @typedef {Object} Schedule
  * @property {number} id
  * @property {string} type
  * @property {string} cron
  * @property {boolean} enabled
+ * @property {number} duration_seconds - Speed test length, 0 = default
+ * @property {number} buffer_size - Write buffer in bytes, 0 = default
+ * @property {number} omit_seconds - Warm-up excluded from results
+ */
+
+/**
+ * @typedef {Object} SpeedTestOptions
+ * @property {string} [direction] - forward, reverse or bidir
+ * @property {number} [parallel]
+ * @property {number} [duration_seconds]
+ * @property {number} [buffer_size]
+ * @property {number} [omit_seconds] - 0 turns off the schedule's warm-up
+ * @property {number} [sample_interval_ms]
  */
 
 /**
@@ -101,12 +240,13 @@ export async function getSchedules() {
  * @param {string} type
  * @param {string} cron
  * @param {boolean} enabled
+ * @param {{duration_seconds?: number, buffer_size?: number, omit_seconds?: number}} [options]
  */
-export async function updateSchedule(type, cron, enabled) {
+export async function updateSchedule(type, cron, enabled, options = {}) {
     const res = await fetch(`${API_BASE}/schedules`, {
         method: 'PUT',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ type, cron, enabled }),
+        body: JSON.stringify({ type, cron, enabled, ...options }),
     });
     if (!res.ok) throw new Error('Failed to update schedule');
 }
@@ -128,22 +268,81 @@ export async function getHistory(limit = 100, type = '') {
     return res.json();
 }
 
+/**
+ * Fetch the throughput time series of a speed test result
+ * @param {number} resultId
+ * @returns {Promise<Sample[]>}
+ */
+export async function getResultSamples(resultId) {
+    const res = await fetch(`${API_BASE}/results/${resultId}/samples`);
+    if (!res.ok) throw new Error('Failed to fetch samples');
+    return res.json();
+}
+
+/**
+ * @param {number} resultId
+ * @returns {Promise<TraceHop[]>}
+ */
+export async function getResultHops(resultId) {
+    const res = await fetch(`${API_BASE}/results/${resultId}/hops`);
+    if (!res.ok) throw new Error('Failed to fetch trace hops');
+    return res.json();
+}
+
+// Marks tests started from the UI as manual rather than API triggered
+const MANUAL = { 'X-Task-Source': 'manual' };
+
 /**
  * Trigger all pings manually
  */
 export async function triggerPingAll() {
-    const res = await fetch(`${API_BASE}/test/ping/all`, { method: 'POST' });
+    const res = await fetch(`${API_BASE}/test/ping/all`, { method: 'POST', headers: MANUAL });
     if (!res.ok) throw new Error('Failed to trigger pings');
 }
 
 /**
  * Trigger all speed tests manually
+ * @param {SpeedTestOptions} [options] - Overrides the speed schedule's options for this run
  */
-export async function triggerSpeedAll() {
-    const res = await fetch(`${API_BASE}/test/speed/all`, { method: 'POST' });
+export async function triggerSpeedAll(options) {
+    const init = { method: 'POST', headers: MANUAL };
+    if (options) {
+        init.headers = { ...MANUAL, 'Content-Type': 'application/json' };
+        init.body = JSON.stringify(options);
+    }
+    const res = await fetch(`${API_BASE}/test/speed/all`, init);
     if (!res.ok) throw new Error('Failed to trigger speed tests');
 }
 
+/**
+ * Trigger all latency-under-load (bufferbloat) tests manually
+ * @param {SpeedTestOptions} [options] - Overrides the bufferbloat schedule's options for this run
+ */
+export async function triggerBufferbloatAll(options) {
+    const init = { method: 'POST', headers: MANUAL };
+    if (options) {
+        init.headers = { ...MANUAL, 'Content-Type': 'application/json' };
+        init.body = JSON.stringify(options);
+    }
+    const res = await fetch(`${API_BASE}/test/bufferbloat/all`, init);
+    if (!res.ok) throw new Error('Failed to trigger bufferbloat tests');
+}
+
+/**
+ * Trace the route and discover the path MTU between two devices
+ * @param {number} sourceId
+ * @param {number} targetId
+ * @param {{protocol?: string, max_hops?: number}} [options] - protocol is udp (default) or tcp
+ */
+export async function triggerTrace(sourceId, targetId, options = {}) {
+    const res = await fetch(`${API_BASE}/test/trace`, {
+        method: 'POST',
+        headers: { ...MANUAL, 'Content-Type': 'application/json' },
+        body: JSON.stringify({ source_id: sourceId, target_id: targetId, ...options })
+    });
+    if (!res.ok) throw new Error('Failed to trigger trace');
+}
+
 /**
  * @typedef {Object} ScheduleStatus
  * @property {string} type
@@ -162,6 +361,51 @@ export async function getScheduleStatus() {
     return res.json();
 }
 
+// Pair Settings
+
+/**
+ * @typedef {Object} PairSetting
+ * @property {number} source_id
+ * @property {number} target_id
+ * @property {number|null} parallel_streams
+ * @property {number|null} timeout_seconds - Overrides TEST_TIMEOUT for this pair
+ */
+
+/**
+ * Fetch per device pair settings
+ * @returns {Promise<PairSetting[]>}
+ */
+export async function getPairSettings() {
+    const res = await fetch(`${API_BASE}/pair-settings`);
+    if (!res.ok) throw new Error('Failed to fetch pair settings');
+    return res.json();
+}
+
+/**
+ * Create or update the settings for a device pair
+ * @param {PairSetting} setting
+ */
+export async function updatePairSetting(setting) {
+    const res = await fetch(`${API_BASE}/pair-settings`, {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(setting),
+    });
+    if (!res.ok) throw new Error('Failed to update pair setting');
+}
+
+/**
+ * Reset a device pair to the global defaults
+ * @param {number} sourceId
+ * @param {number} targetId
+ */
+export async function deletePairSetting(sourceId, targetId) {
+    const res = await fetch(`${API_BASE}/pair-settings/${sourceId}/${targetId}`, {
+        method: 'DELETE',
+    });
+    if (!res.ok) throw new Error('Failed to delete pair setting');
+}
+
 // Queue Status
 
 /**
@@ -169,6 +413,7 @@ export async function getScheduleStatus() {
  * @property {string} id
  * @property {string} type
  * @property {number} priority
+ * @property {'schedule'|'manual'|'api'} [source]
  * @property {string} created_at
  */
 
@@ -177,6 +422,7 @@ export async function getScheduleStatus() {
  * @property {Task|null} running
  * @property {Task[]} queued
  * @property {number} length
+ * @property {boolean} paused - Queued tasks wait until the queue is resumed
  */
 
 /**
@@ -189,6 +435,90 @@ export async function getQueueStatus() {
     return res.json();
 }
 
+/**
+ * Drop a queued task or abort the running one
+ * @param {string} id
+ */
+export async function cancelTask(id) {
+    const res = await fetch(`${API_BASE}/queue/${id}`, {
+        method: 'DELETE',
+    });
+    if (!res.ok) throw new Error('Failed to cancel task');
+}
+
+/**
+ * Move a queued task ahead of the others of its priority
+ * @param {string} id
+ * @param {number} [priority] - 0 (normal) or 1 (high, the default: run next)
+ * @returns {Promise<QueueStatus>}
+ */
+export async function setTaskPriority(id, priority) {
+    const res = await fetch(`${API_BASE}/queue/${id}/priority`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: priority === undefined ? undefined : JSON.stringify({ priority }),
+    });
+    if (!res.ok) throw new Error('Failed to reprioritize task');
+    return res.json();
+}
+
+/**
+ * Stop dispatching queued tasks; the running task carries on
+ * @returns {Promise<QueueStatus>}
+ */
+export async function pauseQueue() {
+    const res = await fetch(`${API_BASE}/queue/pause`, { method: 'POST' });
+    if (!res.ok) throw new Error('Failed to pause queue');
+    return res.json();
+}
+
+/**
+ * Dispatch queued tasks again
+ * @returns {Promise<QueueStatus>}
+ */
+export async function resumeQueue() {
+    const res = await fetch(`${API_BASE}/queue/resume`, { method: 'POST' });
+    if (!res.ok) throw new Error('Failed to resume queue');
+    return res.json();
+}
+
+/**
+ * @typedef {Object} TaskRecord
+ * @property {string} id
+ * @property {string} type
+ * @property {number} priority
+ * @property {'schedule'|'manual'|'api'} source
+ * @property {'queued'|'running'|'done'|'failed'|'cancelled'} status
+ * @property {Object} [payload] - The task's options
+ * @property {string} [error]
+ * @property {string} created_at
+ * @property {string} [started_at]
+ * @property {string} [finished_at]
+ * @property {number} [duration_seconds]
+ * @property {number} pairs_total
+ * @property {number} pairs_succeeded
+ * @property {number} pairs_failed
+ * @property {number} pairs_timed_out
+ * @property {number} pairs_cancelled
+ */
+
+/**
+ * Fetch a page of the task history, newest first
+ * @param {{limit?: number, offset?: number, status?: string}} [query] - limit defaults to 50, at most 500
+ * @returns {Promise<{tasks: TaskRecord[], total: number}>}
+ */
+export async function getTasks({ limit = 50, offset = 0, status = '' } = {}) {
+    const url = new URL(`${window.location.origin}${API_BASE}/tasks`);
+    url.searchParams.append('limit', limit.toString());
+    url.searchParams.append('offset', offset.toString());
+    if (status) {
+        url.searchParams.append('status', status);
+    }
+    const res = await fetch(url.toString());
+    if (!res.ok) throw new Error('Failed to fetch tasks');
+    return res.json();
+}
+
 // Notification Settings
 
 /**